@@ -17,6 +17,9 @@ var DB *gorm.DB
 
 var PRIVKEY string
 
+// DSN is what DB connected with, for connections gorm can't provide
+var DSN string
+
 // ConnectToDB connects the server with database
 func ConnectToDB() {
 	err := godotenv.Load()
@@ -52,6 +55,8 @@ func ConnectToDB() {
 	dsn := fmt.Sprintf("host=localhost user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Kolkata",
 		user, password, dbname, port)
 
+	DSN = dsn
+
 	log.Print("Connecting to Postgres DB...")
 	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
@@ -69,6 +74,18 @@ func ConnectToDB() {
 		&models.User{}, 
 		&models.Claims{},
 		&models.Video{},
+		&models.Job{},
+		&models.Narrator{},
+		&models.StockClip{},
+		&models.ScriptVersion{},
+		&models.Scene{},
+		&models.SceneVersion{},
+		&models.Schedule{},
+		&models.Publication{},
+		&models.VideoVariant{},
+		&models.MusicTrack{},
+		&models.PublishingAccount{},
+		&models.TelegramLink{},
 
 		// billing
 		&models.Subscription{},
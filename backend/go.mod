@@ -20,6 +20,7 @@ require (
 	github.com/lib/pq v1.3.0
 	github.com/resend/resend-go/v2 v2.9.0
 	github.com/sashabaranov/go-openai v1.27.1
+	github.com/valyala/fasthttp v1.16.0
 	google.golang.org/api v0.189.0
 	gorm.io/driver/postgres v1.0.5
 	gorm.io/gorm v1.20.5
@@ -61,7 +62,6 @@ require (
 	github.com/tidwall/pretty v1.2.1 // indirect
 	github.com/tidwall/sjson v1.2.5 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.16.0 // indirect
 	github.com/valyala/tcplisten v0.0.0-20161114210144-ceec8f93295a // indirect
 	go.opencensus.io v0.24.0 // indirect
 	go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc v0.51.0 // indirect
@@ -5,6 +5,7 @@ import (
 
 	"go-authentication-boilerplate/database"
 	"go-authentication-boilerplate/router"
+	"go-authentication-boilerplate/util"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -13,12 +14,33 @@ import (
 // CreateServer creates a new Fiber instance
 func CreateServer() *fiber.App {
 	app := fiber.New()
+
+	// only the music uploads get a larger body limit
+	app.Server().HeaderReceived = router.MusicUploadRequestConfig
 	return app
 }
 
 func main() {
 	// Connect to Postgres
 	database.ConnectToDB()
+	util.SeedNarrators()
+	util.SeedMusicTracks()
+
+	// deliver the progress of videos to clients connected to any server
+	util.StartVideoEventRelay()
+
+	// where the artifacts of the pipeline are kept
+	util.InitBlobStore()
+
+	// pick up queued and abandoned video jobs
+	util.StartJobWorkers()
+
+	// create the videos of recurring schedules
+	util.StartScheduler()
+
+	// delete expired videos and leftover artifacts
+	util.StartSweeper()
+
 	app := CreateServer()
 
 	app.Use(cors.New())
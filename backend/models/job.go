@@ -0,0 +1,36 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	JobStatusQueued    = "queued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job is a unit of background work (e.g. generating a video) that is
+// persisted so it survives restarts of the server
+type Job struct {
+	Base
+	Type        string `json:"type" gorm:"not null;index"`
+	VideoID     string `json:"videoID" gorm:"index"`
+	Payload     string `json:"payload" gorm:"type:text"`
+	Status      string `json:"status" gorm:"not null;default:queued;index"`
+	Attempts    int    `json:"attempts" gorm:"default:0"`
+	MaxAttempts int    `json:"maxAttempts" gorm:"default:3"`
+	Error       string `json:"error" gorm:"null"`
+
+	// the worker currently holding the job and until when it holds it.
+	// a job whose lease ran out is considered abandoned and is picked up again
+	LeaseOwner     string     `json:"leaseOwner" gorm:"null"`
+	LeaseExpiresAt *time.Time `json:"leaseExpiresAt" gorm:"null"`
+	HeartbeatAt    *time.Time `json:"heartbeatAt" gorm:"null"`
+
+	RunAfter   time.Time  `json:"runAfter"`
+	StartedAt  *time.Time `json:"startedAt" gorm:"null"`
+	FinishedAt *time.Time `json:"finishedAt" gorm:"null"`
+}
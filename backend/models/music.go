@@ -0,0 +1,23 @@
+package models
+
+// MusicTrack is a background music track. Name is what Video.BackgroundMusic
+// holds. Tracks without an owner are the catalog everyone can pick from, the
+// ones users upload are private to them
+type MusicTrack struct {
+	Base
+	Name     string  `json:"name" gorm:"unique;not null"`
+	Title    string  `json:"title" gorm:"not null"`
+	Mood     string  `json:"mood"`
+	BPM      int     `json:"bpm"`
+	Duration float64 `json:"duration"` // seconds
+	License  string  `json:"license"`
+	// a blob key for uploaded tracks, a file in BACKGROUND_MUSIC_DIR for the
+	// bundled ones
+	StoragePath string `json:"-" gorm:"not null"`
+	OwnerID     string `json:"ownerID" gorm:"index"`
+	// no DB default: gorm would insert it for false, the seeds and uploads
+	// set it
+	Enabled bool `json:"enabled" gorm:"not null"`
+	// where uploaded tracks can be previewed from, signed on the way out
+	PreviewURL string `json:"previewURL" gorm:"-"`
+}
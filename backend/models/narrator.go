@@ -0,0 +1,15 @@
+package models
+
+// Narrator is a voice that can be picked for a video. Name is what the
+// frontend sends as Video.Narrator, VoiceID is what the provider expects
+type Narrator struct {
+	Base
+	Name        string `json:"name" gorm:"unique;not null"`
+	Description string `json:"description"`
+	Provider    string `json:"provider" gorm:"not null"` // openai or local
+	VoiceID     string `json:"voiceID" gorm:"not null"`
+	Language    string `json:"language" gorm:"default:en"`
+	PreviewURL  string `json:"previewURL" gorm:"null"` // a short sample of the voice
+	// no DB default: gorm would insert it for false, the seeds set it
+	Enabled bool `json:"enabled" gorm:"not null"`
+}
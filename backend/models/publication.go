@@ -0,0 +1,50 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	PublicationStatusPending    = "pending"
+	PublicationStatusPublishing = "publishing"
+	PublicationStatusPublished  = "published"
+	PublicationStatusFailed     = "failed"
+)
+
+// Publication is the posting of a video to one of its PostingMethod
+// destinations (youtube, ...)
+type Publication struct {
+	Base
+	VideoID     string     `json:"videoID" gorm:"not null;uniqueIndex:idx_video_destination"`
+	Destination string     `json:"destination" gorm:"not null;uniqueIndex:idx_video_destination"`
+	Status      string     `json:"status" gorm:"not null;default:pending"`
+	RemoteID    string     `json:"remoteID" gorm:"null"` // the ID of the post on the destination
+	RemoteURL   string     `json:"remoteURL" gorm:"null"`
+	Attempts    int        `json:"attempts" gorm:"default:0"`
+	Error       string     `json:"error" gorm:"null"`
+	PublishedAt *time.Time `json:"publishedAt" gorm:"null"`
+}
+
+// PublishingAccount is the account of a user on a destination that videos
+// are published to
+type PublishingAccount struct {
+	Base
+	OwnerID     string `json:"ownerID" gorm:"not null;uniqueIndex:idx_owner_destination"`
+	Destination string `json:"destination" gorm:"not null;uniqueIndex:idx_owner_destination"`
+	ExternalID  string `json:"externalID"` // the YouTube channel or the telegram chat ID
+	Name        string `json:"name"`
+	// OAuth refresh token (or equivalent credential), never sent to the client
+	Credential string `json:"-" gorm:"type:text"`
+}
+
+// TelegramLink is a chat a user asked to link. It's linked once the code is
+// posted in the chat by one of its admins
+type TelegramLink struct {
+	Base
+	OwnerID   string    `json:"ownerID" gorm:"not null;uniqueIndex"`
+	ChatID    int64     `json:"chatID" gorm:"not null;index:idx_chat_code"`
+	Name      string    `json:"name"`
+	Code      string    `json:"code" gorm:"not null;index:idx_chat_code"`
+	Confirmed bool      `json:"confirmed" gorm:"not null"`
+	ExpiresAt time.Time `json:"expiresAt" gorm:"not null"`
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	SceneStatusPending = "pending"
+	SceneStatusReady   = "ready"
+	SceneStatusFailed  = "failed"
+)
+
+// Scene is one shot of the storyboard of a video: a sentence of the narration
+// and the image (or stock clip) shown while it is narrated
+type Scene struct {
+	Base
+	VideoID    string  `json:"videoID" gorm:"not null;uniqueIndex:idx_video_scene"`
+	SceneIndex int     `json:"index" gorm:"not null;uniqueIndex:idx_video_scene"` // 0-based, in narration order
+	Sentence   string  `json:"sentence"`
+	Start      float64 `json:"start"` // seconds into the narration
+	End        float64 `json:"end"`
+	Prompt     string  `json:"prompt" gorm:"type:text"` // image prompt, or the search query for stock footage
+	Provider   string  `json:"provider" gorm:"null"`    // image provider, or pexels
+	Seed       *int    `json:"seed" gorm:"null"`
+	AssetPath  string  `json:"assetPath" gorm:"null"`
+	Status     string  `json:"status" gorm:"not null;default:pending"`
+	Error      string  `json:"error" gorm:"null"`
+	Version    int     `json:"version" gorm:"default:0"` // the SceneVersion in use, 0 until the scene was regenerated
+	// when each word of the sentence is spoken, for the animated captions
+	Words SceneWords `json:"words" gorm:"type:text"`
+}
+
+// SceneWord is a word of the narration, times in seconds into the narration
+type SceneWord struct {
+	Text  string  `json:"text"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+// SceneWords is stored as JSON
+type SceneWords []SceneWord
+
+func (w SceneWords) Value() (driver.Value, error) {
+	if w == nil {
+		return nil, nil
+	}
+	content, err := json.Marshal(w)
+	return string(content), err
+}
+
+func (w *SceneWords) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*w = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, w)
+	case string:
+		return json.Unmarshal([]byte(v), w)
+	}
+	return fmt.Errorf("can't scan %T into SceneWords", value)
+}
+
+// SceneVersion is an image a scene had at some point, kept so a regenerated
+// scene can be rolled back
+type SceneVersion struct {
+	Base
+	SceneID   string `json:"sceneID" gorm:"not null;uniqueIndex:idx_scene_version"`
+	VideoID   string `json:"videoID" gorm:"not null;index"`
+	Version   int    `json:"version" gorm:"not null;uniqueIndex:idx_scene_version"`
+	Prompt    string `json:"prompt" gorm:"type:text"`
+	Style     string `json:"style"`
+	Provider  string `json:"provider"`
+	Seed      *int   `json:"seed" gorm:"null"`
+	AssetPath string `json:"assetPath"`
+}
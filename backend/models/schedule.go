@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	pq "github.com/lib/pq"
+)
+
+// Schedule creates a new video on every tick of its cron expression, with
+// the topic picked from a pool or generated from a prompt
+type Schedule struct {
+	Base
+	Name     string `json:"name"`
+	Cron     string `json:"cron" gorm:"not null"`        // e.g. "0 9 * * 1-5", see util.ParseCron
+	Timezone string `json:"timezone" gorm:"default:UTC"` // IANA name the cron expression is evaluated in
+	// no DB default: gorm would insert it for false, the router sets it
+	Enabled bool `json:"enabled" gorm:"not null;index"`
+
+	// topics are picked from the pool first, otherwise generated from the prompt
+	TopicPool   pq.StringArray `json:"topicPool" gorm:"type:text[]"`
+	TopicPrompt string         `json:"topicPrompt" gorm:"type:text"`
+	// the last topics used, so they aren't repeated too soon
+	RecentTopics pq.StringArray `json:"recentTopics" gorm:"type:text[]"`
+
+	// defaults of the videos created by the schedule
+	Description     string         `json:"description"`
+	Narrator        string         `json:"narrator"`
+	VideoStyle      string         `json:"videoStyle"`
+	VideoTheme      string         `json:"videoTheme"`
+	BackgroundMusic string         `json:"backgroundMusic"`
+	CaptionStyle    string         `json:"captionStyle" gorm:"default:classic"`
+	Languages       pq.StringArray `json:"languages" gorm:"type:text[]"`
+	CaptionPosition string         `json:"captionPosition" gorm:"default:bottom"`
+	LoudnessTarget  float64        `json:"loudnessTarget" gorm:"default:-14"`
+	TransitionSFX   bool           `json:"transitionSFX" gorm:"default:false"`
+	MediaType       string         `json:"mediaType" gorm:"default:ai"`
+	ScriptProvider  string         `json:"scriptProvider" gorm:"null"`
+	PostingMethod   pq.StringArray `json:"postingMethod" gorm:"type:text[]"`
+
+	NextRunAt *time.Time `json:"nextRunAt" gorm:"null;index"`
+	LastRunAt *time.Time `json:"lastRunAt" gorm:"null"`
+	LastError string     `json:"lastError" gorm:"null"`
+
+	OwnerID string `json:"ownerID" gorm:"index"`
+	Owner   User   `json:"-" gorm:"foreignKey:OwnerID;references:ID"`
+}
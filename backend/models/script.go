@@ -0,0 +1,20 @@
+package models
+
+const (
+	ScriptSourceGenerated = "generated"
+	ScriptSourceEdit      = "edit"
+)
+
+// ScriptVersion is a snapshot of the script of a video. A version is added
+// every time the script is generated or edited by the user
+type ScriptVersion struct {
+	Base
+	VideoID  string `json:"videoID" gorm:"not null;uniqueIndex:idx_script_version"`
+	Version  int    `json:"version" gorm:"not null;uniqueIndex:idx_script_version"`
+	Topic    string `json:"topic"`
+	Script   string `json:"script" gorm:"type:text"`
+	Essence  string `json:"essence"`
+	Source   string `json:"source"`               // generated or edit
+	Provider string `json:"provider" gorm:"null"` // the script provider, for generated versions
+	AuthorID string `json:"authorID" gorm:"null"` // the user, for edits
+}
@@ -0,0 +1,21 @@
+package models
+
+// StockClip is a stock footage clip used for one sentence of a video,
+// along with the attribution the license asks for
+type StockClip struct {
+	Base
+	VideoID       string  `json:"videoID" gorm:"not null;index"`
+	SentenceIndex int     `json:"sentenceIndex"`
+	Sentence      string  `json:"sentence"`
+	Query         string  `json:"query"` // the search query generated for the sentence
+	Score         float64 `json:"score"` // how well the clip fit, see rankPexelsVideo
+	Provider      string  `json:"provider" gorm:"default:pexels"`
+	ProviderID    int     `json:"providerID"`
+	PageURL       string  `json:"pageURL"`   // the page of the clip on the provider
+	SourceURL     string  `json:"sourceURL"` // the file that was downloaded
+	Author        string  `json:"author"`
+	AuthorURL     string  `json:"authorURL"`
+	License       string  `json:"license"`
+	Duration      float64 `json:"duration"` // seconds the clip is on screen
+	FilePath      string  `json:"filePath"`
+}
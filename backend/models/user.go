@@ -8,6 +8,9 @@ import (
 type User struct {
 	Base
 	Email	string `json:"email" gorm:"unique;not null"`
+
+	// preferred script provider (anthropic, openai or gemini), tried first
+	ScriptProvider string `json:"scriptProvider" gorm:"null"`
 }
 
 // UserErrors represent the error format for user routes
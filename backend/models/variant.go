@@ -0,0 +1,26 @@
+package models
+
+const (
+	VariantStatusPending = "pending"
+	VariantStatusReady   = "ready"
+	VariantStatusFailed  = "failed"
+)
+
+// VideoVariant is a video narrated in another language. It shares the scenes
+// of its video and has its own script, narration, timings and render
+type VideoVariant struct {
+	Base
+	VideoID  string `json:"videoID" gorm:"not null;uniqueIndex:idx_video_language"`
+	Language string `json:"language" gorm:"not null;uniqueIndex:idx_video_language"` // ISO 639-1 code
+	Script   string `json:"script" gorm:"type:text"`
+	Narrator string `json:"narrator"` // the narrator the variant was voiced with
+
+	// blob keys, like the ones on Video
+	TTSURL   string `json:"ttsURL" gorm:"null"`
+	SRTURL   string `json:"srtURL" gorm:"null"`
+	VideoURL string `json:"videoURL" gorm:"null"`
+
+	TimingsEstimated bool   `json:"timingsEstimated" gorm:"default:false"`
+	Status           string `json:"status" gorm:"not null;default:pending"`
+	Error            string `json:"error" gorm:"null"`
+}
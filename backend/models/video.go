@@ -4,7 +4,7 @@ import (
 	pq "github.com/lib/pq"
 )
 
-// later, break this into two models: Video and Schedule
+// Video is a single video. Recurring videos are created by a Schedule
 type Video struct {
 	Base
 	Topic         string         `json:"topic"`
@@ -22,6 +22,7 @@ type Video struct {
 	DALLEGenerated       bool `json:"dalleGenerated" gorm:"default:false"`
 	TTSGenerated         bool `json:"ttsGenerated" gorm:"default:false"`
 	SRTGenerated         bool `json:"srtGenerated" gorm:"default:false"`
+	AudioMastered        bool `json:"audioMastered" gorm:"default:false"`
 	VideoStitched        bool `json:"videoStitched" gorm:"default:false"`
 	// full progress of the video
 	VideoUploaded  bool `json:"videoUploaded" gorm:"default:false"`
@@ -32,15 +33,44 @@ type Video struct {
 
 	Essence string `json:"essence" gorm:"null"` // the essence of the video
 
+	// in draft mode the pipeline stops after the script until the user approves it
+	Draft          bool `json:"draft" gorm:"default:false"`
+	ScriptApproved bool `json:"scriptApproved" gorm:"default:false"`
+	ScriptVersion  int  `json:"scriptVersion" gorm:"default:0"` // the current version, see ScriptVersion
+
+	ScriptProvider     string `json:"scriptProvider" gorm:"null"`     // requested script provider, optional
+	ScriptProviderUsed string `json:"scriptProviderUsed" gorm:"null"` // the provider that actually wrote the script
+
 	BackgroundMusic string `json:"backgroundMusic" gorm:"null"`
 
+	// languages the video is localized to besides English, see VideoVariant
+	Languages pq.StringArray `json:"languages" gorm:"type:text[]"`
+
+	// how the captions are burned in, see util.captionPresets
+	CaptionStyle    string `json:"captionStyle" gorm:"default:classic"`
+	CaptionPosition string `json:"captionPosition" gorm:"default:bottom"` // bottom or center of the safe area
+
+	// how the audio is mastered, see util.masterAudio
+	LoudnessTarget float64 `json:"loudnessTarget" gorm:"default:-14"`  // integrated loudness of the mix, in LUFS
+	TransitionSFX  bool    `json:"transitionSFX" gorm:"default:false"` // a whoosh at every scene change
+
 	// maybe, hide this from the user
 	Error string `json:"error" gorm:"null"`
 
+	// the user stopped the generation, see util.CancelVideo
+	Cancelled bool `json:"cancelled" gorm:"default:false"`
+
+	// the ASR service was down and the timings were estimated from the script
+	TimingsEstimated bool `json:"timingsEstimated" gorm:"default:false"`
+
 	TTSURL           string `json:"ttsURL" gorm:"null"`
 	SRTURL           string `json:"srtURL" gorm:"null"`
+	MasteredAudioURL string `json:"masteredAudioURL" gorm:"null"`
 	StitchedVideoURL string `json:"stitchedVideoURL" gorm:"null"`
 
+	// the schedule that created the video, if any
+	ScheduleID string `json:"scheduleID" gorm:"null;index"`
+
 	OwnerID string `json:"ownerID"`
 	Owner   User   `json:"owner" gorm:"foreignKey:OwnerID;references:ID"`
 }
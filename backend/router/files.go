@@ -0,0 +1,52 @@
+package router
+
+import (
+	"errors"
+	"log"
+	"path"
+
+	util "go-authentication-boilerplate/util"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func SetupFileRoutes() {
+	FILES.Get("/*", ServeLocalBlob)
+}
+
+// ServeLocalBlob serves the artifacts of the local blob store to holders of
+// a signed URL. The other stores check their signed URLs themselves
+func ServeLocalBlob(c *fiber.Ctx) error {
+	key := c.Params("*")
+
+	file, err := util.OpenLocalBlob(key, c.Query("expires"), c.Query("token"))
+	if errors.Is(err, util.ErrBlobURLExpired) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": true,
+			"message": "Link is invalid or expired",
+		})
+	}
+
+	if err != nil {
+		if !errors.Is(err, util.ErrBlobNotFound) {
+			log.Printf("[ERROR] Error opening blob %s: %v", key, err)
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "File not found",
+		})
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error reading file",
+		})
+	}
+
+	// fasthttp closes the file once it is sent
+	c.Type(path.Ext(key))
+	return c.SendStream(file, int(info.Size()))
+}
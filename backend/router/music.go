@@ -0,0 +1,315 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	auth "go-authentication-boilerplate/auth"
+	"go-authentication-boilerplate/models"
+	util "go-authentication-boilerplate/util"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+func SetupMusicRoutes() {
+	privMusic := MUSIC.Group("/private")
+	privMusic.Use(auth.SecureAuth()) // middleware to secure all routes for this group
+
+	privMusic.Get("/list", ListMusicTracks)
+	privMusic.Post("/upload", UploadMusicTrack)
+	privMusic.Delete("/:id", DeleteMusicTrack)
+
+	// the catalog everyone picks from
+	adminMusic := privMusic.Group("/admin")
+	adminMusic.Use(AdminOnly)
+
+	adminMusic.Post("/upload", UploadCatalogTrack)
+	adminMusic.Put("/:id", UpdateCatalogTrack)
+}
+
+// the routes taking a music file, matched before the body is read
+var musicUploadPaths = map[string]bool{
+	"/api/music/private/upload":       true,
+	"/api/music/private/admin/upload": true,
+}
+
+// MusicUploadRequestConfig is called by the server once the headers of a
+// request are read. It raises the body limit of the music uploads, with room
+// for the rest of their form; every other route keeps the default limit
+func MusicUploadRequestConfig(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+	path := strings.SplitN(string(header.RequestURI()), "?", 2)[0]
+	path = strings.ToLower(strings.TrimSuffix(path, "/"))
+
+	if header.IsPost() && musicUploadPaths[path] {
+		return fasthttp.RequestConfig{MaxRequestBodySize: util.MaxMusicUploadSize + 1<<20}
+	}
+	return fasthttp.RequestConfig{}
+}
+
+// AdminOnly lets only the users in ADMIN_EMAILS through
+func AdminOnly(c *fiber.Ctx) error {
+	if !util.IsAdmin(c.Locals("id").(string)) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": true,
+			"message": "Forbidden",
+		})
+	}
+	return c.Next()
+}
+
+// ListMusicTracks lists the catalog and the tracks the user uploaded
+func ListMusicTracks(c *fiber.Ctx) error {
+	tracks, err := util.GetMusicTracksForUser(c.Locals("id").(string))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting music tracks",
+		})
+	}
+
+	util.ResolveMusicTrackURLs(tracks)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"tracks": tracks,
+	})
+}
+
+// UploadMusicTrack adds a track only the user can pick
+func UploadMusicTrack(c *fiber.Ctx) error {
+	return uploadMusicTrack(c, c.Locals("id").(string))
+}
+
+// UploadCatalogTrack adds a track to the catalog, a license is required
+func UploadCatalogTrack(c *fiber.Ctx) error {
+	if strings.TrimSpace(c.FormValue("license")) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "A license is required for catalog tracks",
+		})
+	}
+	return uploadMusicTrack(c, "")
+}
+
+// parseMusicTrackForm reads the metadata of a track from a multipart form,
+// returning a message when it is invalid
+func parseMusicTrackForm(c *fiber.Ctx, track *models.MusicTrack) string {
+	track.Title = strings.TrimSpace(c.FormValue("title"))
+	if track.Title == "" || len(track.Title) > 100 {
+		return "A title of up to 100 characters is required"
+	}
+
+	track.Mood = strings.ToLower(strings.TrimSpace(c.FormValue("mood")))
+	track.License = strings.TrimSpace(c.FormValue("license"))
+
+	track.BPM = 0
+	if bpm := c.FormValue("bpm"); bpm != "" {
+		value, err := strconv.Atoi(bpm)
+		if err != nil || value < 20 || value > 300 {
+			return "Invalid BPM"
+		}
+		track.BPM = value
+	}
+	return ""
+}
+
+func uploadMusicTrack(c *fiber.Ctx, ownerID string) error {
+	track := &models.MusicTrack{OwnerID: ownerID}
+	if message := parseMusicTrackForm(c, track); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": message,
+		})
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "An audio file is required",
+		})
+	}
+
+	if header.Size > util.MaxMusicUploadSize {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": true,
+			"message": "The file is too large",
+		})
+	}
+
+	ext := strings.ToLower(filepath.Ext(header.Filename))
+
+	tmpFile, err := ioutil.TempFile("", "music-*"+ext)
+	if err != nil {
+		log.Printf("[ERROR] Error creating temp file: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error saving file",
+		})
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err := c.SaveFile(header, tmpFile.Name()); err != nil {
+		log.Printf("[ERROR] Error saving upload: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error saving file",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	if err := util.CreateMusicTrack(ctx, track, tmpFile.Name(), ext); err != nil {
+		if errors.Is(err, util.ErrInvalidMusicFile) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": err.Error(),
+			})
+		}
+
+		log.Printf("[ERROR] Error adding music track: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error adding music track",
+		})
+	}
+
+	tracks := []models.MusicTrack{*track}
+	util.ResolveMusicTrackURLs(tracks)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"track": tracks[0],
+	})
+}
+
+// UpdateCatalogTrack changes the metadata sent for a catalog track, or takes
+// it out of the catalog with enabled=false
+func UpdateCatalogTrack(c *fiber.Ctx) error {
+	type UpdateRequest struct {
+		Title   *string `json:"title"`
+		Mood    *string `json:"mood"`
+		BPM     *int    `json:"bpm"`
+		License *string `json:"license"`
+		Enabled *bool   `json:"enabled"`
+	}
+
+	var req UpdateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	track, err := util.GetMusicTrackById(c.Params("id"))
+	if err != nil || track.OwnerID != "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Catalog track not found",
+		})
+	}
+
+	updates := map[string]interface{}{}
+
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || len(title) > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "A title of up to 100 characters is required",
+			})
+		}
+		updates["title"] = title
+	}
+
+	if req.Mood != nil {
+		updates["mood"] = strings.ToLower(strings.TrimSpace(*req.Mood))
+	}
+
+	if req.BPM != nil {
+		if *req.BPM != 0 && (*req.BPM < 20 || *req.BPM > 300) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "Invalid BPM",
+			})
+		}
+		updates["bpm"] = *req.BPM
+	}
+
+	if req.License != nil {
+		license := strings.TrimSpace(*req.License)
+		if license == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "A license is required for catalog tracks",
+			})
+		}
+		updates["license"] = license
+	}
+
+	if req.Enabled != nil {
+		updates["enabled"] = *req.Enabled
+	}
+
+	if len(updates) > 0 {
+		if track, err = util.UpdateMusicTrack(track, updates); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": true,
+				"message": "Error updating music track",
+			})
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"track": track,
+	})
+}
+
+// DeleteMusicTrack deletes a track the user uploaded. Admins can delete
+// catalog tracks too
+func DeleteMusicTrack(c *fiber.Ctx) error {
+	userID := c.Locals("id").(string)
+
+	track, err := util.GetMusicTrackById(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Music track not found",
+		})
+	}
+
+	if track.OwnerID != userID && !(track.OwnerID == "" && util.IsAdmin(userID)) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := util.DeleteMusicTrack(ctx, track); err != nil {
+		log.Printf("[ERROR] Error deleting music track: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error deleting music track",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Music track deleted",
+	})
+}
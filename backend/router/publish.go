@@ -0,0 +1,196 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	auth "go-authentication-boilerplate/auth"
+	"go-authentication-boilerplate/models"
+	util "go-authentication-boilerplate/util"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func SetupPublishRoutes() {
+	privPublish := PUBLISH.Group("/private")
+	privPublish.Use(auth.SecureAuth()) // middleware to secure all routes for this group
+
+	privPublish.Get("/accounts", ListPublishingAccounts)
+	privPublish.Post("/accounts/youtube", LinkYouTubeAccount)
+	privPublish.Post("/accounts/telegram", LinkTelegramAccount)
+	privPublish.Post("/accounts/telegram/confirm", ConfirmTelegramAccount)
+	privPublish.Delete("/accounts/:destination", UnlinkPublishingAccount)
+}
+
+func ListPublishingAccounts(c *fiber.Ctx) error {
+	accounts, err := util.GetPublishingAccountsByOwner(c.Locals("id").(string))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting accounts",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"accounts": accounts,
+	})
+}
+
+// LinkYouTubeAccount finishes the OAuth flow started by the frontend. The code
+// has to be requested with access_type=offline and the youtube.upload scope
+func LinkYouTubeAccount(c *fiber.Ctx) error {
+	type LinkRequest struct {
+		Code        string `json:"code"`
+		RedirectURI string `json:"redirectUri"`
+	}
+
+	var req LinkRequest
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	refreshToken, accessToken, err := util.ExchangeYouTubeCode(ctx, req.Code, req.RedirectURI)
+	if err != nil {
+		log.Printf("[ERROR] Error exchanging YouTube code: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Couldn't link the YouTube account",
+		})
+	}
+
+	channel, err := util.GetYouTubeChannel(ctx, accessToken)
+	if err != nil {
+		log.Printf("[ERROR] Error getting YouTube channel: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Couldn't find a YouTube channel for the account",
+		})
+	}
+
+	account, err := util.SetPublishingAccount(&models.PublishingAccount{
+		OwnerID:     c.Locals("id").(string),
+		Destination: util.DestinationYouTube,
+		ExternalID:  channel.ID,
+		Name:        channel.Title,
+		Credential:  refreshToken,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error saving account",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"account": account,
+	})
+}
+
+// LinkTelegramAccount starts linking a channel, group or private chat by ID
+// or @username. The bot has to be added as an admin of channels and groups
+// first. The returned code has to be posted in the chat by one of its admins
+// before confirming
+func LinkTelegramAccount(c *fiber.Ctx) error {
+	type LinkRequest struct {
+		Chat string `json:"chat"`
+	}
+
+	var req LinkRequest
+	if err := c.BodyParser(&req); err != nil || strings.TrimSpace(req.Chat) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	link, err := util.StartTelegramLink(ctx, c.Locals("id").(string), req.Chat)
+	if err != nil {
+		log.Printf("[ERROR] Error linking telegram chat %s: %v", req.Chat, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Couldn't link the chat, make sure the bot is an admin of it",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"chat": link.Name,
+		"code": link.Code,
+		"expiresAt": link.ExpiresAt,
+	})
+}
+
+// ConfirmTelegramAccount links the chat once its link code was posted in it
+func ConfirmTelegramAccount(c *fiber.Ctx) error {
+	link, err := util.GetTelegramLinkByOwner(c.Locals("id").(string))
+	if err != nil || link.ExpiresAt.Before(time.Now()) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "No chat is waiting to be linked, request a new code",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	account, err := util.ConfirmTelegramLink(ctx, link)
+	if err != nil {
+		if errors.Is(err, util.ErrTelegramLinkCodeNotFound) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "The code wasn't found in the chat, post it there from an admin account and try again",
+			})
+		}
+
+		log.Printf("[ERROR] Error confirming telegram chat %d: %v", link.ChatID, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Couldn't link the chat, make sure the bot is an admin of it",
+		})
+	}
+
+	account, err = util.SetPublishingAccount(account)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error saving account",
+		})
+	}
+
+	if err := util.DeleteTelegramLink(link.ID); err != nil {
+		log.Printf("[ERROR] Error deleting telegram link %s: %v", link.ID, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"account": account,
+	})
+}
+
+func UnlinkPublishingAccount(c *fiber.Ctx) error {
+	if err := util.DeletePublishingAccount(c.Locals("id").(string), c.Params("destination")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error unlinking account",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Account unlinked",
+	})
+}
@@ -0,0 +1,317 @@
+package router
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	auth "go-authentication-boilerplate/auth"
+	"go-authentication-boilerplate/models"
+	util "go-authentication-boilerplate/util"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func SetupScheduleRoutes() {
+	privSchedule := SCHEDULE.Group("/private")
+	privSchedule.Use(auth.SecureAuth()) // middleware to secure all routes for this group
+
+	privSchedule.Get("/list", ListSchedules)
+	privSchedule.Get("/:id", GetSchedule)
+	privSchedule.Post("/create", CreateRecurringSchedule)
+	privSchedule.Put("/:id", UpdateSchedule)
+	privSchedule.Delete("/:id", DeleteSchedule)
+}
+
+type ScheduleRequest struct {
+	Name            string   `json:"name"`
+	Cron            string   `json:"cron"`
+	Timezone        string   `json:"timezone"`
+	Enabled         *bool    `json:"enabled"`
+	TopicPool       []string `json:"topicPool"`
+	TopicPrompt     string   `json:"topicPrompt"`
+	Description     string   `json:"description"`
+	Narrator        string   `json:"narrator"`
+	VideoStyle      string   `json:"videoStyle"`
+	VideoTheme      string   `json:"videoTheme"`
+	BackgroundMusic string   `json:"backgroundMusic"`
+	CaptionStyle    string   `json:"captionStyle"`
+	CaptionPosition string   `json:"captionPosition"`
+	Languages       []string `json:"languages"`
+	LoudnessTarget  float64  `json:"loudnessTarget"`
+	TransitionSFX   bool     `json:"transitionSFX"`
+	MediaType       string   `json:"mediaType"`
+	ScriptProvider  string   `json:"scriptProvider"`
+	PostingMethod   []string `json:"postingMethod"`
+}
+
+// applyScheduleRequest validates the request and copies it onto the
+// schedule. It returns the message to send back when the request is invalid
+func applyScheduleRequest(schedule *models.Schedule, req ScheduleRequest) string {
+	var topicPool []string
+	for _, topic := range req.TopicPool {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topicPool = append(topicPool, topic)
+		}
+	}
+
+	if len(topicPool) == 0 && strings.TrimSpace(req.TopicPrompt) == "" {
+		return "A topic pool or a topic prompt is required"
+	}
+
+	if _, err := util.GetNarratorByName(req.Narrator); err != nil {
+		return "Invalid narrator"
+	}
+
+	if !util.IsValidVideoStyle(req.VideoStyle) {
+		return "Invalid video style"
+	}
+
+	if !util.IsValidBackgroundMusic(req.BackgroundMusic, schedule.OwnerID) {
+		return "Invalid background music"
+	}
+
+	if req.ScriptProvider != "" && !util.IsValidScriptProvider(req.ScriptProvider) {
+		return "Invalid script provider"
+	}
+
+	if req.CaptionStyle == "" {
+		req.CaptionStyle = util.CaptionStyleClassic
+	}
+
+	if !util.IsValidCaptionStyle(req.CaptionStyle) {
+		return "Invalid caption style"
+	}
+
+	if req.CaptionPosition == "" {
+		req.CaptionPosition = util.CaptionPositionBottom
+	}
+
+	if !util.IsValidCaptionPosition(req.CaptionPosition) {
+		return "Invalid caption position"
+	}
+
+	if req.LoudnessTarget == 0 {
+		req.LoudnessTarget = util.DefaultLoudnessTarget
+	}
+
+	if !util.IsValidLoudnessTarget(req.LoudnessTarget) {
+		return "Invalid loudness target"
+	}
+
+	languages, err := util.NormalizeLanguages(req.Languages)
+	if err != nil {
+		return "Invalid languages"
+	}
+
+	for _, language := range languages {
+		if _, err := util.GetNarratorForLanguage(req.Narrator, language); err != nil {
+			return "No narrator available for language " + language
+		}
+	}
+
+	if req.MediaType == "" {
+		req.MediaType = "ai"
+	}
+
+	if req.MediaType != "ai" && req.MediaType != "stock" {
+		return "Invalid media type"
+	}
+
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+
+	schedule.Name = req.Name
+	schedule.Cron = strings.TrimSpace(req.Cron)
+	schedule.Timezone = req.Timezone
+	schedule.TopicPool = topicPool
+	schedule.TopicPrompt = strings.TrimSpace(req.TopicPrompt)
+	schedule.Description = req.Description
+	schedule.Narrator = req.Narrator
+	schedule.VideoStyle = req.VideoStyle
+	schedule.VideoTheme = req.VideoTheme
+	schedule.BackgroundMusic = req.BackgroundMusic
+	schedule.CaptionStyle = req.CaptionStyle
+	schedule.CaptionPosition = req.CaptionPosition
+	schedule.Languages = languages
+	schedule.LoudnessTarget = req.LoudnessTarget
+	schedule.TransitionSFX = req.TransitionSFX
+	schedule.MediaType = req.MediaType
+	schedule.ScriptProvider = req.ScriptProvider
+	schedule.PostingMethod = req.PostingMethod
+
+	if req.Enabled != nil {
+		schedule.Enabled = *req.Enabled
+	}
+
+	// validates the cron expression and the timezone as well
+	next, err := util.NextScheduleRun(schedule, time.Now())
+	if err != nil {
+		return "Invalid cron expression or timezone"
+	}
+
+	schedule.NextRunAt = &next
+	if !schedule.Enabled {
+		schedule.NextRunAt = nil
+	}
+
+	return ""
+}
+
+func ListSchedules(c *fiber.Ctx) error {
+	schedules, err := util.GetSchedulesByOwner(c.Locals("id").(string))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting schedules",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"schedules": schedules,
+	})
+}
+
+func GetSchedule(c *fiber.Ctx) error {
+	schedule, err := util.GetScheduleById(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Schedule not found",
+		})
+	}
+
+	if schedule.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	videos, err := util.GetVideosBySchedule(schedule.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting videos",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"schedule": schedule,
+		"videos": videos,
+	})
+}
+
+func CreateRecurringSchedule(c *fiber.Ctx) error {
+	var req ScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		log.Printf("[ERROR] Error parsing request: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	schedule := &models.Schedule{
+		Enabled: true,
+		OwnerID: c.Locals("id").(string),
+	}
+
+	if message := applyScheduleRequest(schedule, req); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": message,
+		})
+	}
+
+	schedule, err := util.SetSchedule(schedule)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error creating schedule",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"schedule": schedule,
+	})
+}
+
+func UpdateSchedule(c *fiber.Ctx) error {
+	schedule, err := util.GetScheduleById(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Schedule not found",
+		})
+	}
+
+	if schedule.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	var req ScheduleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	if message := applyScheduleRequest(schedule, req); message != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": message,
+		})
+	}
+
+	schedule, err = util.SetSchedule(schedule)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error updating schedule",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"schedule": schedule,
+	})
+}
+
+// DeleteSchedule stops the schedule. The videos it already created are kept
+func DeleteSchedule(c *fiber.Ctx) error {
+	schedule, err := util.GetScheduleById(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Schedule not found",
+		})
+	}
+
+	if schedule.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	if err := util.DeleteSchedule(schedule); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error deleting schedule",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Schedule deleted",
+	})
+}
@@ -10,6 +10,10 @@ var USER fiber.Router
 var VIDEO fiber.Router
 var BILLING fiber.Router
 var TELEGRAM fiber.Router
+var SCHEDULE fiber.Router
+var PUBLISH fiber.Router
+var FILES fiber.Router
+var MUSIC fiber.Router
 
 func SetupRoutes(app *fiber.App) {
 	app.Use(logger.New())
@@ -34,4 +38,16 @@ func SetupRoutes(app *fiber.App) {
 
 	TELEGRAM = api.Group("/telegram")
 	SetupTelegramRoutes()
+
+	SCHEDULE = api.Group("/schedule")
+	SetupScheduleRoutes()
+
+	PUBLISH = api.Group("/publish")
+	SetupPublishRoutes()
+
+	FILES = api.Group("/files")
+	SetupFileRoutes()
+
+	MUSIC = api.Group("/music")
+	SetupMusicRoutes()
 }
@@ -135,7 +135,7 @@ func sendMessage(text, username string) error {
     }
 
     ChatInfoConfig := tgbotapi.ChatInfoConfig{
-        chatConfig,
+        ChatConfig: chatConfig,
     }
 
 	chat, err := bot.GetChat(ChatInfoConfig)
@@ -28,6 +28,7 @@ func SetupUserRoutes() {
 	privUser := USER.Group("/private")
 	privUser.Use(auth.SecureAuth()) // middleware to secure all routes for this group
 	privUser.Get("/getinfo", GetUserData)
+	privUser.Put("/preferences", UpdateUserPreferences)
 	// privUser.Get("/shopify/callback", HandleShopifyOauthCallback)
 }
 
@@ -208,3 +209,35 @@ func GetUserData(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{"user": user, "error": false})
 }
+
+// UpdateUserPreferences updates the generation defaults of the user signed in
+func UpdateUserPreferences(c *fiber.Ctx) error {
+	type PreferencesInput struct {
+		ScriptProvider string `json:"scriptProvider"`
+	}
+
+	input := new(PreferencesInput)
+	if err := c.BodyParser(input); err != nil {
+		log.Printf("[ERROR] Couldn't parse the input: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": true, "message": "Please review your input"})
+	}
+
+	if input.ScriptProvider != "" && !util.IsValidScriptProvider(input.ScriptProvider) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": true, "message": "Invalid script provider"})
+	}
+
+	user, err := util.GetUserById(c.Locals("id").(string))
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": true, "message": "Couldn't get user"})
+	}
+
+	user.ScriptProvider = input.ScriptProvider
+
+	user, err = util.SetUser(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": true, "message": "Couldn't save preferences"})
+	}
+
+	return c.JSON(fiber.Map{"user": user, "error": false})
+}
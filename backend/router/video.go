@@ -5,9 +5,18 @@ import (
 	"go-authentication-boilerplate/models"
 	auth "go-authentication-boilerplate/auth"
 	util "go-authentication-boilerplate/util"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
 )
 
 func SetupVideoRoutes() {
@@ -15,9 +24,24 @@ func SetupVideoRoutes() {
 	privVideo.Use(auth.SecureAuth()) // middleware to secure all routes for this group
 
 	privVideo.Get("/list", ListVideos)
+	privVideo.Get("/narrators", ListNarrators)
 	privVideo.Get("/:id", GetVideo)
+	privVideo.Get("/:id/jobs", GetVideoJobs)
+	privVideo.Get("/:id/events", StreamVideoEvents)
+	privVideo.Get("/:id/scenes", GetStoryboard)
+	privVideo.Get("/:id/assets", GetVideoAssets)
+	privVideo.Get("/:id/subtitles", GetVideoSubtitles)
+	privVideo.Get("/:id/scenes/:index/versions", GetSceneVersions)
+	privVideo.Post("/:id/scenes/:index/regenerate", RegenerateScene)
+	privVideo.Post("/:id/scenes/:index/rollback", RollbackScene)
 	privVideo.Post("/create", CreateSchedule)
 	privVideo.Post("/recreate/:id", RecreateVideo)
+	privVideo.Post("/:id/cancel", CancelVideo)
+	privVideo.Delete("/:id", DeleteVideo)
+	privVideo.Post("/:id/publish", PublishVideo)
+	privVideo.Get("/:id/script/versions", GetScriptVersions)
+	privVideo.Put("/:id/script", UpdateScript)
+	privVideo.Post("/:id/script/approve", ApproveScript)
 }
 
 func ListVideos(c *fiber.Ctx) error {
@@ -39,13 +63,789 @@ func ListVideos(c *fiber.Ctx) error {
 		})
 	}
 
+	for i := range videos {
+		util.ResolveVideoURLs(&videos[i])
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"videos": videos,
+	})
+}
+
+func ListNarrators(c *fiber.Ctx) error {
+	narrators, err := util.GetNarrators()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting narrators",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"narrators": narrators,
+	})
+}
+
+func GetVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	if video.Error != "" {
+		video.Error = "An error happened in a step. Try creating the video again"
+	}
+
+	util.ResolveVideoURLs(video)
+
+	// attribution for the stock footage used in the video
+	stockClips, err := util.GetStockClipsByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	for i := range stockClips {
+		stockClips[i].FilePath = util.ResolveBlobURL(stockClips[i].FilePath)
+	}
+
+	publications, err := util.GetPublicationsByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	variants, err := util.GetVideoVariants(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	util.ResolveVariantURLs(variants)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"video": video,
+		"stockClips": stockClips,
+		"publications": publications,
+		"variants": variants,
+	})
+}
+
+func GetVideoJobs(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	jobs, err := util.GetJobsByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video jobs",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"jobs": jobs,
+	})
+}
+
+// GetStoryboard lists the scenes of a video in narration order
+func GetStoryboard(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	scenes, err := util.GetScenesByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scenes",
+		})
+	}
+
+	util.ResolveSceneURLs(scenes)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"scenes": scenes,
+	})
+}
+
+// GetVideoAssets issues short-lived signed URLs for the artifacts of a video.
+// Nothing is publicly readable, clients fetch new URLs once these expire
+func GetVideoAssets(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	scenes, err := util.GetScenesByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scenes",
+		})
+	}
+
+	variants, err := util.GetVideoVariants(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting variants",
+		})
+	}
+
+	expiresAt := util.BlobURLExpiresAt()
+
+	variantURLs := []fiber.Map{}
+	for _, variant := range variants {
+		if variant.Status != models.VariantStatusReady {
+			continue
+		}
+
+		variantURLs = append(variantURLs, fiber.Map{
+			"language": variant.Language,
+			"audio": util.ResolveBlobURL(variant.TTSURL),
+			"subtitles": util.ResolveBlobURL(variant.SRTURL),
+			"video": util.ResolveBlobURL(variant.VideoURL),
+		})
+	}
+
+	sceneURLs := []fiber.Map{}
+	for _, scene := range scenes {
+		if scene.AssetPath == "" {
+			continue
+		}
+
+		sceneURLs = append(sceneURLs, fiber.Map{
+			"index": scene.SceneIndex,
+			"url": util.ResolveBlobURL(scene.AssetPath),
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"expiresAt": expiresAt,
+		"assets": fiber.Map{
+			"audio": util.ResolveBlobURL(video.TTSURL),
+			"mix": util.ResolveBlobURL(video.MasteredAudioURL),
+			"subtitles": util.ResolveBlobURL(video.SRTURL),
+			"video": util.ResolveBlobURL(video.StitchedVideoURL),
+			"scenes": sceneURLs,
+			"variants": variantURLs,
+		},
+	})
+}
+
+// GetVideoSubtitles exports the captions of a video as srt (the default),
+// vtt, ass or json, in English or the language of a variant. maxLineChars
+// and maxDuration (seconds) tighten the limits of the cues for platforms with
+// stricter rules
+func GetVideoSubtitles(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	format := strings.ToLower(c.Query("format", util.SubtitleFormatSRT))
+	if !util.IsValidSubtitleFormat(format) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid format, use srt, vtt, ass or json",
+		})
+	}
+
+	options := util.DefaultSubtitleOptions
+	if value := c.Query("maxLineChars"); value != "" {
+		maxLineChars, err := strconv.Atoi(value)
+		if err != nil || maxLineChars < 10 || maxLineChars > 80 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "maxLineChars must be between 10 and 80",
+			})
+		}
+		options.MaxLineChars = maxLineChars
+	}
+
+	if value := c.Query("maxDuration"); value != "" {
+		maxDuration, err := strconv.ParseFloat(value, 64)
+		if err != nil || maxDuration < 1 || maxDuration > 15 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "maxDuration must be between 1 and 15 seconds",
+			})
+		}
+		options.MaxDuration = time.Duration(maxDuration * float64(time.Second))
+	}
+
+	subtitlesKey := ""
+	if video.SRTGenerated {
+		subtitlesKey = video.SRTURL
+	}
+
+	// the subtitles of a variant
+	language := strings.ToLower(c.Query("language", util.PrimaryLanguage))
+	if language != util.PrimaryLanguage {
+		variants, err := util.GetVideoVariants(video.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": true,
+				"message": "Error getting variants",
+			})
+		}
+
+		found := false
+		for _, variant := range variants {
+			if variant.Language == language {
+				subtitlesKey = variant.SRTURL
+				found = true
+			}
+		}
+
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": true,
+				"message": "The video isn't localized to " + language,
+			})
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	content, err := util.RenderSubtitles(ctx, subtitlesKey, format, options)
+	if err == util.ErrNoSubtitles {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Subtitles are not generated yet",
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error rendering subtitles of video %s: %v", video.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error rendering subtitles",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, util.SubtitleContentType(format))
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s.%s"`, video.ID, language, format))
+	return c.Status(fiber.StatusOK).Send(content)
+}
+
+// getEditableScene returns the video and the scene at :index if the scenes
+// of the video can be changed right now, otherwise it writes the error response
+func getEditableScene(c *fiber.Ctx) (*models.Video, *models.Scene, error) {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return nil, nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil || index < 0 {
+		return nil, nil, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid scene",
+		})
+	}
+
+	scene, err := util.GetSceneByIndex(video.ID, index)
+	if errors.Is(err, util.ErrSceneNotFound) {
+		return nil, nil, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Scene not found",
+		})
+	}
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scene",
+		})
+	}
+
+	activeJob, err := util.GetActiveJobByVideo(video.ID, util.VideoGenerationJobTypes...)
+	if err != nil {
+		return nil, nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video jobs",
+		})
+	}
+
+	if activeJob != nil {
+		return nil, nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+
+	if !video.DALLEGenerated || scene.Provider == "pexels" {
+		return nil, nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Scene can't be changed",
+		})
+	}
+
+	return video, scene, nil
+}
+
+func GetSceneVersions(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	index, err := strconv.Atoi(c.Params("index"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid scene",
+		})
+	}
+
+	scene, err := util.GetSceneByIndex(video.ID, index)
+	if errors.Is(err, util.ErrSceneNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Scene not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scene",
+		})
+	}
+
+	versions, err := util.GetSceneVersions(scene.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scene versions",
+		})
+	}
+
+	scene.AssetPath = util.ResolveBlobURL(scene.AssetPath)
+	util.ResolveSceneVersionURLs(versions)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"scene": scene,
+		"versions": versions,
+	})
+}
+
+// RegenerateScene generates a new image for one scene (optionally from a
+// custom prompt or in another style) and stitches the video again
+func RegenerateScene(c *fiber.Ctx) error {
+	type RegenerateSceneRequest struct {
+		Prompt string `json:"prompt"`
+		Style  string `json:"style"`
+		Seed   *int   `json:"seed"`
+	}
+
+	var req RegenerateSceneRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "Invalid request",
+			})
+		}
+	}
+
+	if req.Style != "" && !util.IsValidVideoStyle(req.Style) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid video style",
+		})
+	}
+
+	video, scene, err := getEditableScene(c)
+	if scene == nil {
+		return err
+	}
+
+	job, err := util.EnqueueRegenerateScene(video.ID, util.RegenerateSceneJobPayload{
+		SceneIndex: scene.SceneIndex,
+		Prompt: req.Prompt,
+		Style: req.Style,
+		Seed: req.Seed,
+	})
+	if errors.Is(err, util.ErrVideoGenerating) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error enqueueing scene: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error regenerating scene",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Regenerating scene",
+		"job": job,
+	})
+}
+
+// RollbackScene puts an earlier version of a scene back and stitches the video again
+func RollbackScene(c *fiber.Ctx) error {
+	type RollbackSceneRequest struct {
+		Version int `json:"version"`
+	}
+
+	var req RollbackSceneRequest
+	if err := c.BodyParser(&req); err != nil || req.Version <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	video, scene, err := getEditableScene(c)
+	if scene == nil {
+		return err
+	}
+
+	version, err := util.GetSceneVersion(scene.ID, req.Version)
+	if errors.Is(err, util.ErrSceneVersionNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": true,
+			"message": "Scene version not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting scene version",
+		})
+	}
+
+	// the version is put back by the job that stitches the video, so a
+	// failed enqueue leaves the scene as it was
+	job, err := util.EnqueueRollbackScene(video.ID, util.RollbackSceneJobPayload{
+		SceneIndex: scene.SceneIndex,
+		Version: version.Version,
+	})
+	if errors.Is(err, util.ErrVideoGenerating) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error enqueueing rollback: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error rolling back scene",
+		})
+	}
+
+	version.AssetPath = util.ResolveBlobURL(version.AssetPath)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Rolling back scene",
+		"version": version,
+		"job": job,
+	})
+}
+
+// StreamVideoEvents streams the progress of a video as server-sent events
+// until it is done or fails. The first event is the current state so a client
+// that connects late (or reconnects) doesn't have to poll GetVideo first
+func StreamVideoEvents(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	activeJob, err := util.GetActiveJobByVideo(video.ID, util.VideoGenerationJobTypes...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video jobs",
+		})
+	}
+
+	// subscribe before sending the snapshot so no event falls in between
+	events, unsubscribe := util.SubscribeVideoEvents(video.ID)
+
+	snapshot := util.VideoEvent{VideoID: video.ID, Type: util.VideoEventProgress, Progress: video.Progress, Time: time.Now()}
+	if activeJob == nil && video.VideoStitched {
+		snapshot.Type = util.VideoEventDone
+	} else if activeJob == nil && video.Error != "" {
+		snapshot.Type = util.VideoEventFailed
+	} else if activeJob == nil && video.Cancelled {
+		snapshot.Type = util.VideoEventCancelled
+	} else if activeJob == nil && video.Draft && video.ScriptGenerated && !video.ScriptApproved {
+		snapshot.Type = util.VideoEventScriptReady
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		event := snapshot
+		for {
+			// the errors of the pipeline are internal, like in GetVideo
+			if event.Message != "" {
+				event.Message = "An error happened in a step. Try creating the video again"
+			}
+
+			if err := writeVideoEvent(w, event); err != nil {
+				return
+			}
+
+			if event.Final() {
+				return
+			}
+
+			var ok bool
+			for waiting := true; waiting; {
+				select {
+				case event, ok = <-events:
+					if !ok {
+						return
+					}
+					waiting = false
+				case <-keepAlive.C:
+					// a comment keeps proxies from closing an idle stream and
+					// tells us when the client went away
+					if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+						return
+					}
+					if err := w.Flush(); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}))
+
+	return nil
+}
+
+func writeVideoEvent(w *bufio.Writer, event util.VideoEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func RecreateVideo(c *fiber.Ctx) error {
+	// if video exists but had an error, we start the background job again
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	// paying customers have full authority
+	// if !(len(video.Error) > 0) {
+	// 	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+	// 		"error": true,
+	// 		"message": "Video is not in error state",
+	// 	})
+	// }
+
+	activeJob, err := util.GetActiveJobByVideo(video.ID, util.VideoGenerationJobTypes...)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video jobs",
+		})
+	}
+
+	if activeJob != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+
+	// by default the video resumes from its first incomplete stage
+	type RecreateVideoRequest struct {
+		FromStage string `json:"from_stage"`
+	}
+
+	req := RecreateVideoRequest{FromStage: c.Query("from_stage")}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "Invalid request",
+			})
+		}
+	}
+
+	if req.FromStage != "" && !util.IsValidVideoStage(req.FromStage) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid stage",
+		})
+	}
+
+	job, err := util.EnqueueCreateVideo(video.ID, req.FromStage)
+	if errors.Is(err, util.ErrVideoGenerating) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error enqueueing video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error recreating video",
+		})
+	}
+
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"error": false,
-		"videos": videos,
+		"message": "Recreating video",
+		"job": job,
 	})
 }
 
-func GetVideo(c *fiber.Ctx) error {
+// CancelVideo stops the generation of a video, e.g. to fix a typo in the
+// topic without paying for the rest of the pipeline
+func CancelVideo(c *fiber.Ctx) error {
 	id := c.Params("id")
 	video, err := util.GetVideoById(id)
 	if err != nil {
@@ -63,19 +863,90 @@ func GetVideo(c *fiber.Ctx) error {
 		})
 	}
 
-	if video.Error != "" {
-		video.Error = "An error happened in a step. Try creating the video again"
+	cancelled, err := util.CancelVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error cancelling video",
+		})
+	}
+
+	if !cancelled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is not being generated",
+		})
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"error": false,
-		"video": video,
+		"message": "Cancelling video",
 	})
 }
 
+// DeleteVideo deletes a video and all of its artifacts. Videos being generated
+// or published have to be cancelled or finish first
+func DeleteVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
 
-func RecreateVideo(c *fiber.Ctx) error {
-	// if video exists but had an error, we start the background job again
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	activeJob, err := util.GetActiveJobByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting jobs",
+		})
+	}
+
+	if activeJob != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video has a job in progress, cancel it or wait for it to finish",
+			"jobID": activeJob.ID,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if err := util.DeleteVideo(ctx, video); err != nil {
+		// a job was enqueued meanwhile
+		if errors.Is(err, util.ErrVideoBusy) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": true,
+				"message": "Video has a job in progress, cancel it or wait for it to finish",
+			})
+		}
+
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error deleting video",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"message": "Video deleted",
+	})
+}
+
+// PublishVideo queues the publishing of a stitched video to the destinations
+// it wasn't published to yet, retrying the ones that failed
+func PublishVideo(c *fiber.Ctx) error {
 	id := c.Params("id")
 	video, err := util.GetVideoById(id)
 	if err != nil {
@@ -93,22 +964,186 @@ func RecreateVideo(c *fiber.Ctx) error {
 		})
 	}
 
-	// paying customers have full authority
-	// if !(len(video.Error) > 0) {
-	// 	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-	// 		"error": true,
-	// 		"message": "Video is not in error state",
-	// 	})
-	// }
+	if !video.VideoStitched {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is not ready yet",
+		})
+	}
 
-	go util.CreateVideo(video, true)
+	queued, err := util.EnqueuePublications(video)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error publishing video",
+		})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"error": false,
-		"message": "Recreating video",
+		"publications": queued,
+	})
+}
+
+func GetScriptVersions(c *fiber.Ctx) error {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	versions, err := util.GetScriptVersionsByVideo(video.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting script versions",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"versions": versions,
+	})
+}
+
+// getDraftAwaitingApproval returns the video if it is a draft whose script
+// is ready for review, otherwise it writes the error response
+func getDraftAwaitingApproval(c *fiber.Ctx) (*models.Video, error) {
+	id := c.Params("id")
+	video, err := util.GetVideoById(id)
+	if err != nil {
+		log.Printf("[ERROR] Error getting video: %v", err)
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video",
+		})
+	}
+
+	if video.OwnerID != c.Locals("id") {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": true,
+			"message": "Unauthorized",
+		})
+	}
+
+	activeJob, err := util.GetActiveJobByVideo(video.ID, util.VideoGenerationJobTypes...)
+	if err != nil {
+		return nil, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error getting video jobs",
+		})
+	}
+
+	if activeJob != nil || !video.Draft || !video.ScriptGenerated || video.ScriptApproved {
+		return nil, c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video script is not awaiting approval",
+		})
+	}
+
+	return video, nil
+}
+
+// UpdateScript saves the edits of the user to the script of a draft as a new version
+func UpdateScript(c *fiber.Ctx) error {
+	type UpdateScriptRequest struct {
+		Topic   string `json:"topic"`
+		Script  string `json:"script"`
+		Essence string `json:"essence"`
+	}
+
+	var req UpdateScriptRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid request",
+		})
+	}
+
+	if strings.TrimSpace(req.Script) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Script is required",
+		})
+	}
+
+	video, err := getDraftAwaitingApproval(c)
+	if video == nil {
+		return err
+	}
+
+	video.Script = strings.TrimSpace(req.Script)
+	if topic := strings.TrimSpace(req.Topic); topic != "" {
+		video.Topic = topic
+	}
+	if essence := strings.TrimSpace(req.Essence); essence != "" {
+		video.Essence = essence
+	}
+
+	version, err := util.AddScriptVersion(video, models.ScriptSourceEdit, "", c.Locals("id").(string))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error saving script",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"video": video,
+		"version": version,
 	})
 }
 
+// ApproveScript continues the pipeline of a draft with TTS, ASR, images and stitching
+func ApproveScript(c *fiber.Ctx) error {
+	video, err := getDraftAwaitingApproval(c)
+	if video == nil {
+		return err
+	}
+
+	video.ScriptApproved = true
+
+	video, err = util.SetVideo(video)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error approving script",
+		})
+	}
+
+	job, err := util.EnqueueCreateVideo(video.ID, "")
+	if errors.Is(err, util.ErrVideoGenerating) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": true,
+			"message": "Video is already being generated",
+		})
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error enqueueing video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error approving script",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"error": false,
+		"video": video,
+		"job": job,
+	})
+}
 
 func CreateSchedule(c *fiber.Ctx) error {
 	type CreateScheduleRequest struct {
@@ -120,6 +1155,16 @@ func CreateSchedule(c *fiber.Ctx) error {
 		IsOneTime bool `json:"isOneTime"`
 		VideoTheme string `json:"videoTheme"`
 		BackgroundMusic string `json:"backgroundMusic"`
+		ScriptProvider string `json:"scriptProvider"`
+		// stop after the script so it can be reviewed, see ApproveScript
+		Draft bool `json:"draft"`
+		CaptionStyle string `json:"captionStyle"`
+		CaptionPosition string `json:"captionPosition"`
+		// languages to localize the video to besides English
+		Languages []string `json:"languages"`
+		// integrated loudness of the mix in LUFS, -14 when not set
+		LoudnessTarget float64 `json:"loudnessTarget"`
+		TransitionSFX bool `json:"transitionSFX"`
 	}
 
 	var req CreateScheduleRequest
@@ -131,21 +1176,7 @@ func CreateSchedule(c *fiber.Ctx) error {
 		})
 	}
 
-	// const [musicTracks] = useState([
-    //     { name: "Another love", value: "_another-love" },
-    //     { name: "Bladerunner 2049", value: "_bladerunner-2049" },
-    //     { name: "Constellations", value: "_constellations" },
-    //     { name: "Fallen", value: "_fallen" },
-    //     { name: "Hotline", value: "_hotline" },
-    //     { name: "Izzamuzzic", value: "_izzamuzzic" },
-    //     { name: "Nas", value: "_nas" },
-    //     { name: "Paris else", value: "_paris-else" },
-    //     { name: "Snowfall", value: "_snowfall" },
-    // ])
-
-	validTracks := []string{"_another-love", "_bladerunner-2049", "_constellations", "_fallen", "_hotline", "_izzamuzzic", "_nas", "_paris-else", "_snowfall"}
-
-	if !util.Contains(validTracks, req.BackgroundMusic) {
+	if !util.IsValidBackgroundMusic(req.BackgroundMusic, c.Locals("id").(string)) {
 		log.Printf("[ERROR] Invalid background music: %v", req.BackgroundMusic)
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": true,
@@ -154,8 +1185,7 @@ func CreateSchedule(c *fiber.Ctx) error {
 	}
 
 	// verify if narrator is valid
-	narrators := []string{"alloy", "echo", "fable", "nova", "onyx", "shimmer"}
-	if !util.Contains(narrators, req.Narrator) {
+	if _, err := util.GetNarratorByName(req.Narrator); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": true,
 			"message": "Invalid narrator",
@@ -163,14 +1193,70 @@ func CreateSchedule(c *fiber.Ctx) error {
 	}
 
 	// verify if videoStyle is valid
-	videoStyles := []string{"default", "anime", "watercolor", "cartoon"}
-	if !util.Contains(videoStyles, req.VideoStyle) {
+	if !util.IsValidVideoStyle(req.VideoStyle) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": true,
 			"message": "Invalid video style",
 		})
 	}
 
+	if req.ScriptProvider != "" && !util.IsValidScriptProvider(req.ScriptProvider) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid script provider",
+		})
+	}
+
+	if req.CaptionStyle == "" {
+		req.CaptionStyle = util.CaptionStyleClassic
+	}
+
+	if !util.IsValidCaptionStyle(req.CaptionStyle) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid caption style",
+		})
+	}
+
+	if req.CaptionPosition == "" {
+		req.CaptionPosition = util.CaptionPositionBottom
+	}
+
+	if !util.IsValidCaptionPosition(req.CaptionPosition) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid caption position",
+		})
+	}
+
+	if req.LoudnessTarget == 0 {
+		req.LoudnessTarget = util.DefaultLoudnessTarget
+	}
+
+	if !util.IsValidLoudnessTarget(req.LoudnessTarget) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid loudness target",
+		})
+	}
+
+	languages, err := util.NormalizeLanguages(req.Languages)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": true,
+			"message": "Invalid languages",
+		})
+	}
+
+	for _, language := range languages {
+		if _, err := util.GetNarratorForLanguage(req.Narrator, language); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": true,
+				"message": "No narrator available for language " + language,
+			})
+		}
+	}
+
 	user, err := util.GetUserById(c.Locals("id").(string))
 	if err != nil {
 		log.Printf("[ERROR] Error getting user: %v", err)
@@ -199,6 +1285,13 @@ func CreateSchedule(c *fiber.Ctx) error {
 		Owner: *user,
 		VideoTheme: req.VideoTheme,
 		BackgroundMusic: req.BackgroundMusic,
+		ScriptProvider: req.ScriptProvider,
+		Draft: req.Draft,
+		CaptionStyle: req.CaptionStyle,
+		CaptionPosition: req.CaptionPosition,
+		Languages: languages,
+		LoudnessTarget: req.LoudnessTarget,
+		TransitionSFX: req.TransitionSFX,
 	}
 
 	video, err := util.SetVideo(videoData)
@@ -211,11 +1304,19 @@ func CreateSchedule(c *fiber.Ctx) error {
 	}
 
 	// start background job to create video
-	go util.CreateVideo(video, false)
+	job, err := util.EnqueueCreateVideo(video.ID, "")
+	if err != nil {
+		log.Printf("[ERROR] Error enqueueing video: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": true,
+			"message": "Error creating schedule",
+		})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"error": false,
 		"video": video,
+		"job": job,
 	})
 
 
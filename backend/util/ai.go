@@ -3,14 +3,12 @@ package util
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -39,6 +37,14 @@ const (
 	WatercolorStyle ImageStyle = "watercolor"
 )
 
+func IsValidVideoStyle(style string) bool {
+	switch ImageStyle(style) {
+	case DefaultStyle, AnimeStyle, CartoonStyle, WatercolorStyle:
+		return true
+	}
+	return false
+}
+
 type PromptResponse struct {
 	DallePrompt string `json:"dalle_prompt"`
 }
@@ -82,281 +88,341 @@ type SDXLResponse struct {
 
 
 func getVideoFolderPath(videoID string) string {
-	return filepath.Join(os.Getenv("HOME"), "Desktop", "reels", videoID)
+	return filepath.Join(getVideoWorkDir(), videoID)
 }
 
 func SaveVideoError(video *models.Video, err error) error {
+	// the job queue sends the failed event, once the job won't be retried
 	video.Error = err.Error()
+
 	_, err = SetVideo(video)
 	return err
 }
 
-func CreateVideo(video *models.Video, recreate bool) (*models.Video, error) {
+// failVideo records a stage error on the video, unless the stage failed
+// because the video was cancelled: that isn't an error of the pipeline
+func failVideo(ctx context.Context, video *models.Video, err error) error {
+	if ctx.Err() != nil {
+		log.Printf("[INFO] Stopped video %s: %v", video.ID, ctx.Err())
+		return ctx.Err()
+	}
+	return SaveVideoError(video, err)
+}
+
+// CreateVideo runs the pipeline for a video. Stages that already completed
+// (and whose artifacts are still on disk) are skipped, so a failed or
+// interrupted video resumes where it left off. fromStage forces that stage
+// and everything after it to run again. Cancelling ctx stops the stage that
+// is running (including outbound requests and ffmpeg) and returns ctx.Err()
+func CreateVideo(ctx context.Context, video *models.Video, fromStage string) (*models.Video, error) {
 	startTime := time.Now()
 
 	client := openai.NewClient(OPENAI_API_KEY)
 
-	if recreate {
-		video.Error = ""
-		// if video.DALLEPromptGenerated && video.DALLEGenerated && video.TTSGenerated {
-		// 	log.Printf("[INFO] Video already processed. Let's try to stitch it again: %s", video.ID)
-		// 	videoPtr, err := StitchVideo(*video);
-		// 	if err != nil {
-		// 		log.Printf("[ERROR] Error stitching video: %v", err)
-		// 		return nil, SaveVideoError(video, err)
-		// 	}
-
-		// 	video = &videoPtr
-
-		// 	// Update video progress
-		// 	video.Progress = 100
-		// 	video.VideoStitched = true
-
-		// 	video, err := SetVideo(video)
-		// 	if err != nil {
-		// 		log.Printf("[ERROR] Error saving video: %v", err)
-		// 		return nil, SaveVideoError(video, err)
-		// 	}
-		// 	return video, nil
-		// }
-
-		folderPath := getVideoFolderPath(video.ID)
-		if err := os.RemoveAll(folderPath); err != nil {
-			log.Printf("[ERROR] Error deleting folder: %v", err)
-		}
-
-		if err := os.MkdirAll(folderPath, 0755); err != nil {
-			log.Printf("[ERROR] Error creating folder: %v", err)
-			return nil, err
-		}
+	video.Error = ""
+	video.Cancelled = false
 
-		video.Progress = 0
-		video.ScriptGenerated = false
-		video.DALLEPromptGenerated = false
-		video.DALLEGenerated = false
-		video.TTSGenerated = false
-		video.VideoStitched = false
-		video.SRTGenerated = false
-		video.VideoUploaded = false
-		video.Error = ""
-		video.TTSURL = ""
-		video.StitchedVideoURL = ""
-
-		var err error
-		video, err = SetVideo(video)
-		if err != nil {
-			log.Printf("[ERROR] Error saving video: %v", err)
-			return nil, err
-		}
+	folderPath := getVideoFolderPath(video.ID)
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		log.Printf("[ERROR] Error creating folder: %v", err)
+		return nil, err
 	}
 
-	log.Printf("[INFO] Processing content for video: %s", video.ID)
+	// the work dir may be empty (another server, a restart), the stored
+	// artifacts decide which stages are complete
+	if err := restoreVideoFolder(ctx, video.ID); err != nil {
+		log.Printf("[ERROR] Error restoring artifacts of video %s: %v", video.ID, err)
+		return nil, failVideo(ctx, video, err)
+	}
 
-	// cleanedTopic, script, essence, err := processContent(client, video.Topic, video.Description)
-	cleanedTopic, script, essence, err := GenerateScriptClaude(video.Topic, video.Description)
+	var err error
+	resumeStage := firstIncompleteStage(video)
+	if fromStage != "" && (resumeStage == "" || stageIndex(fromStage) < stageIndex(resumeStage)) {
+		log.Printf("[INFO] Rerunning video %s from stage %s", video.ID, fromStage)
+		err = resetVideoFromStage(video, fromStage, true)
+	} else if resumeStage != "" {
+		log.Printf("[INFO] Resuming video %s from stage %s", video.ID, resumeStage)
+		err = resetVideoFromStage(video, resumeStage, false)
+	}
 	if err != nil {
-		log.Printf("[ERROR] Error processing content: %v", err)
-		return nil, SaveVideoError(video, err)
+		log.Printf("[ERROR] Error resetting video %s: %v", video.ID, err)
+		return nil, err
 	}
 
-	log.Printf("[INFO] Processed content for video: %s", video.ID)
-
-	video.Topic = cleanedTopic
-	video.Script = script
-	video.Essence = essence
-	video.ScriptGenerated = true
-	video.Progress = 10
-
 	video, err = SetVideo(video)
 	if err != nil {
 		log.Printf("[ERROR] Error saving video: %v", err)
-		return nil, SaveVideoError(video, err)
+		return nil, err
 	}
 
-	log.Printf("[INFO] Generating TTS for video: %s", video.ID)
+	if !video.ScriptGenerated {
+		log.Printf("[INFO] Processing content for video: %s", video.ID)
+		publishStageStarted(video, StageScript)
 
-	if err := generateTTSForScript(client, video); err != nil {
-		log.Printf("[ERROR] Error generating TTS: %v", err)
-		return nil, SaveVideoError(video, err)
-	}
+		generated, provider, err := WriteScriptForVideo(ctx, video)
+		if err != nil {
+			log.Printf("[ERROR] Error processing content: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	log.Printf("[INFO] Generated TTS for video: %s", video.ID)
+		log.Printf("[INFO] Processed content for video: %s with %s", video.ID, provider)
 
-	video.Progress = 30
-	video.TTSGenerated = true
+		video.Topic = generated.Topic
+		video.Script = generated.Script
+		video.Essence = generated.Essence
+		video.ScriptProviderUsed = provider
+		video.ScriptGenerated = true
+		video.Progress = 10
 
-	video, err = SetVideo(video)
-	if err != nil {
-		log.Printf("[ERROR] Error saving video: %v", err)
-		return nil, SaveVideoError(video, err)
-	}
+		if _, err := AddScriptVersion(video, models.ScriptSourceGenerated, provider, ""); err != nil {
+			return nil, failVideo(ctx, video, err)
+		}
 
-	log.Printf("[INFO] Generating SRT for video: %s", video.ID)
+		publishStageFinished(video, StageScript)
+	}
 
-	asrSentences, err := generateSRTForTTSTranscript(video)
-	if err != nil {
-		log.Printf("[ERROR] Error generating SRT: %v", err)
-		return nil, SaveVideoError(video, err)
+	// in draft mode the user reviews (and maybe edits) the script before
+	// anything is spent on the rest of the pipeline
+	if video.Draft && !video.ScriptApproved {
+		log.Printf("[INFO] Video %s is waiting for its script to be approved", video.ID)
+		PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventScriptReady, Stage: StageScript, Progress: video.Progress})
+		return video, nil
 	}
 
-	log.Printf("[INFO] Generated SRT for video: %s", video.ID)
+	if !video.TTSGenerated {
+		log.Printf("[INFO] Generating TTS for video: %s", video.ID)
+		publishStageStarted(video, StageTTS)
 
-	video.Progress = 50
-	video.SRTGenerated = true
-	video.SRTURL = filepath.Join(getVideoFolderPath(video.ID), "subtitles", "subtitles.json")
+		if err := generateTTSForScript(ctx, video); err != nil {
+			log.Printf("[ERROR] Error generating TTS: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	video, err = SetVideo(video)
-	if err != nil {
-		log.Printf("[ERROR] Error saving video: %v", err)
-		return nil, SaveVideoError(video, err)
-	}
+		log.Printf("[INFO] Generated TTS for video: %s", video.ID)
+
+		audioKey, err := storeVideoArtifact(ctx, getAudioFilePath(video.ID))
+		if err != nil {
+			log.Printf("[ERROR] Error storing TTS: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	forceAI := false
+		video.Progress = 30
+		video.TTSGenerated = true
+		video.TTSURL = audioKey
 
-	if video.MediaType == "stock" {
-		pexelsVideos, err := fetchPexelsVideos(*video, asrSentences)
+		video, err = SetVideo(video)
 		if err != nil {
-			log.Printf("[ERROR] Error fetching Pexels videos: %v", err)
-			forceAI = true
-		} else {
-			log.Printf("[INFO] Fetched %d Pexels videos", len(pexelsVideos))
+			log.Printf("[ERROR] Error saving video: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-			selectedVideos, err := matchVideosToSentences(pexelsVideos, asrSentences)
-			if err != nil {
-				log.Printf("[ERROR] Error matching videos to sentences: %v", err)
-				forceAI = true
-			} else {
-				log.Printf("[INFO] Matched %d videos to sentences", len(selectedVideos))
+		publishStageFinished(video, StageTTS)
+	}
 
-				// one must try to download these as well soon. 
-				// too tired to try.
+	var asrSentences []ASRSentences
 
-				video.MediaType = "stock"
-				video.Progress = 60
-				video, err = SetVideo(video)
-				if err != nil {
-					log.Printf("[ERROR] Error saving video: %v", err)
-					return nil, SaveVideoError(video, err)
-				}
-			}
+	if !video.SRTGenerated {
+		log.Printf("[INFO] Generating SRT for video: %s", video.ID)
+		publishStageStarted(video, StageSRT)
+
+		asrSentences, err = generateSRTForTTSTranscript(ctx, video)
+		if err != nil {
+			log.Printf("[ERROR] Error generating SRT: %v", err)
+			return nil, failVideo(ctx, video, err)
 		}
-	} 
 
-	if forceAI || video.MediaType == "ai" {
-		log.Printf("[INFO] Generating images (after generating prompt for each sentence) for video: %s", video.ID)
+		log.Printf("[INFO] Generated SRT for video: %s", video.ID)
 
-		err = generateAndSaveImagesForScript(client, video)
+		subtitlesKey, err := storeVideoArtifact(ctx, getSubtitlesFilePath(video.ID))
 		if err != nil {
-			log.Printf("[ERROR] Error generating images: %v", err)
-			return nil, SaveVideoError(video, err)
+			log.Printf("[ERROR] Error storing SRT: %v", err)
+			return nil, failVideo(ctx, video, err)
 		}
 
-		video.Progress = 80
-		video.DALLEGenerated = true
-		video.DALLEPromptGenerated = true
+		video.Progress = 50
+		video.SRTGenerated = true
+		video.SRTURL = subtitlesKey
 
 		video, err = SetVideo(video)
 		if err != nil {
 			log.Printf("[ERROR] Error saving video: %v", err)
-			return nil, SaveVideoError(video, err)
+			return nil, failVideo(ctx, video, err)
+		}
+
+		publishStageFinished(video, StageSRT)
+	} else {
+		asr, err := readASRForVideo(video.ID)
+		if err != nil {
+			log.Printf("[ERROR] Error reading SRT: %v", err)
+			return nil, failVideo(ctx, video, err)
 		}
 
-		log.Printf("[INFO] Generated images for video: %s", video.ID)
+		asrSentences = asr.Sentences
 	}
 
-	log.Printf("[INFO] Going to try to stitch video now: %s", video.ID)
+	if !video.DALLEGenerated {
+		forceAI := false
+		publishStageStarted(video, StageImages)
 
-	videoPtr, err := StitchVideo(*video)
-	if err != nil {
-		log.Printf("[ERROR] Error stitching video: %v", err)
-		return nil, SaveVideoError(video, err)
-	}
+		if video.MediaType == "stock" {
+			matches, err := matchStockClipsToSentences(ctx, client, video, asrSentences)
+			if err != nil {
+				log.Printf("[ERROR] Error matching Pexels videos to sentences: %v", err)
+				forceAI = true
+			} else {
+				log.Printf("[INFO] Matched %d Pexels videos to sentences", len(matches))
+
+				if err := downloadStockClips(ctx, video, asrSentences, matches); err != nil {
+					log.Printf("[ERROR] Error downloading stock clips: %v", err)
+					forceAI = true
+				} else {
+					// the media for every sentence is ready
+					video.MediaType = "stock"
+					video.DALLEGenerated = true
+					video.Progress = 80
+					video, err = SetVideo(video)
+					if err != nil {
+						log.Printf("[ERROR] Error saving video: %v", err)
+						return nil, failVideo(ctx, video, err)
+					}
+
+					publishStageFinished(video, StageImages)
+				}
+			}
+		}
 
-	video = &videoPtr
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 
-	log.Printf("[INFO] Stitched video for video: %s", video.ID)
+		if forceAI || video.MediaType == "ai" {
+			log.Printf("[INFO] Generating images (after generating prompt for each sentence) for video: %s", video.ID)
 
-	video.Progress = 100
-	video.VideoStitched = true
+			err = generateAndSaveImagesForScript(ctx, client, video)
+			if err != nil {
+				log.Printf("[ERROR] Error generating images: %v", err)
+				return nil, failVideo(ctx, video, err)
+			}
 
-	video, err = SetVideo(video)
-	if err != nil {
-		log.Printf("[ERROR] Error saving video: %v", err)
-		return nil, SaveVideoError(video, err)
+			video.Progress = 80
+			video.DALLEGenerated = true
+			video.DALLEPromptGenerated = true
+
+			video, err = SetVideo(video)
+			if err != nil {
+				log.Printf("[ERROR] Error saving video: %v", err)
+				return nil, failVideo(ctx, video, err)
+			}
+
+			log.Printf("[INFO] Generated images for video: %s", video.ID)
+			publishStageFinished(video, StageImages)
+		}
 	}
 
-	endTime := time.Now()
+	if !video.AudioMastered {
+		log.Printf("[INFO] Mastering audio for video: %s", video.ID)
+		publishStageStarted(video, StageMaster)
 
-	log.Printf("[INFO] Video processing completed in %v", endTime.Sub(startTime))
+		n, err := videoNarration(*video)
+		if err != nil {
+			log.Printf("[ERROR] Error reading narration: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	return video, nil
-}
+		if err := masterAudio(ctx, *video, n); err != nil {
+			log.Printf("[ERROR] Error mastering audio: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-func fetchPexelsVideos(video models.Video, asrSentences []ASRSentences) ([]PexelsVideo, error) {
-	httpClient := &http.Client{}
-	req, err := http.NewRequest("GET", "https://api.pexels.com/videos/search", nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
-	}
+		mixKey, err := storeVideoArtifact(ctx, n.MixPath)
+		if err != nil {
+			log.Printf("[ERROR] Error storing mastered audio: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	req.Header.Set("Authorization", os.Getenv("PEXELS_API_KEY"))
-	req.Header.Set("Accept", "application/json")
+		video.Progress = stageProgress(StageStitch)
+		video.AudioMastered = true
+		video.MasteredAudioURL = mixKey
 
-	query := url.Values{}
-	query.Add("query", video.Essence)
-	query.Add("per_page", fmt.Sprintf("%d", len(asrSentences)*2)) // Fetch more videos than sentences for better matching
-	req.URL.RawQuery = query.Encode()
+		video, err = SetVideo(video)
+		if err != nil {
+			log.Printf("[ERROR] Error saving video: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error sending request: %v", err)
+		publishStageFinished(video, StageMaster)
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
-	}
+	if !video.VideoStitched {
+		log.Printf("[INFO] Going to try to stitch video now: %s", video.ID)
+		publishStageStarted(video, StageStitch)
 
-	var pexelsResponse PexelsResponse
-	err = json.Unmarshal(body, &pexelsResponse)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling response: %v", err)
-	}
+		videoPtr, err := StitchVideo(ctx, *video)
+		if err != nil {
+			log.Printf("[ERROR] Error stitching video: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	return pexelsResponse.Videos, nil
-}
+		video = &videoPtr
+
+		log.Printf("[INFO] Stitched video for video: %s", video.ID)
 
-func matchVideosToSentences(videos []PexelsVideo, sentences []ASRSentences) ([]PexelsVideo, error) {
-	if len(videos) == 0 {
-		return nil, fmt.Errorf("no videos fetched from Pexels")
+		video.Progress = 100
+		if len(video.Languages) > 0 {
+			video.Progress = stageProgress(StageLocalize)
+		}
+		video.VideoStitched = true
+
+		video, err = SetVideo(video)
+		if err != nil {
+			log.Printf("[ERROR] Error saving video: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 	}
 
-	// Calculate total duration of all sentences
-	totalSentenceDuration := sentences[len(sentences)-1].End - sentences[0].Start
+	if !isVideoStageComplete(video, StageLocalize) {
+		log.Printf("[INFO] Localizing video %s to %s", video.ID, strings.Join(video.Languages, ", "))
+		publishStageStarted(video, StageLocalize)
 
-	// Sort videos by duration, closest to total sentence duration first
-	// sort.Slice(videos, func(i, j int) bool {
-	// 	return math.Abs(float64(videos[i].Duration*1000-totalSentenceDuration)) <
-	// 		math.Abs(float64(videos[j].Duration*1000-totalSentenceDuration))
-	// })
+		if err := localizeVideo(ctx, client, video); err != nil {
+			log.Printf("[ERROR] Error localizing video: %v", err)
+			return nil, failVideo(ctx, video, err)
+		}
 
-	// Select videos that cover the total duration
-	var selectedVideos []PexelsVideo
-	currentDuration := float64(0)
-	for _, video := range videos {
-		if currentDuration >= totalSentenceDuration {
-			break
+		// variants that failed are listed with their error, the video itself is done
+		video.Progress = 100
+
+		video, err = SetVideo(video)
+		if err != nil {
+			log.Printf("[ERROR] Error saving video: %v", err)
+			return nil, failVideo(ctx, video, err)
 		}
-		selectedVideos = append(selectedVideos, video)
-		currentDuration += float64(video.Duration) * float64(1000) // Convert to milliseconds
+
+		publishStageFinished(video, StageLocalize)
+	}
+
+	// publishing failures are tracked per destination and don't fail the video
+	if _, err := EnqueuePublications(video); err != nil {
+		log.Printf("[ERROR] Error enqueueing publications for video %s: %v", video.ID, err)
 	}
 
-	return selectedVideos, nil
+	endTime := time.Now()
+
+	log.Printf("[INFO] Video processing completed in %v", endTime.Sub(startTime))
+
+	PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventDone, Stage: StageStitch, Progress: video.Progress})
+
+	return video, nil
 }
 
-func generateTTSForScript(client *openai.Client, video *models.Video) error {
-	audioData, err := generateTTSForFullScript(client, video.Script, video.Narrator)
+func generateTTSForScript(ctx context.Context, video *models.Video) error {
+	// audio left over from an interrupted run was made from the current script
+	if fileExists(getAudioFilePath(video.ID)) {
+		log.Printf("[INFO] Reusing existing TTS for video: %s", video.ID)
+		return nil
+	}
+
+	audioData, err := SynthesizeForNarrator(ctx, video.Script, video.Narrator)
 	if err != nil {
 		return fmt.Errorf("error generating TTS for script: %v", err)
 	}
@@ -372,45 +438,35 @@ func generateTTSForScript(client *openai.Client, video *models.Video) error {
 	return ioutil.WriteFile(filePath, audioData, 0644)
 }
 
-func generateTTSForFullScript(client *openai.Client, script, narrator string) ([]byte, error) {
-	req := openai.CreateSpeechRequest{
-		Model: openai.TTSModel1HD,
-		Input: script,
-		Voice: openai.VoiceAlloy,
-	}
-
-	switch narrator {
-	case "alloy":
-		req.Voice = openai.VoiceAlloy
-	case "echo":
-		req.Voice = openai.VoiceEcho
-	case "fable":
-		req.Voice = openai.VoiceFable
-	case "onyx":
-		req.Voice = openai.VoiceOnyx
-	case "nova":
-		req.Voice = openai.VoiceNova
-	case "shimmer":
-		req.Voice = openai.VoiceShimmer
-	}
-
-	resp, err := client.CreateSpeech(context.Background(), req)
-	if err != nil {
-		return nil, fmt.Errorf("speech creation failed: %v", err)
-	}
-	defer resp.Close()
-
-	return io.ReadAll(resp)
-}
-
-func generateSRTForTTSTranscript(video *models.Video) ([]ASRSentences, error) {
-	audioFilePath := filepath.Join(getVideoFolderPath(video.ID), "audio", "full_audio.mp3")
+func generateSRTForTTSTranscript(ctx context.Context, video *models.Video) ([]ASRSentences, error) {
+	audioFilePath := getAudioFilePath(video.ID)
 
 	asrSentences := []ASRSentences{}
 
-	srtContent, err := generateSRTWithWhisper(audioFilePath, video.Script)
+	if fileExists(getSubtitlesFilePath(video.ID)) {
+		log.Printf("[INFO] Reusing existing SRT for video: %s", video.ID)
+		asr, err := readASRForVideo(video.ID)
+		if err != nil {
+			return asrSentences, err
+		}
+		video.TimingsEstimated = asr.Estimated
+		return asr.Sentences, nil
+	}
+
+	srtContent, err := generateSRTWithWhisper(ctx, audioFilePath, video.Script)
 	if err != nil {
-		return asrSentences, fmt.Errorf("error generating SRT with Whisper: %v", err)
+		if ctx.Err() != nil {
+			return asrSentences, err
+		}
+
+		// the video doesn't have to fail with the ASR service, the timings
+		// can be estimated from the script and the length of the narration
+		log.Printf("[ERROR] Error generating SRT with Whisper, estimating the timings of video %s: %v", video.ID, err)
+
+		srtContent, err = estimateSRTForScript(ctx, audioFilePath, video.Script)
+		if err != nil {
+			return asrSentences, fmt.Errorf("error estimating SRT: %v", err)
+		}
 	}
 
 	srtFolderPath := filepath.Join(getVideoFolderPath(video.ID), "subtitles")
@@ -432,11 +488,32 @@ func generateSRTForTTSTranscript(video *models.Video) ([]ASRSentences, error) {
 	}
 
 	asrSentences = asr.Sentences
+	video.TimingsEstimated = asr.Estimated
 
 	return asrSentences, err
 }
 
-func generateSRTWithWhisper(audioFilePath string, script string) (string, error) {
+// estimateSRTForScript builds the ASR output for the script with the offline
+// aligner, from the measured duration of the narration
+func estimateSRTForScript(ctx context.Context, audioFilePath string, script string) (string, error) {
+	audioDuration, err := probeMediaDuration(ctx, audioFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	asr := estimateASR(script, audioDuration)
+	if len(asr.Sentences) == 0 {
+		return "", fmt.Errorf("the script has no sentences")
+	}
+
+	content, err := json.Marshal(asr)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func generateSRTWithWhisper(ctx context.Context, audioFilePath string, script string) (string, error) {
 	file, err := os.Open(audioFilePath)
 	if err != nil {
 		return "", fmt.Errorf("error opening audio file: %v", err)
@@ -454,11 +531,13 @@ func generateSRTWithWhisper(audioFilePath string, script string) (string, error)
 	}
 
 	_ = writer.WriteField("original_script", script)
+	// services that support it return the words of each sentence with their timings
+	_ = writer.WriteField("word_timestamps", "true")
 
 	writer.Close()
 	
 
-	req, err := http.NewRequest("POST", "http://localhost:5000/generate_asr", body)
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://localhost:5000/generate_asr", body)
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %v", err)
 	}
@@ -476,93 +555,53 @@ func generateSRTWithWhisper(audioFilePath string, script string) (string, error)
 		return "", fmt.Errorf("error reading response: %v", err)
 	}
 
-	return string(srtContent), nil
-}
-
-func generateImageForPrompt(prompt string, style ImageStyle, numImages int) ([]byte, error) {
-	fullPrompt := prompt
-
-	apiKey := os.Getenv("ACIDRAIN_OLA_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("ACIDRAIN_OLA_KEY environment variable not set")
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("ASR service returned status code %d: %s", resp.StatusCode, string(srtContent))
 	}
 
-	log.Printf("Generating image for prompt: %s", fullPrompt)
-
-	seed := 1075943719
-	seedPtr := &seed
-
-	reqBody := SDXLRequest{
-		ModelName:         "diffusion1XL",
-		Prompt:            fullPrompt,
-		ImageHeight:       1024,
-		ImageWidth:        1024,
-		NumOutputImages:   numImages,
-		GuidanceScale:     10,
-		NumInferenceSteps: 50,
-		Seed:              seedPtr,
-		OutputImgType:     "pil",
+	// a response without sentences is as useless as an error
+	var asr ASR
+	if err := json.Unmarshal(srtContent, &asr); err != nil {
+		return "", fmt.Errorf("invalid ASR response: %v", err)
 	}
-
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request body: %v", err)
+	if len(asr.Sentences) == 0 {
+		return "", fmt.Errorf("ASR response has no sentences")
 	}
 
-	req, err := http.NewRequest("POST", "https://cloud.olakrutrim.com/v1/images/generations/diffusion", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
+	return string(srtContent), nil
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
+func readASRForVideo(videoID string) (*ASR, error) {
+	return readASRFile(getSubtitlesFilePath(videoID))
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func readASRFile(path string) (*ASR, error) {
+	srtContent, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %v", err)
+		return nil, fmt.Errorf("error reading SRT file: %v", err)
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	var asr ASR
+	err = json.Unmarshal(srtContent, &asr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+		return nil, fmt.Errorf("error unmarshalling ASR content: %v", err)
 	}
+	return &asr, nil
+}
 
-	var sdxlResp SDXLResponse
-	err = json.Unmarshal(body, &sdxlResp)
+func generateAndSaveImagesForScript(ctx context.Context, client *openai.Client, video *models.Video) error {
+	asr, err := readASRForVideo(video.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
-	}
-
-	if len(sdxlResp.Data) == 0 {
-		return nil, fmt.Errorf("no image data received")
+		return err
 	}
+	sentences := SplitScriptASRIntoSentences(asr.Sentences)
 
-	imageData, err := base64.StdEncoding.DecodeString(sdxlResp.Data[0].B64JSON)
+	scenes, err := syncScenes(video, asr.Sentences, func(index int) string {
+		return getSceneImagePath(video.ID, index)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode base64 image data: %v", err)
+		return fmt.Errorf("error preparing scenes: %v", err)
 	}
 
-	return imageData, nil
-}
-
-func generateAndSaveImagesForScript(client *openai.Client, video *models.Video) error {
-	srtFilePath := filepath.Join(getVideoFolderPath(video.ID), "subtitles", "subtitles.json")
-	srtContent, err := ioutil.ReadFile(srtFilePath)
-	if err != nil {
-		return fmt.Errorf("error reading SRT file: %v", err)
-	}
-	var asr ASR
-	err = json.Unmarshal(srtContent, &asr)
-	if err != nil {
-		return fmt.Errorf("error unmarshalling ASR content: %v", err)
-	}
-	sentences := SplitScriptASRIntoSentences(asr.Sentences)
 	var wg sync.WaitGroup
 	errorChan := make(chan error, len(sentences))
 	// Semaphore to limit the number of concurrent goroutines
@@ -581,13 +620,26 @@ func generateAndSaveImagesForScript(client *openai.Client, video *models.Video)
 		retryDelays = append(retryDelays, time.Duration(i*10)*time.Second)
 	}
 
+	imageProviders := GetImageProvidersForUser(video.OwnerID)
+	imageParams := GetImageParamsForStyle(video.VideoStyle)
+
 	for i, sentence := range sentences {
+		// images left over from an earlier run are reused
+		if scenes[i].Status == models.SceneStatusReady {
+			continue
+		}
+
 		wg.Add(1)
-		go func(index int, s string) {
+		go func(index int, s string, scene *models.Scene) {
 			defer wg.Done()
 			
 			// Acquire semaphore
-			semaphore <- struct{}{}
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				errorChan <- ctx.Err()
+				return
+			}
 			defer func() { <-semaphore }() // Release semaphore
 
 			var prompt string
@@ -602,44 +654,73 @@ func generateAndSaveImagesForScript(client *openai.Client, video *models.Video)
 
 			// Retry loop for prompt generation
 			for retryCount := 0; retryCount <= len(retryDelays); retryCount++ {
-				prompt, err = generateDallEPromptForSentence(client, s, video, lastSentence)
+				prompt, err = generateDallEPromptForSentence(ctx, client, s, video, lastSentence)
 				if err == nil {
 					break
 				}
 				if retryCount < len(retryDelays) {
 					log.Printf("Error generating prompt for sentence '%s', retrying in %v: %v", s, retryDelays[retryCount], err)
-					time.Sleep(retryDelays[retryCount])
+					if !sleepContext(ctx, retryDelays[retryCount]) {
+						errorChan <- ctx.Err()
+						return
+					}
 				}
 			}
 			if err != nil {
 				errorChan <- fmt.Errorf("[ERROR] failed to generate prompt for sentence '%s' after all retries: %v", s, err)
+				finishScene(scene, "", err)
 				return
 			}
 
+			scene.Prompt = prompt
+
 			// Retry loop for image generation
 			for retryCount := 0; retryCount <= len(retryDelays); retryCount++ {
-				imageData, err = generateImageForPrompt(prompt, ImageStyle(video.VideoStyle), 1)
+				var provider string
+				imageData, provider, err = generateImageWithFallback(ctx, imageProviders, prompt, imageParams)
 				if err == nil {
+					log.Printf("[INFO] Generated image %d with %s", index+1, provider)
+
+					scene.Provider = provider
+					scene.Seed = nil
+					if imageProviderUsesSeed(provider) {
+						scene.Seed = imageParams.Seed
+					}
 					break
 				}
 				if retryCount < len(retryDelays) {
 					log.Printf("[ERROR] Error generating image for prompt %d, retrying in %v: %v", index+1, retryDelays[retryCount], err)
-					time.Sleep(retryDelays[retryCount])
+					if !sleepContext(ctx, retryDelays[retryCount]) {
+						errorChan <- ctx.Err()
+						return
+					}
 				}
 			}
 			if err != nil {
 				errorChan <- fmt.Errorf("failed to generate image for prompt %d after all retries: %v", index+1, err)
+				finishScene(scene, "", err)
+				PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventScene, Stage: StageImages, Progress: video.Progress, Scene: index + 1, Scenes: len(sentences), Message: err.Error()})
 				return
 			}
 
 			// Save image
-			filename := fmt.Sprintf("image_%d.png", index+1)
-			filePath := filepath.Join(folderPath, filename)
+			filePath := getSceneImagePath(video.ID, index)
 			if err := ioutil.WriteFile(filePath, imageData, 0644); err != nil {
 				errorChan <- fmt.Errorf("error saving image %d: %v", index+1, err)
+				finishScene(scene, "", err)
+				return
+			}
+
+			if _, err := storeVideoArtifact(ctx, filePath); err != nil {
+				errorChan <- fmt.Errorf("error storing image %d: %v", index+1, err)
+				finishScene(scene, "", err)
 				return
 			}
-		}(i, sentence)
+
+			finishScene(scene, filePath, nil)
+
+			PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventScene, Stage: StageImages, Progress: video.Progress, Scene: index + 1, Scenes: len(sentences)})
+		}(i, sentence, &scenes[i])
 	}
 	wg.Wait()
 	close(errorChan)
@@ -657,9 +738,9 @@ func generateAndSaveImagesForScript(client *openai.Client, video *models.Video)
 	return nil
 }
 
-func generateDallEPromptForSentence(client *openai.Client, formattedSentence string, video *models.Video, lastSentence string) (string, error) {
+func generateDallEPromptForSentence(ctx context.Context, client *openai.Client, formattedSentence string, video *models.Video, lastSentence string) (string, error) {
 	if isDevMode() {
-		return generateDallEPromptForSentenceGemini(formattedSentence, video, lastSentence)
+		return generateDallEPromptForSentenceGemini(ctx, formattedSentence, video, lastSentence)
 	}
 
 	functionDescription := openai.FunctionDefinition{
@@ -679,7 +760,7 @@ func generateDallEPromptForSentence(client *openai.Client, formattedSentence str
 
 	styleInstruction := getStyleInstruction(video.VideoStyle)
 	resp, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT4,
 			Messages: []openai.ChatCompletionMessage{
@@ -829,8 +910,7 @@ For each sentence I provide, respond with an list containing the SDXL prompt (Mu
 	return cleanedPrompts, nil
 }
 
-func generateDallEPromptForSentenceGemini(formattedSentence string, video *models.Video, lastSentence string) (string, error) {
-	ctx := context.Background()
+func generateDallEPromptForSentenceGemini(ctx context.Context, formattedSentence string, video *models.Video, lastSentence string) (string, error) {
 	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
 	if err != nil {
 		return "", fmt.Errorf("error creating Gemini client: %v", err)
@@ -910,11 +990,7 @@ func getStyleInstruction(style string) string {
 	}
 }
 
-func processContent(client *openai.Client, topic, description string) (string, string, string, error) {
-	if isDevMode() {
-		return processContentGemini(topic, description)
-	}
-
+func processContent(ctx context.Context, client *openai.Client, topic, description string) (string, string, string, error) {
 	functionDescription := openai.FunctionDefinition{
 		Name:        "process_content",
 		Description: "Process a topic and description to create a cleaned topic and script for short-form video content",
@@ -939,7 +1015,7 @@ func processContent(client *openai.Client, topic, description string) (string, s
 	}
 
 	resp, err := client.CreateChatCompletion(
-		context.Background(),
+		ctx,
 		openai.ChatCompletionRequest{
 			Model: openai.GPT4,
 			Messages: []openai.ChatCompletionMessage{
@@ -964,6 +1040,9 @@ func processContent(client *openai.Client, topic, description string) (string, s
 	if err != nil {
 		return "", "", "", fmt.Errorf("error creating chat completion: %v", err)
 	}
+	if len(resp.Choices) == 0 {
+		return "", "", "", fmt.Errorf("no choices returned from the API")
+	}
 
 	functionArgs := resp.Choices[0].Message.FunctionCall.Arguments
 	// clean functionArgs of \n
@@ -984,7 +1063,7 @@ func processContent(client *openai.Client, topic, description string) (string, s
 	return result.CleanedTopic, result.Script, result.Essence, nil
 }
 
-func GenerateScriptClaude(topic, description string) (string, string, string, error) {
+func GenerateScriptClaude(ctx context.Context, topic, description string) (string, string, string, error) {
 	client := anthropic.NewClient(
 		anthropicOpts.WithAPIKey(
 			os.Getenv("ANTHROPIC_API_KEY"),
@@ -1013,7 +1092,7 @@ Remember, your response will be directly parsed. Do not even include a paragraph
 Do not include hashtags, links, emojis, or any guidance on how to shoot the video or camera angles in the script.`, topic, description))),
 	}
 
-	message, err := client.Messages.New(context.TODO(), anthropic.MessageNewParams{
+	message, err := client.Messages.New(ctx, anthropic.MessageNewParams{
 		Model:     anthropic.F(anthropic.ModelClaude_3_5_Sonnet_20240620),
 		MaxTokens: anthropic.Int(1024),
 		System: anthropic.F([]anthropic.TextBlockParam{
@@ -1045,8 +1124,7 @@ Do not include hashtags, links, emojis, or any guidance on how to shoot the vide
 	return result.CleanedTopic, result.Script, result.Essence, nil
 }
 
-func processContentGemini(topic, description string) (string, string, string, error) {
-	ctx := context.Background()
+func processContentGemini(ctx context.Context, topic, description string) (string, string, string, error) {
 	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
 	if err != nil {
 		return "", "", "", fmt.Errorf("error creating Gemini client: %v", err)
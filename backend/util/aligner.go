@@ -0,0 +1,208 @@
+package util
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Pauses of the narration, in syllables, after the punctuation ending a word
+const (
+	alignerClausePause   = 1.0 // , ; : and dashes
+	alignerSentencePause = 2.0 // . ! ?
+)
+
+// estimateASR is the fallback for when the ASR service is down: it spreads
+// the script over the duration of the narration, giving every word time by
+// its syllables and adding pauses at the punctuation. The timings are close
+// enough for scene changes and captions, and flagged as estimated
+func estimateASR(script string, audioDuration float64) ASR {
+	return estimateASRForSentences(splitScriptSentences(script), audioDuration)
+}
+
+// estimateASRForSentences is estimateASR for a script that is already split
+// into sentences, which are kept as they are
+func estimateASRForSentences(sentences []string, audioDuration float64) ASR {
+	asr := ASR{Estimated: true}
+
+	if len(sentences) == 0 || audioDuration <= 0 {
+		return asr
+	}
+
+	var words []string
+	var sentenceOf []int
+	for i, sentence := range sentences {
+		for _, word := range strings.Fields(sentence) {
+			words = append(words, word)
+			sentenceOf = append(sentenceOf, i)
+		}
+	}
+
+	if len(words) == 0 {
+		return asr
+	}
+
+	timings := estimateWordTimings(words, 0, audioDuration*1000)
+
+	for i, sentence := range sentences {
+		sentence = strings.Join(strings.Fields(sentence), " ")
+		if sentence == "" {
+			continue
+		}
+
+		var sentenceWords []ASRWord
+		for j, word := range words {
+			if sentenceOf[j] == i {
+				sentenceWords = append(sentenceWords, ASRWord{Text: word, Start: timings[j][0], End: timings[j][1]})
+			}
+		}
+
+		asr.Sentences = append(asr.Sentences, ASRSentences{
+			// like the ASR service, sentences start with a space
+			Text:  " " + sentence,
+			Start: sentenceWords[0].Start,
+			End:   sentenceWords[len(sentenceWords)-1].End,
+			Words: sentenceWords,
+		})
+	}
+
+	return asr
+}
+
+// estimateWordTimings shares the time between start and end out between the
+// words by their syllables, leaving pauses after punctuation. It returns the
+// start and end of every word
+func estimateWordTimings(words []string, start float64, end float64) [][2]float64 {
+	if len(words) == 0 {
+		return nil
+	}
+
+	weights := make([]float64, len(words))
+	pauses := make([]float64, len(words))
+	total := 0.0
+	for i, word := range words {
+		weights[i] = float64(countSyllables(word))
+		// nothing is said after the last word, its pause would be lost
+		if i < len(words)-1 {
+			pauses[i] = punctuationPause(word)
+		}
+		total += weights[i] + pauses[i]
+	}
+
+	unit := math.Max(end-start, 0) / total
+
+	timings := make([][2]float64, len(words))
+	cursor := start
+	for i := range words {
+		timings[i] = [2]float64{cursor, cursor + weights[i]*unit}
+		cursor += (weights[i] + pauses[i]) * unit
+	}
+	return timings
+}
+
+// punctuationPause is how long the narration pauses after a word, in syllables
+func punctuationPause(word string) float64 {
+	word = strings.TrimRight(word, `"')]»”’`)
+	if word == "" {
+		return 0
+	}
+
+	switch {
+	case strings.HasSuffix(word, "..."), strings.HasSuffix(word, "…"):
+		return alignerSentencePause
+	case strings.ContainsAny(word[len(word)-1:], ".!?"):
+		return alignerSentencePause
+	case strings.ContainsAny(word[len(word)-1:], ",;:"), strings.HasSuffix(word, "—"), strings.HasSuffix(word, "–"):
+		return alignerClausePause
+	}
+	return 0
+}
+
+// countSyllables guesses the syllables of a word from its vowel groups, which
+// is right for most English words. Digits are read out one by one at worst,
+// and scripts without vowels (e.g. CJK) count a syllable per character
+func countSyllables(word string) int {
+	word = strings.ToLower(word)
+
+	syllables := 0
+	letters := 0
+	vowelGroups := 0
+	inVowel := false
+	var last, beforeLast rune
+
+	for _, r := range word {
+		switch {
+		case unicode.IsDigit(r):
+			syllables++
+			inVowel = false
+			continue
+		case !unicode.IsLetter(r):
+			inVowel = false
+			continue
+		}
+
+		letters++
+		vowel := strings.ContainsRune("aeiouyàáâãäåèéêëìíîïòóôõöùúûüýÿæœ", r)
+		if vowel && !inVowel {
+			vowelGroups++
+		}
+		inVowel = vowel
+		beforeLast, last = last, r
+	}
+
+	if letters == 0 {
+		if syllables == 0 {
+			return 1
+		}
+		return syllables
+	}
+
+	if vowelGroups == 0 {
+		// no latin vowels at all, like CJK
+		if !isLatinWord(word) {
+			return syllables + letters
+		}
+		return syllables + 1
+	}
+
+	// a trailing e is usually silent (make, stone) but not after an l (table)
+	if last == 'e' && beforeLast != 'l' && vowelGroups > 1 && !strings.ContainsRune("aeiouy", beforeLast) {
+		vowelGroups--
+	}
+
+	return syllables + vowelGroups
+}
+
+func isLatinWord(word string) bool {
+	for _, r := range word {
+		if unicode.IsLetter(r) && !unicode.Is(unicode.Latin, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// splitScriptSentences splits a script where a sentence ends: after . ! or ?
+// followed by a space, and at line breaks
+func splitScriptSentences(script string) []string {
+	var sentences []string
+
+	for _, line := range strings.Split(script, "\n") {
+		words := strings.Fields(line)
+
+		var sentence []string
+		for _, word := range words {
+			sentence = append(sentence, word)
+			if punctuationPause(word) == alignerSentencePause {
+				sentences = append(sentences, strings.Join(sentence, " "))
+				sentence = nil
+			}
+		}
+
+		if len(sentence) > 0 {
+			sentences = append(sentences, strings.Join(sentence, " "))
+		}
+	}
+
+	return sentences
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCountSyllables(t *testing.T) {
+	tests := []struct {
+		word string
+		want int
+	}{
+		{"cat", 1},
+		{"the", 1},
+		{"make", 1},
+		{"stone", 1},
+		{"table", 2},
+		{"queue", 1},
+		{"beautiful", 3},
+		{"rhythm", 1},
+		{"café", 2},
+		{"Hello,", 2},
+		{"\"Stop!\"", 1},
+		{"Brrr", 1},
+		{"2024", 4},
+		{"100%", 3},
+		{"A4", 2},
+		{"—", 1},
+		{"日本語", 3},
+	}
+
+	for _, tt := range tests {
+		if got := countSyllables(tt.word); got != tt.want {
+			t.Errorf("countSyllables(%q) = %d, want %d", tt.word, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateWordTimings(t *testing.T) {
+	tests := []struct {
+		name  string
+		words []string
+		start float64
+		end   float64
+		want  [][2]float64
+	}{
+		{"even words", []string{"one", "two"}, 0, 2000, [][2]float64{{0, 1000}, {1000, 2000}}},
+		{"by syllables", []string{"cat", "table"}, 0, 3000, [][2]float64{{0, 1000}, {1000, 3000}}},
+		{"offset", []string{"table"}, 1000, 3000, [][2]float64{{1000, 3000}}},
+		{"clause pause", []string{"Hi,", "there."}, 0, 3000, [][2]float64{{0, 1000}, {2000, 3000}}},
+		{"sentence pause", []string{"Done.", "Next"}, 0, 4000, [][2]float64{{0, 1000}, {3000, 4000}}},
+		{"pause behind a quote", []string{"“Stop!”", "now"}, 0, 4000, [][2]float64{{0, 1000}, {3000, 4000}}},
+		{"no pause after the last word", []string{"one", "two."}, 0, 2000, [][2]float64{{0, 1000}, {1000, 2000}}},
+		{"end before start", []string{"a", "b"}, 5, 3, [][2]float64{{5, 5}, {5, 5}}},
+		{"no words", nil, 0, 1000, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := estimateWordTimings(tt.words, tt.start, tt.end)
+			if len(got) != len(tt.want) {
+				t.Fatalf("estimateWordTimings(%q) = %v, want %v", tt.words, got, tt.want)
+			}
+
+			for i := range tt.want {
+				if math.Abs(got[i][0]-tt.want[i][0]) > 1e-6 || math.Abs(got[i][1]-tt.want[i][1]) > 1e-6 {
+					t.Errorf("estimateWordTimings(%q) = %v, want %v", tt.words, got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSplitScriptSentences(t *testing.T) {
+	tests := []struct {
+		script string
+		want   []string
+	}{
+		{"Hello there. How are you? Fine!", []string{"Hello there.", "How are you?", "Fine!"}},
+		{"One line\nSecond line", []string{"One line", "Second line"}},
+		{"Wait... what", []string{"Wait...", "what"}},
+		{"He said \"stop.\" Then left", []string{"He said \"stop.\"", "Then left"}},
+		{"Version 2.0 is out", []string{"Version 2.0 is out"}},
+		{"A,  b\n\n  c.  ", []string{"A, b", "c."}},
+		{"", nil},
+	}
+
+	for _, tt := range tests {
+		if got := splitScriptSentences(tt.script); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitScriptSentences(%q) = %q, want %q", tt.script, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	models "go-authentication-boilerplate/models"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob not found")
+	// the signed URL is expired, or wasn't signed by us
+	ErrBlobURLExpired = errors.New("blob URL is invalid or expired")
+)
+
+// BlobStore keeps the artifacts of the pipeline (audio, subtitles, images,
+// clips, final videos). Keys are slash separated, e.g. videos/<id>/final/video.mp4
+type BlobStore interface {
+	Name() string
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns ErrBlobNotFound when there is no blob with the key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL is where clients can fetch the blob from until the URL
+	// expires. The blobs are private, there is no URL that doesn't expire
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+var blobStore BlobStore
+
+// InitBlobStore sets up the store selected with BLOB_STORE: local (the
+// default), gcs or s3 (which works with MinIO and other S3-compatible stores)
+func InitBlobStore() {
+	backend := os.Getenv("BLOB_STORE")
+
+	var err error
+	switch backend {
+	case "", "local":
+		blobStore, err = newLocalBlobStore()
+	case "gcs":
+		blobStore, err = newGCSBlobStore()
+	case "s3":
+		blobStore, err = newS3BlobStore()
+	default:
+		err = fmt.Errorf("unknown blob store %s", backend)
+	}
+
+	if err != nil {
+		log.Fatalf("[ERROR] Error setting up the blob store: %v", err)
+	}
+
+	log.Printf("[INFO] Storing artifacts in the %s blob store", blobStore.Name())
+}
+
+func GetBlobStore() BlobStore {
+	return blobStore
+}
+
+// validBlobKey rejects keys that could escape the store, like ../x
+func validBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+func blobContentType(key string) string {
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// deleteBlobPrefix deletes every blob whose key starts with the prefix
+func deleteBlobPrefix(ctx context.Context, store BlobStore, prefix string) error {
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getVideoWorkDir is the local scratch space the pipeline renders in. Only
+// the blob store is authoritative, a server can start with an empty work dir
+func getVideoWorkDir() string {
+	if dir := os.Getenv("VIDEO_WORK_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "reels")
+}
+
+// videoArtifactKey maps a file in the work dir to its blob key
+func videoArtifactKey(filePath string) string {
+	rel, err := filepath.Rel(getVideoWorkDir(), filePath)
+	if err != nil {
+		return filepath.ToSlash(filePath)
+	}
+	return "videos/" + filepath.ToSlash(rel)
+}
+
+// videoArtifactPath maps a blob key to where the file lives in the work dir
+func videoArtifactPath(key string) string {
+	return filepath.Join(getVideoWorkDir(), filepath.FromSlash(strings.TrimPrefix(key, "videos/")))
+}
+
+// storeVideoArtifact uploads a file of the work dir and returns its key
+func storeVideoArtifact(ctx context.Context, filePath string) (string, error) {
+	key := videoArtifactKey(filePath)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", filePath, err)
+	}
+
+	if err := blobStore.Put(ctx, key, file, info.Size(), blobContentType(key)); err != nil {
+		return "", fmt.Errorf("error storing %s: %v", key, err)
+	}
+	return key, nil
+}
+
+// fetchVideoArtifact makes sure the blob is in the work dir and returns its
+// path there
+func fetchVideoArtifact(ctx context.Context, key string) (string, error) {
+	filePath := videoArtifactPath(key)
+	if fileExists(filePath) {
+		return filePath, nil
+	}
+
+	reader, err := blobStore.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %v", key, err)
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return "", fmt.Errorf("error creating folder: %v", err)
+	}
+
+	// written next to the target first so a half downloaded file is never used
+	tmpPath := filePath + ".part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("error creating %s: %v", tmpPath, err)
+	}
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return "", fmt.Errorf("error downloading %s: %v", key, err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return filePath, os.Rename(tmpPath, filePath)
+}
+
+// restoreVideoFolder downloads the stored artifacts of a video that are
+// missing from the work dir, e.g. when it resumes on another server. The
+// final videos (of the video and of its variants) aren't needed to resume
+// and are left in the store
+func restoreVideoFolder(ctx context.Context, videoID string) error {
+	prefix := videoArtifactKey(getVideoFolderPath(videoID)) + "/"
+
+	keys, err := blobStore.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("error listing artifacts: %v", err)
+	}
+
+	for _, key := range keys {
+		if strings.Contains(key, "/final/") {
+			continue
+		}
+
+		if _, err := fetchVideoArtifact(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobURLExpiry is how long the signed URLs handed to clients work,
+// BLOB_URL_EXPIRY (e.g. 30m) or 15 minutes
+func blobURLExpiry() time.Duration {
+	if expiry, err := time.ParseDuration(os.Getenv("BLOB_URL_EXPIRY")); err == nil && expiry > 0 {
+		return expiry
+	}
+	return 15 * time.Minute
+}
+
+// ResolveBlobURL turns a stored key into a signed URL clients can fetch.
+// Values that aren't keys (empty, or URLs of older videos) are returned as is
+func ResolveBlobURL(key string) string {
+	if key == "" || validBlobKey(key) != nil {
+		return key
+	}
+
+	signedURL, err := blobStore.SignedURL(key, blobURLExpiry())
+	if err != nil {
+		log.Printf("[ERROR] Error signing URL for %s: %v", key, err)
+		return ""
+	}
+	return signedURL
+}
+
+// BlobURLExpiresAt is when the URLs resolved now stop working
+func BlobURLExpiresAt() time.Time {
+	return time.Now().Add(blobURLExpiry())
+}
+
+// ResolveVideoURLs replaces the keys stored on a video with URLs, for
+// responses. The video shouldn't be saved afterwards
+func ResolveVideoURLs(video *models.Video) {
+	video.TTSURL = ResolveBlobURL(video.TTSURL)
+	video.SRTURL = ResolveBlobURL(video.SRTURL)
+	video.MasteredAudioURL = ResolveBlobURL(video.MasteredAudioURL)
+	video.VideoURL = ResolveBlobURL(video.VideoURL)
+	video.StitchedVideoURL = ResolveBlobURL(video.StitchedVideoURL)
+}
+
+func ResolveVariantURLs(variants []models.VideoVariant) {
+	for i := range variants {
+		variants[i].TTSURL = ResolveBlobURL(variants[i].TTSURL)
+		variants[i].SRTURL = ResolveBlobURL(variants[i].SRTURL)
+		variants[i].VideoURL = ResolveBlobURL(variants[i].VideoURL)
+	}
+}
+
+// ResolveMusicTrackURLs signs the preview URLs of the uploaded tracks, the
+// bundled ones are served by the frontend
+func ResolveMusicTrackURLs(tracks []models.MusicTrack) {
+	for i := range tracks {
+		if strings.HasPrefix(tracks[i].StoragePath, musicBlobPrefix) {
+			tracks[i].PreviewURL = ResolveBlobURL(tracks[i].StoragePath)
+		}
+	}
+}
+
+func ResolveSceneURLs(scenes []models.Scene) {
+	for i := range scenes {
+		scenes[i].AssetPath = ResolveBlobURL(scenes[i].AssetPath)
+	}
+}
+
+func ResolveSceneVersionURLs(versions []models.SceneVersion) {
+	for i := range versions {
+		versions[i].AssetPath = ResolveBlobURL(versions[i].AssetPath)
+	}
+}
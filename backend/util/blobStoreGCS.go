@@ -0,0 +1,157 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsBlobStore keeps the blobs in the GCS_BUCKET bucket
+type gcsBlobStore struct {
+	client *storage.Client
+	bucket string
+}
+
+func newGCSBlobStore() (*gcsBlobStore, error) {
+	bucket := os.Getenv("GCS_BUCKET")
+	if bucket == "" {
+		return nil, fmt.Errorf("GCS_BUCKET is not set")
+	}
+
+	client, err := GetGCPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// GCS_LEGACY_BUCKETS are the buckets older versions uploaded public
+	// objects to
+	buckets := []string{bucket}
+	for _, legacy := range strings.Split(os.Getenv("GCS_LEGACY_BUCKETS"), ",") {
+		if legacy = strings.TrimSpace(legacy); legacy != "" && legacy != bucket {
+			buckets = append(buckets, legacy)
+		}
+	}
+
+	for _, name := range buckets {
+		if err := enforcePrivateBucket(ctx, client, name); err != nil {
+			return nil, err
+		}
+	}
+
+	return &gcsBlobStore{client: client, bucket: bucket}, nil
+}
+
+// enforcePrivateBucket turns on uniform bucket-level access, which ignores
+// the public ACLs older versions set on the objects, and public access
+// prevention so nothing in the bucket can be made public again
+func enforcePrivateBucket(ctx context.Context, client *storage.Client, name string) error {
+	bucket := client.Bucket(name)
+
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("error getting attributes of bucket %s: %v", name, err)
+	}
+
+	if attrs.UniformBucketLevelAccess.Enabled && attrs.PublicAccessPrevention == storage.PublicAccessPreventionEnforced {
+		return nil
+	}
+
+	_, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{
+		UniformBucketLevelAccess: &storage.UniformBucketLevelAccess{Enabled: true},
+		PublicAccessPrevention:   storage.PublicAccessPreventionEnforced,
+	})
+	if err != nil {
+		return fmt.Errorf("error making bucket %s private, the service account needs storage.buckets.update: %v", name, err)
+	}
+
+	log.Printf("[INFO] Enforced uniform access and public access prevention on bucket %s", name)
+	return nil
+}
+
+func (s *gcsBlobStore) Name() string {
+	return "gcs"
+}
+
+func (s *gcsBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validBlobKey(key); err != nil {
+		return err
+	}
+
+	obj := s.client.Bucket(s.bucket).Object(key)
+
+	writer := obj.NewWriter(ctx)
+	writer.ContentType = contentType
+	if _, err := io.Copy(writer, r); err != nil {
+		writer.Close()
+		return fmt.Errorf("error writing %s to bucket: %v", key, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("error closing writer: %v", err)
+	}
+
+	return nil
+}
+
+func (s *gcsBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	reader, err := s.client.Bucket(s.bucket).Object(key).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return reader, err
+}
+
+func (s *gcsBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.Bucket(s.bucket).Object(key).Attrs(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *gcsBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	objects := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error listing bucket: %v", err)
+		}
+		keys = append(keys, attrs.Name)
+	}
+
+	return keys, nil
+}
+
+func (s *gcsBlobStore) Delete(ctx context.Context, key string) error {
+	err := s.client.Bucket(s.bucket).Object(key).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// SignedURL signs with the key of the service account in the credentials,
+// or through the IAM signBlob API when running with default credentials
+func (s *gcsBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return s.client.Bucket(s.bucket).SignedURL(key, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  "GET",
+		Expires: time.Now().Add(expiry),
+	})
+}
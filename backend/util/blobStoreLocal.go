@@ -0,0 +1,212 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// localBlobStore keeps the blobs on the filesystem of the server, under
+// BLOB_LOCAL_DIR. Meant for development and single server deployments. The
+// blobs are served by the files route, to holders of a token it signed
+type localBlobStore struct {
+	root string
+	// prefix of the URLs the blobs are served from
+	baseURL string
+	secret  []byte
+}
+
+func newLocalBlobStore() (*localBlobStore, error) {
+	root := os.Getenv("BLOB_LOCAL_DIR")
+	if root == "" {
+		root = filepath.Join("data", "blobs")
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("error creating %s: %v", root, err)
+	}
+
+	// not shared with the JWT key, a leaked URL signing key must not let
+	// anyone sign sessions
+	secret := os.Getenv("BLOB_URL_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("BLOB_URL_SECRET is not set")
+	}
+
+	return &localBlobStore{
+		root:    root,
+		baseURL: strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/") + "/api/files/",
+		secret:  []byte(secret),
+	}, nil
+}
+
+func (s *localBlobStore) Name() string {
+	return "local"
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	blobPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := blobPath + ".part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, blobPath)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	blobPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *localBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	blobPath, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	return fileExists(blobPath), nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+
+	// only the folder the prefix points into has to be walked
+	start := s.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		start = filepath.Join(s.root, filepath.FromSlash(prefix[:i]))
+	}
+
+	if !fileExists(start) {
+		return keys, nil
+	}
+
+	err := filepath.Walk(start, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(filePath, ".part") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	blobPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(blobPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrBlobNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) token(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *localBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+
+	expires := time.Now().Add(expiry).Unix()
+	return fmt.Sprintf("%s%s?expires=%d&token=%s", s.baseURL, key, expires, s.token(key, expires)), nil
+}
+
+// OpenLocalBlob opens a blob of the local store so the server can send it,
+// if the token and expiry of its signed URL check out. It fails when another
+// store is configured
+func OpenLocalBlob(key string, expires string, token string) (*os.File, error) {
+	store, ok := blobStore.(*localBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("the %s blob store doesn't serve files", blobStore.Name())
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, ErrBlobURLExpired
+	}
+
+	if !hmac.Equal([]byte(token), []byte(store.token(key, expiresAt))) {
+		return nil, ErrBlobURLExpired
+	}
+
+	blobPath, err := store.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(blobPath)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
@@ -0,0 +1,327 @@
+package util
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3BlobStore keeps the blobs in an S3 bucket, or in any store speaking the
+// S3 API like MinIO. Requests are signed with AWS Signature Version 4 and
+// use path-style URLs (endpoint/bucket/key), which every such store accepts
+type s3BlobStore struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// the endpoint clients reach the store on, when it isn't the one the
+	// server uses (e.g. MinIO on an internal hostname). URLs are signed for it
+	publicEndpoint string
+}
+
+func newS3BlobStore() (*s3BlobStore, error) {
+	store := &s3BlobStore{
+		endpoint:  strings.TrimRight(os.Getenv("S3_ENDPOINT"), "/"),
+		region:    os.Getenv("S3_REGION"),
+		bucket:    os.Getenv("S3_BUCKET"),
+		accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		publicEndpoint: strings.TrimRight(os.Getenv("S3_PUBLIC_ENDPOINT"), "/"),
+	}
+
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+
+	if store.endpoint == "" {
+		store.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", store.region)
+	}
+
+	if store.publicEndpoint == "" {
+		store.publicEndpoint = store.endpoint
+	}
+
+	if store.bucket == "" || store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required")
+	}
+
+	return store, nil
+}
+
+func (s *s3BlobStore) Name() string {
+	return "s3"
+}
+
+// s3URIEncode escapes like the canonical request of SigV4 expects: every
+// byte but the unreserved characters, and / only when it isn't a separator
+func s3URIEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3URIEncode(name, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// signature signs the canonical request and returns the credential scope
+// along with the signature
+func (s *s3BlobStore) signature(now time.Time, canonicalRequest string) (string, string) {
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.region)
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func (s *s3BlobStore) objectPath(key string) string {
+	if key == "" {
+		return "/" + s.bucket
+	}
+	return "/" + s.bucket + "/" + s3URIEncode(key, false)
+}
+
+// request sends a signed request. The payload isn't hashed (UNSIGNED-PAYLOAD)
+// so uploads can be streamed
+func (s *s3BlobStore) request(ctx context.Context, method string, key string, query url.Values, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	objectPath := s.objectPath(key)
+	canonicalQuery := s3CanonicalQuery(query)
+
+	endpoint := s.endpoint + objectPath
+	if canonicalQuery != "" {
+		endpoint += "?" + canonicalQuery
+	}
+
+	// without this an empty upload would be sent chunked, which S3 rejects
+	if body != nil && size == 0 {
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:%s\n", req.URL.Host, now.Format("20060102T150405Z"))
+
+	canonicalRequest := strings.Join([]string{method, objectPath, canonicalQuery, canonicalHeaders, signedHeaders, "UNSIGNED-PAYLOAD"}, "\n")
+	scope, signature := s.signature(now, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+
+	return http.DefaultClient.Do(req)
+}
+
+func s3Error(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrBlobNotFound
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return fmt.Errorf("S3 request for %s failed with status code %d: %s", key, resp.StatusCode, string(body))
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	if err := validBlobKey(key); err != nil {
+		return err
+	}
+
+	resp, err := s.request(ctx, "PUT", key, nil, r, size, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.request(ctx, "GET", key, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp, key)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	resp, err := s.request(ctx, "HEAD", key, nil, nil, 0, "")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("S3 request for %s failed with status code %d", key, resp.StatusCode)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.request(ctx, "GET", "", query, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp, prefix)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding list result: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := s.request(ctx, "DELETE", key, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 answers 204 whether or not the object existed
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp, key)
+	}
+	return nil
+}
+
+// presign returns the query of a presigned GET of the object path on host,
+// signature included
+func (s *s3BlobStore) presign(host string, objectPath string, now time.Time, expiry time.Duration) string {
+	date := now.Format("20060102")
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {fmt.Sprintf("%s/%s/%s/s3/aws4_request", s.accessKey, date, s.region)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := strings.Join([]string{"GET", objectPath, canonicalQuery, "host:" + host + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	_, signature := s.signature(now, canonicalRequest)
+
+	return canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func (s *s3BlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+
+	// presigned URLs can't live longer than a week
+	if expiry > 7*24*time.Hour {
+		expiry = 7 * 24 * time.Hour
+	}
+
+	endpoint, err := url.Parse(s.publicEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+
+	objectPath := s.objectPath(key)
+	return s.publicEndpoint + objectPath + "?" + s.presign(endpoint.Host, objectPath, time.Now().UTC(), expiry), nil
+}
@@ -0,0 +1,329 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	models "go-authentication-boilerplate/models"
+)
+
+const (
+	CaptionStyleClassic     = "classic"
+	CaptionStylePopIn       = "pop-in"
+	CaptionStyleHighlight   = "highlight"
+	CaptionStyleBoldOutline = "bold-outline"
+
+	CaptionPositionBottom = "bottom"
+	CaptionPositionCenter = "center"
+
+	captionRendererDrawtext = "drawtext"
+	captionRendererASS      = "ass"
+)
+
+// captionPreset is how a caption style looks. drawtext presets are burned in
+// natively, ass presets are animated with libass
+type captionPreset struct {
+	Renderer string
+	Font     string // file in public, for drawtext
+	FontName string // family name, for libass
+	FontSize int
+	Outline  int
+	// words on screen at once, 0 for the whole sentence
+	MaxWords     int
+	MaxLineChars int
+	Uppercase    bool
+}
+
+var captionPresets = map[string]captionPreset{
+	CaptionStyleClassic: {
+		Renderer: captionRendererDrawtext, Font: captionFont, FontName: "Roboto",
+		FontSize: captionFontSize, Outline: 5, MaxLineChars: captionMaxLineChars,
+	},
+	CaptionStyleBoldOutline: {
+		Renderer: captionRendererDrawtext, Font: "Roboto-Black.ttf", FontName: "Roboto Black",
+		FontSize: 88, Outline: 10, MaxWords: 3, MaxLineChars: 16, Uppercase: true,
+	},
+	CaptionStylePopIn: {
+		Renderer: captionRendererASS, Font: captionFont, FontName: "Roboto",
+		FontSize: 80, Outline: 6, MaxWords: 4, MaxLineChars: 20,
+	},
+	CaptionStyleHighlight: {
+		Renderer: captionRendererASS, Font: captionFont, FontName: "Roboto",
+		FontSize: 72, Outline: 6, MaxWords: 6, MaxLineChars: 22,
+	},
+}
+
+// colour of the word being spoken in the highlight style, ASS colours are BGR
+const captionHighlightColour = "&H0000E5FF&"
+
+// a pause this long between two words (in seconds) ends a group of words
+const captionGroupGap = 0.6
+
+func IsValidCaptionStyle(style string) bool {
+	_, ok := captionPresets[style]
+	return ok
+}
+
+func IsValidCaptionPosition(position string) bool {
+	return position == CaptionPositionBottom || position == CaptionPositionCenter
+}
+
+func getCaptionPreset(style string) captionPreset {
+	if preset, ok := captionPresets[style]; ok {
+		return preset
+	}
+	return captionPresets[CaptionStyleClassic]
+}
+
+// sceneWords returns when each word of a sentence is spoken. Without word
+// timestamps from the ASR service they are estimated like the offline
+// aligner does
+func sceneWords(sentence ASRSentences) models.SceneWords {
+	if len(sentence.Words) > 0 {
+		var words models.SceneWords
+		for _, word := range sentence.Words {
+			if text := strings.TrimSpace(word.Text); text != "" {
+				words = append(words, models.SceneWord{Text: text, Start: asrSeconds(word.Start), End: asrSeconds(word.End)})
+			}
+		}
+		return words
+	}
+
+	fields := strings.Fields(sentence.Text)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	var words models.SceneWords
+	for i, timing := range estimateWordTimings(fields, asrSeconds(sentence.Start), asrSeconds(sentence.End)) {
+		words = append(words, models.SceneWord{Text: fields[i], Start: timing[0], End: timing[1]})
+	}
+	return words
+}
+
+// captionWords returns the words of every sentence, from the scenes when
+// they have them
+func captionWords(videoID string, sentences []ASRSentences) []models.SceneWords {
+	scenes, err := GetScenesByVideo(videoID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting scenes of video %s, estimating the word timings: %v", videoID, err)
+	}
+
+	byIndex := map[int]models.SceneWords{}
+	for _, scene := range scenes {
+		byIndex[scene.SceneIndex] = scene.Words
+	}
+
+	words := make([]models.SceneWords, len(sentences))
+	for i, sentence := range sentences {
+		if stored := byIndex[i]; len(stored) > 0 {
+			words[i] = stored
+		} else {
+			words[i] = sceneWords(sentence)
+		}
+	}
+	return words
+}
+
+// groupCaptionWords splits the words of a sentence into the groups shown at
+// once. A group ends early where the narration pauses: after punctuation or
+// before a gap of captionGroupGap
+func groupCaptionWords(words models.SceneWords, maxWords int) []models.SceneWords {
+	var groups []models.SceneWords
+	var group models.SceneWords
+
+	for i, word := range words {
+		group = append(group, word)
+		pause := i < len(words)-1 && words[i+1].Start-word.End >= captionGroupGap
+		if len(group) == maxWords || pause || strings.ContainsAny(word.Text[len(word.Text)-1:], ",;:.!?") {
+			groups = append(groups, group)
+			group = nil
+		}
+	}
+
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// groupWindow is when a group of words is on screen: until the next group of
+// the sentence starts, or until its last word was said
+func groupWindow(groups []models.SceneWords, i int) (float64, float64) {
+	start := groups[i][0].Start
+	end := groups[i][len(groups[i])-1].End
+	if i < len(groups)-1 {
+		end = groups[i+1][0].Start
+	}
+	return start, end
+}
+
+// buildWordCaptions builds drawtext captions showing a few words at a time
+func buildWordCaptions(words []models.SceneWords, preset captionPreset) []caption {
+	var captions []caption
+	for _, sentenceWords := range words {
+		groups := groupCaptionWords(sentenceWords, preset.MaxWords)
+		for i, group := range groups {
+			start, end := groupWindow(groups, i)
+			captions = append(captions, caption{
+				Text:  wrapCaption(captionText(group, preset), preset.MaxLineChars),
+				Start: start,
+				End:   end,
+			})
+		}
+	}
+	return captions
+}
+
+func captionText(words models.SceneWords, preset captionPreset) string {
+	texts := make([]string, len(words))
+	for i, word := range words {
+		texts[i] = word.Text
+		if preset.Uppercase {
+			texts[i] = strings.ToUpper(texts[i])
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// captionLineBreaks tells before which words wrapCaption starts a new line
+func captionLineBreaks(texts []string, maxChars int) []bool {
+	breaks := make([]bool, len(texts))
+	lineLength := 0
+	for i, text := range texts {
+		length := utf8.RuneCountInString(text)
+		if lineLength > 0 && lineLength+1+length > maxChars {
+			breaks[i] = true
+			lineLength = length
+			continue
+		}
+		if lineLength > 0 {
+			lineLength++
+		}
+		lineLength += length
+	}
+	return breaks
+}
+
+// animatedCaptionLine renders a group with the word at current being spoken.
+// pop-in shows the words said so far, the next ones take up their space but
+// are transparent so the line doesn't move. highlight colours the current word
+func animatedCaptionLine(group models.SceneWords, current int, style string, preset captionPreset) string {
+	texts := make([]string, len(group))
+	for i, word := range group {
+		texts[i] = assEscaper.Replace(word.Text)
+		if preset.Uppercase {
+			texts[i] = strings.ToUpper(texts[i])
+		}
+	}
+
+	breaks := captionLineBreaks(texts, preset.MaxLineChars)
+
+	var b strings.Builder
+	for i, text := range texts {
+		if i > 0 {
+			if breaks[i] {
+				b.WriteString("\\N")
+			} else {
+				b.WriteString(" ")
+			}
+		}
+
+		switch {
+		case style == CaptionStylePopIn && i == current:
+			fmt.Fprintf(&b, "{\\fscx125\\fscy125\\t(0,120,\\fscx100\\fscy100)}%s{\\r}", text)
+		case style == CaptionStylePopIn && i > current:
+			fmt.Fprintf(&b, "{\\alpha&HFF&}%s{\\r}", text)
+		case style == CaptionStyleHighlight && i == current:
+			fmt.Fprintf(&b, "{\\1c%s}%s{\\r}", captionHighlightColour, text)
+		default:
+			b.WriteString(text)
+		}
+	}
+	return b.String()
+}
+
+// buildAnimatedCaptions renders the captions of the word styles as an ASS
+// script, one event per spoken word
+func buildAnimatedCaptions(words []models.SceneWords, style string, position string) []byte {
+	preset := getCaptionPreset(style)
+
+	// alignment 2 is bottom center, 5 is the middle of the frame. The bottom
+	// margin keeps the captions clear of the UI of the platforms
+	alignment, marginV := 2, outputHeight*25/100
+	if position == CaptionPositionCenter {
+		alignment, marginV = 5, 0
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Script Info]\nScriptType: v4.00+\nPlayResX: %d\nPlayResY: %d\nWrapStyle: 2\nScaledBorderAndShadow: yes\n\n", outputWidth, outputHeight)
+
+	b.WriteString("[V4+ Styles]\n")
+	b.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	fmt.Fprintf(&b, "Style: Default,%s,%d,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,-1,0,0,0,100,100,0,0,1,%d,2,%d,60,60,%d,1\n\n",
+		preset.FontName, preset.FontSize, preset.Outline, alignment, marginV)
+
+	b.WriteString("[Events]\n")
+	b.WriteString("Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+
+	for _, sentenceWords := range words {
+		groups := groupCaptionWords(sentenceWords, preset.MaxWords)
+		for i, group := range groups {
+			groupStart, groupEnd := groupWindow(groups, i)
+
+			for j := range group {
+				start, end := group[j].Start, groupEnd
+				if j == 0 {
+					start = groupStart
+				}
+				if j < len(group)-1 {
+					end = group[j+1].Start
+				}
+				if end <= start {
+					continue
+				}
+
+				fmt.Fprintf(&b, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n",
+					formatASSTime(start), formatASSTime(end), animatedCaptionLine(group, j, style, preset))
+			}
+		}
+	}
+
+	return b.Bytes()
+}
+
+// buildVideoCaptionFilters returns the filters burning the captions of the
+// style of the video in. words are the words of every sentence
+func buildVideoCaptionFilters(video models.Video, folderPath string, sentences []ASRSentences, words []models.SceneWords) ([]string, error) {
+	style := video.CaptionStyle
+	if !IsValidCaptionStyle(style) {
+		style = CaptionStyleClassic
+	}
+	preset := getCaptionPreset(style)
+
+	if preset.Renderer == captionRendererASS {
+		captionsPath := filepath.Join(folderPath, "captions.ass")
+		content := buildAnimatedCaptions(words, style, video.CaptionPosition)
+		if err := ioutil.WriteFile(captionsPath, content, 0644); err != nil {
+			return nil, fmt.Errorf("error writing captions: %v", err)
+		}
+
+		fontsDir, err := filepath.Abs(getPublicAssetPath(""))
+		if err != nil {
+			return nil, fmt.Errorf("error resolving fonts folder: %v", err)
+		}
+
+		return []string{fmt.Sprintf("subtitles=filename=%s:fontsdir=%s", escapeFilterValue(captionsPath), escapeFilterValue(fontsDir))}, nil
+	}
+
+	captions := buildCaptions(sentences)
+	if preset.MaxWords > 0 {
+		captions = buildWordCaptions(words, preset)
+	}
+	return buildCaptionFilters(folderPath, captions, preset, video.CaptionPosition)
+}
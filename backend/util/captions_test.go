@@ -0,0 +1,298 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	models "go-authentication-boilerplate/models"
+)
+
+func testWords(words ...interface{}) models.SceneWords {
+	var result models.SceneWords
+	for i := 0; i < len(words); i += 3 {
+		result = append(result, models.SceneWord{Text: words[i].(string), Start: words[i+1].(float64), End: words[i+2].(float64)})
+	}
+	return result
+}
+
+func wordTexts(groups []models.SceneWords) [][]string {
+	var texts [][]string
+	for _, group := range groups {
+		var text []string
+		for _, word := range group {
+			text = append(text, word.Text)
+		}
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func TestGroupCaptionWords(t *testing.T) {
+	tests := []struct {
+		name     string
+		words    models.SceneWords
+		maxWords int
+		want     [][]string
+	}{
+		{
+			"by word count",
+			testWords("a", 0.0, 0.2, "b", 0.2, 0.4, "c", 0.4, 0.6, "d", 0.6, 0.8, "e", 0.8, 1.0),
+			2,
+			[][]string{{"a", "b"}, {"c", "d"}, {"e"}},
+		},
+		{
+			"after punctuation",
+			testWords("Hi,", 0.0, 0.3, "you", 0.3, 0.5, "there.", 0.5, 0.9, "Go", 0.9, 1.1),
+			4,
+			[][]string{{"Hi,"}, {"you", "there."}, {"Go"}},
+		},
+		{
+			"before a gap",
+			testWords("a", 0.0, 0.3, "b", 0.3, 0.5, "c", 1.2, 1.5, "d", 1.5, 1.7),
+			4,
+			[][]string{{"a", "b"}, {"c", "d"}},
+		},
+		{
+			"short gap",
+			testWords("a", 0.0, 0.3, "b", 0.3, 0.5, "c", 1.0, 1.5, "d", 1.5, 1.7),
+			4,
+			[][]string{{"a", "b", "c", "d"}},
+		},
+		{
+			"whole sentence",
+			testWords("a", 0.0, 0.2, "b", 0.2, 0.4, "c", 0.4, 0.6, "d", 0.6, 0.8, "e", 0.8, 1.0),
+			0,
+			[][]string{{"a", "b", "c", "d", "e"}},
+		},
+		{"no words", nil, 3, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := wordTexts(groupCaptionWords(tt.words, tt.maxWords)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("groupCaptionWords() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptionLineBreaks(t *testing.T) {
+	tests := []struct {
+		texts    []string
+		maxChars int
+		want     []bool
+	}{
+		{[]string{"aaaa", "bbbb", "cccc"}, 9, []bool{false, false, true}},
+		{[]string{"aaaa", "bbbb", "cccc"}, 14, []bool{false, false, false}},
+		{[]string{"toolongword", "a", "b"}, 5, []bool{false, true, false}},
+		{nil, 10, []bool{}},
+	}
+
+	for _, tt := range tests {
+		got := captionLineBreaks(tt.texts, tt.maxChars)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("captionLineBreaks(%q, %d) = %v, want %v", tt.texts, tt.maxChars, got, tt.want)
+		}
+
+		// the breaks are where wrapCaption breaks the line
+		wrapped := strings.Join(tt.texts, " ")
+		var rebuilt strings.Builder
+		for i, text := range tt.texts {
+			if i > 0 && got[i] {
+				rebuilt.WriteString("\n")
+			} else if i > 0 {
+				rebuilt.WriteString(" ")
+			}
+			rebuilt.WriteString(text)
+		}
+		if want := wrapCaption(wrapped, tt.maxChars); rebuilt.String() != want {
+			t.Errorf("captionLineBreaks(%q, %d) breaks as %q, wrapCaption as %q", tt.texts, tt.maxChars, rebuilt.String(), want)
+		}
+	}
+}
+
+func TestAnimatedCaptionLine(t *testing.T) {
+	popIn := captionPresets[CaptionStylePopIn]
+	highlight := captionPresets[CaptionStyleHighlight]
+	words := testWords("one", 0.0, 0.3, "two", 0.3, 0.6, "three", 0.6, 1.0)
+
+	tests := []struct {
+		name    string
+		group   models.SceneWords
+		current int
+		style   string
+		preset  captionPreset
+		want    string
+	}{
+		{
+			"pop-in first word", words, 0, CaptionStylePopIn, popIn,
+			`{\fscx125\fscy125\t(0,120,\fscx100\fscy100)}one{\r} {\alpha&HFF&}two{\r} {\alpha&HFF&}three{\r}`,
+		},
+		{
+			"pop-in last word", words, 2, CaptionStylePopIn, popIn,
+			`one two {\fscx125\fscy125\t(0,120,\fscx100\fscy100)}three{\r}`,
+		},
+		{
+			"highlight", words, 1, CaptionStyleHighlight, highlight,
+			`one {\1c&H0000E5FF&}two{\r} three`,
+		},
+		{
+			"override tags are escaped", testWords(`{\b1}`, 0.0, 0.3, `a\Nb`, 0.3, 0.6), 0, CaptionStyleHighlight, highlight,
+			`{\1c&H0000E5FF&}(/b1){\r} a/Nb`,
+		},
+		{
+			"line break", testWords("aaaa", 0.0, 0.3, "bbbb", 0.3, 0.6, "cccc", 0.6, 1.0), 2, CaptionStyleHighlight,
+			captionPreset{MaxLineChars: 9},
+			`aaaa bbbb\N{\1c&H0000E5FF&}cccc{\r}`,
+		},
+		{
+			"uppercase", testWords("hi", 0.0, 0.3, "you", 0.3, 0.6), 0, CaptionStyleHighlight,
+			captionPreset{MaxLineChars: 20, Uppercase: true},
+			`{\1c&H0000E5FF&}HI{\r} YOU`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := animatedCaptionLine(tt.group, tt.current, tt.style, tt.preset); got != tt.want {
+				t.Errorf("animatedCaptionLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// dialogueTimes returns the start and end of every event of an ASS script
+func dialogueTimes(script string) [][2]string {
+	var times [][2]string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(line, "Dialogue: ") {
+			continue
+		}
+		fields := strings.SplitN(line, ",", 4)
+		times = append(times, [2]string{fields[1], fields[2]})
+	}
+	return times
+}
+
+func TestBuildAnimatedCaptions(t *testing.T) {
+	words := []models.SceneWords{
+		testWords("one", 0.0, 0.3, "two", 0.35, 0.6, "three.", 0.7, 1.0, "four", 1.1, 1.4),
+		testWords("five", 2.0, 2.5),
+		// starts with the next word, it never is the current word
+		testWords("x", 3.0, 3.2, "y", 3.0, 3.4),
+	}
+
+	// every word is current from its start until the next word starts, so
+	// the events of a group add up to the time the group is on screen
+	wantTimes := [][2]string{
+		{"0:00:00.00", "0:00:00.35"},
+		{"0:00:00.35", "0:00:00.70"},
+		{"0:00:00.70", "0:00:01.10"},
+		{"0:00:01.10", "0:00:01.40"},
+		{"0:00:02.00", "0:00:02.50"},
+		{"0:00:03.00", "0:00:03.40"},
+	}
+
+	tests := []struct {
+		style    string
+		position string
+		styleRow string
+	}{
+		{CaptionStylePopIn, CaptionPositionBottom, "Style: Default,Roboto,80,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,-1,0,0,0,100,100,0,0,1,6,2,2,60,60,480,1"},
+		{CaptionStylePopIn, CaptionPositionCenter, "Style: Default,Roboto,80,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,-1,0,0,0,100,100,0,0,1,6,2,5,60,60,0,1"},
+		{CaptionStyleHighlight, CaptionPositionBottom, "Style: Default,Roboto,72,&H00FFFFFF,&H00FFFFFF,&H00000000,&H80000000,-1,0,0,0,100,100,0,0,1,6,2,2,60,60,480,1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style+" "+tt.position, func(t *testing.T) {
+			script := string(buildAnimatedCaptions(words, tt.style, tt.position))
+
+			if !strings.Contains(script, tt.styleRow+"\n") {
+				t.Errorf("buildAnimatedCaptions() has no %q in\n%s", tt.styleRow, script)
+			}
+			if !strings.Contains(script, "PlayResX: 1080\nPlayResY: 1920\n") {
+				t.Errorf("buildAnimatedCaptions() isn't sized for the output:\n%s", script)
+			}
+
+			if got := dialogueTimes(script); !reflect.DeepEqual(got, wantTimes) {
+				t.Errorf("event times = %v, want %v", got, wantTimes)
+			}
+		})
+	}
+}
+
+func TestBuildVideoCaptionFilters(t *testing.T) {
+	t.Setenv("PUBLIC_ASSETS_DIR", t.TempDir())
+
+	sentences := []ASRSentences{
+		{Start: 0, End: 1000, Text: "One two three."},
+		{Start: 1500, End: 3000, Text: "Four five six seven."},
+	}
+	var words []models.SceneWords
+	for _, sentence := range sentences {
+		words = append(words, sceneWords(sentence))
+	}
+
+	tests := []struct {
+		style    string
+		position string
+		// the text files of the drawtext filters, or the number of events
+		// of the ASS script
+		texts    []string
+		events   int
+		contains string
+	}{
+		{style: CaptionStyleClassic, texts: []string{"One two three.", "Four five six seven."}, contains: "fontsize=64:fontcolor=white:borderw=5"},
+		{style: "neon", texts: []string{"One two three.", "Four five six seven."}, contains: "fontsize=64:fontcolor=white:borderw=5"},
+		{style: CaptionStyleClassic, position: CaptionPositionCenter, texts: []string{"One two three.", "Four five six seven."}, contains: "y=(h-text_h)/2"},
+		{style: CaptionStyleBoldOutline, texts: []string{"ONE TWO THREE.", "FOUR FIVE SIX", "SEVEN."}, contains: "Roboto-Black.ttf"},
+		{style: CaptionStylePopIn, events: 7, contains: "subtitles=filename="},
+		{style: CaptionStyleHighlight, events: 7, contains: "subtitles=filename="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.style+" "+tt.position, func(t *testing.T) {
+			folderPath := t.TempDir()
+			video := models.Video{CaptionStyle: tt.style, CaptionPosition: tt.position}
+
+			filters, err := buildVideoCaptionFilters(video, folderPath, sentences, words)
+			if err != nil {
+				t.Fatalf("buildVideoCaptionFilters() error = %v", err)
+			}
+			if len(filters) == 0 || !strings.Contains(filters[0], tt.contains) {
+				t.Errorf("buildVideoCaptionFilters() = %q, want %q in it", filters, tt.contains)
+			}
+
+			if tt.texts == nil {
+				if len(filters) != 1 {
+					t.Fatalf("buildVideoCaptionFilters() = %q, want one subtitles filter", filters)
+				}
+				script, err := os.ReadFile(filepath.Join(folderPath, "captions.ass"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if events := len(dialogueTimes(string(script))); events != tt.events {
+					t.Errorf("captions.ass has %d events, want %d", events, tt.events)
+				}
+				return
+			}
+
+			if len(filters) != len(tt.texts) {
+				t.Fatalf("buildVideoCaptionFilters() = %q, want %d drawtext filters", filters, len(tt.texts))
+			}
+			for i, want := range tt.texts {
+				text, err := os.ReadFile(filepath.Join(folderPath, "captions", fmt.Sprintf("caption_%d.txt", i+1)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(text) != want {
+					t.Errorf("caption %d = %q, want %q", i+1, text, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"* * * * *", true},
+		{"*/15 * * * *", true},
+		{"0 9 * * 1-5", true},
+		{"0,30 8-18/2 1,15 * 0", true},
+		{"5/15 * * * *", true},
+		{"0 0 * * 7", true},
+		{"@hourly", true},
+		{"@daily", true},
+		{" @weekly ", true},
+		{"@monthly", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * 32 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"a * * * *", false},
+		{"1- * * * *", false},
+		{"@yearly", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := ParseCron(tt.expression)
+			if (err == nil) != tt.valid {
+				t.Errorf("ParseCron(%q) error = %v, want valid = %v", tt.expression, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04:05", value)
+		if err != nil {
+			parsed, err = time.Parse("2006-01-02 15:04", value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		after      string
+		want       string
+	}{
+		{"every minute", "* * * * *", "2024-03-10 10:15", "2024-03-10 10:16"},
+		{"seconds are dropped", "* * * * *", "2024-03-10 10:15:42", "2024-03-10 10:16"},
+		{"step", "*/15 * * * *", "2024-03-10 10:15", "2024-03-10 10:30"},
+		{"step wraps the hour", "*/15 * * * *", "2024-03-10 10:50", "2024-03-10 11:00"},
+		{"step from a start", "5/20 * * * *", "2024-03-10 10:26", "2024-03-10 10:45"},
+		{"list", "0,30 * * * *", "2024-03-10 10:10", "2024-03-10 10:30"},
+		{"range of hours", "0 9-17 * * *", "2024-03-10 17:30", "2024-03-11 09:00"},
+		{"range with step", "0 8-18/4 * * *", "2024-03-10 12:00", "2024-03-10 16:00"},
+		{"same time is excluded", "0 9 * * *", "2024-03-10 09:00", "2024-03-11 09:00"},
+		{"weekdays skip the weekend", "0 9 * * 1-5", "2024-03-08 10:00", "2024-03-11 09:00"},
+		{"sunday as 0", "0 0 * * 0", "2024-03-10 00:00", "2024-03-17 00:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-03-11 00:00", "2024-03-17 00:00"},
+		{"day of month", "0 0 15 * *", "2024-03-16 00:00", "2024-04-15 00:00"},
+		{"day of month or weekday", "0 0 13 * 5", "2024-03-01 00:00", "2024-03-08 00:00"},
+		{"day of month before weekday", "0 0 13 * 5", "2024-03-09 00:00", "2024-03-13 00:00"},
+		{"starred day step isn't a restriction", "0 0 */2 * 1", "2024-03-01 00:00", "2024-03-11 00:00"},
+		{"month rollover", "30 23 31 * *", "2024-04-01 00:00", "2024-05-31 23:30"},
+		{"year rollover", "0 0 1 1 *", "2024-06-01 00:00", "2025-01-01 00:00"},
+		{"restricted months", "0 12 1 3,9 *", "2024-03-01 12:00", "2024-09-01 12:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"hourly", "@hourly", "2024-03-10 10:00", "2024-03-10 11:00"},
+		{"monthly", "@monthly", "2024-12-05 00:00", "2025-01-01 00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cron, err := ParseCron(tt.expression)
+			if err != nil {
+				t.Fatalf("ParseCron(%q) error = %v", tt.expression, err)
+			}
+
+			got := cron.Next(at(tt.after))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next(%s) = %s, want never", tt.after, got)
+				}
+				return
+			}
+
+			if want := at(tt.want); !got.Equal(want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.after, got.Format("2006-01-02 15:04 Mon"), want.Format("2006-01-02 15:04 Mon"))
+			}
+		})
+	}
+}
+
+func TestCronNextAcrossDST(t *testing.T) {
+	tests := []struct {
+		name       string
+		location   string
+		expression string
+		after      string // local time
+		want       []string
+	}{
+		// 2:00 doesn't exist on the day clocks go forward
+		{"hours over the gap", "America/New_York", "0 * * * *",
+			"2024-03-10 00:30",
+			[]string{"2024-03-10 01:00 -0500", "2024-03-10 03:00 -0400", "2024-03-10 04:00 -0400"}},
+		{"daily after the gap", "America/New_York", "0 9 * * *",
+			"2024-03-09 12:00",
+			[]string{"2024-03-10 09:00 -0400", "2024-03-11 09:00 -0400"}},
+		// midnight doesn't exist on the day clocks go forward
+		{"midnight gap", "America/Sao_Paulo", "30 * 4 * *",
+			"2018-11-03 12:00",
+			[]string{"2018-11-04 01:30 -0200", "2018-11-04 02:30 -0200"}},
+		{"half hour offset", "Asia/Kolkata", "0 */6 * * *",
+			"2024-03-10 05:30",
+			[]string{"2024-03-10 06:00 +0530", "2024-03-10 12:00 +0530"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location, err := time.LoadLocation(tt.location)
+			if err != nil {
+				t.Skipf("no tz database: %v", err)
+			}
+
+			cron, err := ParseCron(tt.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := time.ParseInLocation("2006-01-02 15:04", tt.after, location)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, want := range tt.want {
+				got := cron.Next(after)
+				if got.Format("2006-01-02 15:04 -0700") != want {
+					t.Fatalf("Next(%s) = %s, want %s", after, got.Format("2006-01-02 15:04 -0700"), want)
+				}
+				after = got
+			}
+		})
+	}
+}
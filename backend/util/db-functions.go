@@ -1,11 +1,14 @@
 package util
 
 import (
+	"errors"
 	db "go-authentication-boilerplate/database"
 	models "go-authentication-boilerplate/models"
 	"log"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func GetUserById(id string) (*models.User, error) {
@@ -96,6 +99,60 @@ func GetVideoById(id string) (*models.Video, error) {
 	return video, nil
 }
 
+// ErrVideoBusy is returned when deleting a video a job works on, or that
+// another server is deleting
+var ErrVideoBusy = errors.New("the video has a job in progress")
+
+// DeleteVideoRows deletes a video along with everything that refers to it.
+// The video row is claimed and checked for active jobs in the same
+// transaction, EnqueueJob waits for it
+func DeleteVideoRows(videoID string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		var videos []models.Video
+		txn := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).Where("id = ?", videoID).Find(&videos)
+		if txn.Error != nil {
+			log.Printf("[ERROR] Error claiming video %s: %v", videoID, txn.Error)
+			return txn.Error
+		}
+		if len(videos) == 0 {
+			return ErrVideoBusy
+		}
+
+		var activeJobs int64
+		txn = tx.Model(&models.Job{}).
+			Where("video_id = ? AND status IN ?", videoID, []string{models.JobStatusQueued, models.JobStatusRunning}).
+			Count(&activeJobs)
+		if txn.Error != nil {
+			log.Printf("[ERROR] Error getting active jobs of video %s: %v", videoID, txn.Error)
+			return txn.Error
+		}
+		if activeJobs > 0 {
+			return ErrVideoBusy
+		}
+
+		for _, model := range []interface{}{
+			&models.Job{},
+			&models.SceneVersion{},
+			&models.Scene{},
+			&models.ScriptVersion{},
+			&models.StockClip{},
+			&models.Publication{},
+			&models.VideoVariant{},
+		} {
+			if err := tx.Where("video_id = ?", videoID).Delete(model).Error; err != nil {
+				log.Printf("[ERROR] Error deleting rows of video %s: %v", videoID, err)
+				return err
+			}
+		}
+
+		if err := tx.Where("id = ?", videoID).Delete(&models.Video{}).Error; err != nil {
+			log.Printf("[ERROR] Error deleting video: %v", err)
+			return err
+		}
+		return nil
+	})
+}
+
 func SetVideo(video *models.Video) (*models.Video, error) {
 	// check if video with ID exists
 	if video.ID == "" {
@@ -181,4 +238,485 @@ func SetUser(user *models.User) (*models.User, error) {
 	}
 
 	return user, nil
-}
\ No newline at end of file
+}
+
+// GetJobsByVideo returns the jobs of a video, newest first
+func GetJobsByVideo(videoID string) ([]models.Job, error) {
+	jobs := []models.Job{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("created_at desc").Find(&jobs)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting jobs: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return jobs, nil
+}
+
+// GetActiveJobByVideo returns a queued or running job of one of the given
+// types, or of any type when none is given
+func GetActiveJobByVideo(videoID string, jobTypes ...string) (*models.Job, error) {
+	jobs := []models.Job{}
+	query := db.DB.Where("video_id = ? AND status IN ?", videoID, []string{models.JobStatusQueued, models.JobStatusRunning})
+	if len(jobTypes) > 0 {
+		query = query.Where("type IN ?", jobTypes)
+	}
+
+	txn := query.Limit(1).Find(&jobs)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting active job: %v", txn.Error)
+		return nil, txn.Error
+	}
+
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+	return &jobs[0], nil
+}
+
+func GetNarrators() ([]models.Narrator, error) {
+	narrators := []models.Narrator{}
+	txn := db.DB.Where("enabled = ?", true).Order("name asc").Find(&narrators)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting narrators: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return narrators, nil
+}
+
+func GetNarratorByName(name string) (*models.Narrator, error) {
+	narrator := new(models.Narrator)
+	txn := db.DB.Where("name = ? AND enabled = ?", name, true).First(&narrator)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting narrator: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return narrator, nil
+}
+
+// GetMusicTracksForUser returns the catalog and the tracks the user uploaded
+func GetMusicTracksForUser(userID string) ([]models.MusicTrack, error) {
+	tracks := []models.MusicTrack{}
+	txn := db.DB.Where("enabled = ? AND (owner_id = '' OR owner_id IS NULL OR owner_id = ?)", true, userID).Order("title asc").Find(&tracks)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting music tracks: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return tracks, nil
+}
+
+func GetMusicTrackByName(name string) (*models.MusicTrack, error) {
+	track := new(models.MusicTrack)
+	txn := db.DB.Where("name = ?", name).First(&track)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting music track: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return track, nil
+}
+
+func GetMusicTrackById(id string) (*models.MusicTrack, error) {
+	track := new(models.MusicTrack)
+	txn := db.DB.Where("id = ?", id).First(&track)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting music track: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return track, nil
+}
+
+// UpdateMusicTrack updates only the given columns of the track
+func UpdateMusicTrack(track *models.MusicTrack, updates map[string]interface{}) (*models.MusicTrack, error) {
+	txn := db.DB.Model(track).Updates(updates)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error updating music track: %v", txn.Error)
+		return track, txn.Error
+	}
+	return track, nil
+}
+
+func GetStockClipsByVideo(videoID string) ([]models.StockClip, error) {
+	clips := []models.StockClip{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("sentence_index asc").Find(&clips)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting stock clips: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return clips, nil
+}
+
+// SetStockClips replaces the stock clips of a video
+func SetStockClips(videoID string, clips []models.StockClip) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("video_id = ?", videoID).Delete(&models.StockClip{}).Error; err != nil {
+			log.Printf("[ERROR] Error deleting stock clips: %v", err)
+			return err
+		}
+
+		for i := range clips {
+			clips[i].VideoID = videoID
+			if err := tx.Create(&clips[i]).Error; err != nil {
+				log.Printf("[ERROR] Error creating stock clip: %v", err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func GetScriptVersionsByVideo(videoID string) ([]models.ScriptVersion, error) {
+	versions := []models.ScriptVersion{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("version desc").Find(&versions)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting script versions: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return versions, nil
+}
+
+// AddScriptVersion records the current topic, script and essence of the video
+// as its next script version and saves the video
+func AddScriptVersion(video *models.Video, source string, provider string, authorID string) (*models.ScriptVersion, error) {
+	version := &models.ScriptVersion{
+		VideoID:  video.ID,
+		Topic:    video.Topic,
+		Script:   video.Script,
+		Essence:  video.Essence,
+		Source:   source,
+		Provider: provider,
+		AuthorID: authorID,
+	}
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var latest int
+		if err := tx.Model(&models.ScriptVersion{}).Where("video_id = ?", video.ID).
+			Select("COALESCE(MAX(version), 0)").Scan(&latest).Error; err != nil {
+			return err
+		}
+
+		version.Version = latest + 1
+		if err := tx.Create(version).Error; err != nil {
+			return err
+		}
+
+		video.ScriptVersion = version.Version
+		video.UpdatedAt = db.DB.NowFunc().String()
+		return tx.Omit("Owner").Save(video).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Error adding script version: %v", err)
+		return nil, err
+	}
+
+	return version, nil
+}
+
+func GetScenesByVideo(videoID string) ([]models.Scene, error) {
+	scenes := []models.Scene{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("scene_index asc").Find(&scenes)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting scenes: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return scenes, nil
+}
+
+func SetScene(scene *models.Scene) (*models.Scene, error) {
+	txn := db.DB.Save(scene)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving scene: %v", txn.Error)
+		return scene, txn.Error
+	}
+	return scene, nil
+}
+
+// SetScenes replaces the storyboard of a video. Scenes are matched by their
+// index so their IDs stay the same across runs
+func SetScenes(videoID string, scenes []models.Scene) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("video_id = ? AND scene_index >= ?", videoID, len(scenes)).Delete(&models.Scene{}).Error; err != nil {
+			log.Printf("[ERROR] Error deleting scenes: %v", err)
+			return err
+		}
+
+		for i := range scenes {
+			scenes[i].VideoID = videoID
+			if err := tx.Save(&scenes[i]).Error; err != nil {
+				log.Printf("[ERROR] Error saving scene: %v", err)
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func DeleteScenesByVideo(videoID string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("video_id = ?", videoID).Delete(&models.SceneVersion{}).Error; err != nil {
+			log.Printf("[ERROR] Error deleting scene versions: %v", err)
+			return err
+		}
+
+		if err := tx.Where("video_id = ?", videoID).Delete(&models.Scene{}).Error; err != nil {
+			log.Printf("[ERROR] Error deleting scenes: %v", err)
+			return err
+		}
+		return nil
+	})
+}
+
+// ErrSceneNotFound and ErrSceneVersionNotFound tell a missing row apart
+// from a failed query
+var (
+	ErrSceneNotFound        = errors.New("scene not found")
+	ErrSceneVersionNotFound = errors.New("scene version not found")
+)
+
+func GetSceneByIndex(videoID string, index int) (*models.Scene, error) {
+	scene := new(models.Scene)
+	txn := db.DB.Where("video_id = ? AND scene_index = ?", videoID, index).First(scene)
+	if errors.Is(txn.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrSceneNotFound
+	}
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting scene: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return scene, nil
+}
+
+func GetSceneVersions(sceneID string) ([]models.SceneVersion, error) {
+	versions := []models.SceneVersion{}
+	txn := db.DB.Where("scene_id = ?", sceneID).Order("version desc").Find(&versions)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting scene versions: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return versions, nil
+}
+
+func GetSceneVersion(sceneID string, version int) (*models.SceneVersion, error) {
+	sceneVersion := new(models.SceneVersion)
+	txn := db.DB.Where("scene_id = ? AND version = ?", sceneID, version).First(sceneVersion)
+	if errors.Is(txn.Error, gorm.ErrRecordNotFound) {
+		return nil, ErrSceneVersionNotFound
+	}
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting scene version: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return sceneVersion, nil
+}
+
+func CreateSceneVersion(sceneVersion *models.SceneVersion) (*models.SceneVersion, error) {
+	txn := db.DB.Create(sceneVersion)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error creating scene version: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return sceneVersion, nil
+}
+
+func GetSchedulesByOwner(ownerID string) ([]models.Schedule, error) {
+	schedules := []models.Schedule{}
+	txn := db.DB.Where("owner_id = ?", ownerID).Order("created_at desc").Find(&schedules)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting schedules: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return schedules, nil
+}
+
+func GetScheduleById(id string) (*models.Schedule, error) {
+	schedule := new(models.Schedule)
+	txn := db.DB.Where("id = ?", id).First(schedule)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting schedule: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return schedule, nil
+}
+
+func SetSchedule(schedule *models.Schedule) (*models.Schedule, error) {
+	txn := db.DB.Omit("Owner").Save(schedule)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving schedule: %v", txn.Error)
+		return schedule, txn.Error
+	}
+	return schedule, nil
+}
+
+func DeleteSchedule(schedule *models.Schedule) error {
+	txn := db.DB.Delete(schedule)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error deleting schedule: %v", txn.Error)
+		return txn.Error
+	}
+	return nil
+}
+
+func GetVideosBySchedule(scheduleID string) ([]models.Video, error) {
+	videos := []models.Video{}
+	txn := db.DB.Where("schedule_id = ?", scheduleID).Order("created_at desc").Find(&videos)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting videos: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return videos, nil
+}
+
+func GetPublicationsByVideo(videoID string) ([]models.Publication, error) {
+	publications := []models.Publication{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("created_at asc").Find(&publications)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting publications: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return publications, nil
+}
+
+func GetPublicationById(id string) (*models.Publication, error) {
+	publication := new(models.Publication)
+	txn := db.DB.Where("id = ?", id).First(publication)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting publication: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return publication, nil
+}
+
+func SetPublication(publication *models.Publication) (*models.Publication, error) {
+	txn := db.DB.Save(publication)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving publication: %v", txn.Error)
+		return publication, txn.Error
+	}
+	return publication, nil
+}
+
+func GetPublishingAccountsByOwner(ownerID string) ([]models.PublishingAccount, error) {
+	accounts := []models.PublishingAccount{}
+	txn := db.DB.Where("owner_id = ?", ownerID).Find(&accounts)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting publishing accounts: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return accounts, nil
+}
+
+func GetPublishingAccount(ownerID string, destination string) (*models.PublishingAccount, error) {
+	account := new(models.PublishingAccount)
+	txn := db.DB.Where("owner_id = ? AND destination = ?", ownerID, destination).First(account)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting publishing account: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return account, nil
+}
+
+// SetPublishingAccount links the account, replacing the one the user had
+// linked on the same destination
+func SetPublishingAccount(account *models.PublishingAccount) (*models.PublishingAccount, error) {
+	existing := new(models.PublishingAccount)
+	txn := db.DB.Where("owner_id = ? AND destination = ?", account.OwnerID, account.Destination).Limit(1).Find(existing)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting publishing account: %v", txn.Error)
+		return nil, txn.Error
+	}
+
+	if txn.RowsAffected > 0 {
+		account.ID = existing.ID
+		account.CreatedAt = existing.CreatedAt
+	}
+
+	txn = db.DB.Save(account)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving publishing account: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return account, nil
+}
+
+// SetTelegramLink starts linking a chat, replacing the link the user was
+// waiting on
+func SetTelegramLink(link *models.TelegramLink) (*models.TelegramLink, error) {
+	txn := db.DB.Where("owner_id = ?", link.OwnerID).Delete(&models.TelegramLink{})
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error deleting telegram link: %v", txn.Error)
+		return nil, txn.Error
+	}
+
+	txn = db.DB.Create(link)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving telegram link: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return link, nil
+}
+
+func GetTelegramLinkByOwner(ownerID string) (*models.TelegramLink, error) {
+	link := new(models.TelegramLink)
+	txn := db.DB.Where("owner_id = ?", ownerID).First(link)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting telegram link: %v", txn.Error)
+		return nil, txn.Error
+	}
+	return link, nil
+}
+
+// ConfirmTelegramLinkCode marks the unexpired link with the code as posted in
+// the chat, returning whether there was one
+func ConfirmTelegramLinkCode(chatID int64, code string) (bool, error) {
+	txn := db.DB.Model(&models.TelegramLink{}).
+		Where("chat_id = ? AND code = ? AND expires_at > ?", chatID, code, time.Now()).
+		Update("confirmed", true)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error confirming telegram link: %v", txn.Error)
+		return false, txn.Error
+	}
+	return txn.RowsAffected > 0, nil
+}
+
+func DeleteTelegramLink(id string) error {
+	txn := db.DB.Where("id = ?", id).Delete(&models.TelegramLink{})
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error deleting telegram link: %v", txn.Error)
+		return txn.Error
+	}
+	return nil
+}
+
+func DeletePublishingAccount(ownerID string, destination string) error {
+	txn := db.DB.Where("owner_id = ? AND destination = ?", ownerID, destination).Delete(&models.PublishingAccount{})
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error deleting publishing account: %v", txn.Error)
+		return txn.Error
+	}
+	return nil
+}
+
+func GetVideoVariants(videoID string) ([]models.VideoVariant, error) {
+	variants := []models.VideoVariant{}
+	txn := db.DB.Where("video_id = ?", videoID).Order("language asc").Find(&variants)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting video variants: %v", txn.Error)
+		return variants, txn.Error
+	}
+	return variants, nil
+}
+
+func SetVideoVariant(variant *models.VideoVariant) (*models.VideoVariant, error) {
+	txn := db.DB.Save(variant)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving video variant: %v", txn.Error)
+		return variant, txn.Error
+	}
+	return variant, nil
+}
+
+func DeleteVideoVariants(videoID string) error {
+	txn := db.DB.Where("video_id = ?", videoID).Delete(&models.VideoVariant{})
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error deleting video variants: %v", txn.Error)
+		return txn.Error
+	}
+	return nil
+}
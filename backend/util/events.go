@@ -0,0 +1,179 @@
+package util
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	VideoEventStage       = "stage"        // a stage started
+	VideoEventProgress    = "progress"     // a stage finished, progress moved
+	VideoEventScene       = "scene"        // the media of a scene is ready
+	VideoEventScriptReady = "script_ready" // a draft waits for its script to be approved
+	VideoEventRetrying    = "retrying"     // a stage failed, the job runs again
+	VideoEventFailed      = "failed"
+	VideoEventCancelled   = "cancelled"
+	VideoEventDone        = "done"
+
+	// the postgres channel the events go through, so the clients connected
+	// to one server get the events of the jobs running on another
+	videoEventsChannel = "video_events"
+	// notifications are limited to 8000 bytes
+	videoEventMaxMessageLength = 1000
+)
+
+// VideoEvent is pushed to the clients watching a video while CreateVideo runs
+type VideoEvent struct {
+	VideoID  string    `json:"videoID"`
+	Type     string    `json:"type"`
+	Stage    string    `json:"stage,omitempty"`
+	Progress int       `json:"progress"`
+	Scene    int       `json:"scene,omitempty"`
+	Scenes   int       `json:"scenes,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	videoSubscribersMu sync.Mutex
+	videoSubscribers   = map[string]map[chan VideoEvent]struct{}{}
+
+	// set while the relay listens to the channel, events are only delivered
+	// to the subscribers of this server otherwise
+	videoEventRelayUp atomic.Bool
+)
+
+// SubscribeVideoEvents returns a channel receiving the events of a video and
+// a function to stop receiving them
+func SubscribeVideoEvents(videoID string) (<-chan VideoEvent, func()) {
+	ch := make(chan VideoEvent, 32)
+
+	videoSubscribersMu.Lock()
+	if videoSubscribers[videoID] == nil {
+		videoSubscribers[videoID] = map[chan VideoEvent]struct{}{}
+	}
+	videoSubscribers[videoID][ch] = struct{}{}
+	videoSubscribersMu.Unlock()
+
+	unsubscribe := func() {
+		videoSubscribersMu.Lock()
+		defer videoSubscribersMu.Unlock()
+
+		if _, ok := videoSubscribers[videoID][ch]; !ok {
+			return
+		}
+
+		delete(videoSubscribers[videoID], ch)
+		if len(videoSubscribers[videoID]) == 0 {
+			delete(videoSubscribers, videoID)
+		}
+		close(ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// PublishVideoEvent sends the event to the subscribers of every server,
+// through postgres when the relay is up
+func PublishVideoEvent(event VideoEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if videoEventRelayUp.Load() {
+		if runes := []rune(event.Message); len(runes) > videoEventMaxMessageLength {
+			event.Message = string(runes[:videoEventMaxMessageLength])
+		}
+
+		payload, err := json.Marshal(event)
+		if err == nil {
+			err = db.DB.Exec("SELECT pg_notify(?, ?)", videoEventsChannel, string(payload)).Error
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("[ERROR] Error relaying %s event of video %s: %v", event.Type, event.VideoID, err)
+	}
+
+	deliverVideoEvent(event)
+}
+
+// deliverVideoEvent never blocks the pipeline: a subscriber that can't keep
+// up misses the event (the next one carries the progress anyway)
+func deliverVideoEvent(event VideoEvent) {
+	videoSubscribersMu.Lock()
+	defer videoSubscribersMu.Unlock()
+
+	for ch := range videoSubscribers[event.VideoID] {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("[ERROR] Dropping %s event for a slow subscriber of video %s", event.Type, event.VideoID)
+		}
+	}
+}
+
+// StartVideoEventRelay listens to the events published by every server and
+// delivers them to the subscribers of this one
+func StartVideoEventRelay() {
+	listener := pq.NewListener(db.DSN, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			videoEventRelayUp.Store(true)
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			videoEventRelayUp.Store(false)
+			log.Printf("[ERROR] Video event relay disconnected: %v", err)
+		}
+	})
+
+	if err := listener.Listen(videoEventsChannel); err != nil {
+		log.Printf("[ERROR] Error listening to video events, events stay on this server: %v", err)
+		videoEventRelayUp.Store(false)
+		return
+	}
+	videoEventRelayUp.Store(true)
+
+	go func() {
+		for notification := range listener.NotificationChannel() {
+			// nil after a reconnect, the events sent meanwhile are lost
+			if notification == nil {
+				continue
+			}
+
+			var event VideoEvent
+			if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+				log.Printf("[ERROR] Error parsing relayed video event: %v", err)
+				continue
+			}
+			deliverVideoEvent(event)
+		}
+	}()
+
+	log.Println("[INFO] Relaying video events through postgres")
+}
+
+// Final reports whether nothing follows the event until the video is
+// generated again
+func (e VideoEvent) Final() bool {
+	switch e.Type {
+	case VideoEventScriptReady, VideoEventFailed, VideoEventCancelled, VideoEventDone:
+		return true
+	}
+	return false
+}
+
+func publishStageStarted(video *models.Video, stage string) {
+	PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventStage, Stage: stage, Progress: video.Progress})
+}
+
+func publishStageFinished(video *models.Video, stage string) {
+	PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventProgress, Stage: stage, Progress: video.Progress})
+}
@@ -0,0 +1,475 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	ImageProviderOla    = "ola"
+	ImageProviderOpenAI = "openai"
+	ImageProviderLocal  = "local"
+
+	// a provider failing this many times in a row is skipped for a while
+	imageProviderFailureThreshold = 3
+	imageProviderCooldown         = 5 * time.Minute
+)
+
+// ImageParams are the generation settings of a video style. Models maps an
+// image provider to the model it uses, a provider without one uses its default
+type ImageParams struct {
+	Models            map[string]string `json:"models"`
+	Width             int               `json:"width"`
+	Height            int               `json:"height"`
+	GuidanceScale     float64           `json:"guidanceScale"`
+	NumInferenceSteps int               `json:"numInferenceSteps"`
+	Seed              *int              `json:"seed"`
+	NegativePrompt    string            `json:"negativePrompt"`
+}
+
+// ImageGenerator generates a single image for a prompt
+type ImageGenerator interface {
+	Name() string
+	GenerateImage(ctx context.Context, prompt string, params ImageParams) ([]byte, error)
+}
+
+var defaultImageSeed = 1075943719
+
+var defaultImageParams = ImageParams{
+	Width:             1024,
+	Height:            1024,
+	GuidanceScale:     10,
+	NumInferenceSteps: 50,
+	Seed:              &defaultImageSeed,
+}
+
+// styleImageParams holds the per style overrides of defaultImageParams.
+// They can be replaced through a JSON file at IMAGE_STYLE_PARAMS_FILE
+// mapping the style name to ImageParams
+var styleImageParams = map[string]ImageParams{
+	string(AnimeStyle):      {GuidanceScale: 8, NumInferenceSteps: 40},
+	string(CartoonStyle):    {GuidanceScale: 8, NumInferenceSteps: 40},
+	string(WatercolorStyle): {GuidanceScale: 7, NumInferenceSteps: 45},
+}
+
+// imageProvidersByPlan is the order in which image providers are tried,
+// keyed by the first word of the plan name ("Basic", "Pro", ...).
+// The empty key is used for users without an active subscription
+var imageProvidersByPlan = map[string][]string{
+	"":         {ImageProviderOla, ImageProviderLocal},
+	"Basic":    {ImageProviderOla, ImageProviderLocal},
+	"Standard": {ImageProviderOla, ImageProviderOpenAI, ImageProviderLocal},
+	"Pro":      {ImageProviderOpenAI, ImageProviderOla, ImageProviderLocal},
+	"Premium":  {ImageProviderOpenAI, ImageProviderOla, ImageProviderLocal},
+}
+
+var imageGenerators = map[string]ImageGenerator{
+	ImageProviderOla:    olaImageGenerator{},
+	ImageProviderOpenAI: openAIImageGenerator{},
+	ImageProviderLocal:  localImageGenerator{},
+}
+
+var loadStyleImageParamsOnce sync.Once
+
+func loadStyleImageParams() {
+	path := os.Getenv("IMAGE_STYLE_PARAMS_FILE")
+	if path == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("[ERROR] Error reading image style params: %v", err)
+		return
+	}
+
+	params := map[string]ImageParams{}
+	if err := json.Unmarshal(content, &params); err != nil {
+		log.Printf("[ERROR] Error parsing image style params: %v", err)
+		return
+	}
+
+	for style, p := range params {
+		for provider := range p.Models {
+			if _, ok := imageGenerators[provider]; !ok {
+				log.Printf("[ERROR] Unknown image provider %s in the params of style %s", provider, style)
+				delete(p.Models, provider)
+			}
+		}
+		styleImageParams[style] = p
+	}
+}
+
+// GetImageParamsForStyle merges the overrides of a style into the defaults
+func GetImageParamsForStyle(style string) ImageParams {
+	loadStyleImageParamsOnce.Do(loadStyleImageParams)
+
+	params := defaultImageParams
+	override, ok := styleImageParams[style]
+	if !ok {
+		return params
+	}
+
+	if len(override.Models) > 0 {
+		// copied so the defaults aren't changed
+		models := map[string]string{}
+		for provider, model := range params.Models {
+			models[provider] = model
+		}
+		for provider, model := range override.Models {
+			models[provider] = model
+		}
+		params.Models = models
+	}
+	if override.Width > 0 {
+		params.Width = override.Width
+	}
+	if override.Height > 0 {
+		params.Height = override.Height
+	}
+	if override.GuidanceScale > 0 {
+		params.GuidanceScale = override.GuidanceScale
+	}
+	if override.NumInferenceSteps > 0 {
+		params.NumInferenceSteps = override.NumInferenceSteps
+	}
+	if override.Seed != nil {
+		params.Seed = override.Seed
+	}
+	if override.NegativePrompt != "" {
+		params.NegativePrompt = override.NegativePrompt
+	}
+	return params
+}
+
+// GetImageProvidersForUser returns the image providers to try for a user,
+// based on their plan. IMAGE_PROVIDERS overrides it for everyone
+func GetImageProvidersForUser(userID string) []string {
+	if value := os.Getenv("IMAGE_PROVIDERS"); value != "" {
+		var providers []string
+		for _, provider := range strings.Split(value, ",") {
+			provider = strings.TrimSpace(provider)
+			if _, ok := imageGenerators[provider]; ok {
+				providers = append(providers, provider)
+			}
+		}
+		return providers
+	}
+
+	tier := ""
+	subscription, err := GetActiveSubscriptionByUserID(userID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting subscription, using the free image providers: %v", err)
+	} else if subscription != nil {
+		tier = strings.Split(subscription.PlanName, " ")[0]
+	}
+
+	providers, ok := imageProvidersByPlan[tier]
+	if !ok {
+		providers = imageProvidersByPlan[""]
+	}
+	return providers
+}
+
+type imageProviderHealth struct {
+	consecutiveFailures int
+	skipUntil           time.Time
+}
+
+var (
+	imageProviderHealthMu sync.Mutex
+	imageProviderHealths  = map[string]*imageProviderHealth{}
+)
+
+func isImageProviderAvailable(provider string) bool {
+	imageProviderHealthMu.Lock()
+	defer imageProviderHealthMu.Unlock()
+
+	health, ok := imageProviderHealths[provider]
+	return !ok || time.Now().After(health.skipUntil)
+}
+
+func recordImageProviderResult(provider string, err error) {
+	imageProviderHealthMu.Lock()
+	defer imageProviderHealthMu.Unlock()
+
+	health, ok := imageProviderHealths[provider]
+	if !ok {
+		health = &imageProviderHealth{}
+		imageProviderHealths[provider] = health
+	}
+
+	if err == nil {
+		health.consecutiveFailures = 0
+		return
+	}
+
+	health.consecutiveFailures++
+	if health.consecutiveFailures >= imageProviderFailureThreshold {
+		log.Printf("[ERROR] Image provider %s failed %d times in a row, skipping it for %v", provider, health.consecutiveFailures, imageProviderCooldown)
+		health.skipUntil = time.Now().Add(imageProviderCooldown)
+		health.consecutiveFailures = 0
+	}
+}
+
+// generateImageWithFallback tries the providers in order, skipping the ones
+// that keep failing, and returns the image along with the provider used
+func generateImageWithFallback(ctx context.Context, providers []string, prompt string, params ImageParams) ([]byte, string, error) {
+	var errors []string
+
+	for _, provider := range providers {
+		generator, ok := imageGenerators[provider]
+		if !ok || !isImageProviderAvailable(provider) {
+			continue
+		}
+
+		imageData, err := generator.GenerateImage(ctx, prompt, params)
+		if ctx.Err() != nil {
+			// a cancelled request says nothing about the health of the provider
+			return nil, "", ctx.Err()
+		}
+
+		recordImageProviderResult(provider, err)
+		if err == nil {
+			return imageData, provider, nil
+		}
+
+		log.Printf("[ERROR] Image provider %s failed: %v", provider, err)
+		errors = append(errors, fmt.Sprintf("%s: %v", provider, err))
+	}
+
+	if len(errors) == 0 {
+		return nil, "", fmt.Errorf("no image provider available")
+	}
+	return nil, "", fmt.Errorf("all image providers failed: %s", strings.Join(errors, "; "))
+}
+
+// imageProviderUsesSeed reports whether the provider honors ImageParams.Seed,
+// so the seed recorded on a scene can reproduce its image
+func imageProviderUsesSeed(provider string) bool {
+	return provider != ImageProviderOpenAI
+}
+
+// olaImageGenerator uses the Ola Krutrim SDXL endpoint
+type olaImageGenerator struct{}
+
+func (g olaImageGenerator) Name() string { return ImageProviderOla }
+
+func (g olaImageGenerator) GenerateImage(ctx context.Context, prompt string, params ImageParams) ([]byte, error) {
+	apiKey := os.Getenv("ACIDRAIN_OLA_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("ACIDRAIN_OLA_KEY environment variable not set")
+	}
+
+	log.Printf("Generating image for prompt: %s", prompt)
+
+	modelName := params.Models[ImageProviderOla]
+	if modelName == "" {
+		modelName = "diffusion1XL"
+	}
+
+	reqBody := SDXLRequest{
+		ModelName:         modelName,
+		Prompt:            prompt,
+		ImageHeight:       params.Height,
+		ImageWidth:        params.Width,
+		NegativePrompt:    params.NegativePrompt,
+		NumOutputImages:   1,
+		GuidanceScale:     params.GuidanceScale,
+		NumInferenceSteps: params.NumInferenceSteps,
+		Seed:              params.Seed,
+		OutputImgType:     "pil",
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://cloud.olakrutrim.com/v1/images/generations/diffusion", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	var sdxlResp SDXLResponse
+	err = json.Unmarshal(body, &sdxlResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if len(sdxlResp.Data) == 0 {
+		return nil, fmt.Errorf("no image data received")
+	}
+
+	imageData, err := base64.StdEncoding.DecodeString(sdxlResp.Data[0].B64JSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 image data: %v", err)
+	}
+
+	return imageData, nil
+}
+
+// openAIImageGenerator uses the OpenAI Images API (DALL-E 3 by default)
+type openAIImageGenerator struct{}
+
+func (g openAIImageGenerator) Name() string { return ImageProviderOpenAI }
+
+func (g openAIImageGenerator) GenerateImage(ctx context.Context, prompt string, params ImageParams) ([]byte, error) {
+	client := openai.NewClient(OPENAI_API_KEY)
+
+	model := openai.CreateImageModelDallE3
+	if params.Models[ImageProviderOpenAI] != "" {
+		model = params.Models[ImageProviderOpenAI]
+	}
+
+	// DALL-E 3 only supports a few sizes, pick the closest orientation
+	size := openai.CreateImageSize1024x1024
+	if params.Height > params.Width {
+		size = openai.CreateImageSize1024x1792
+	} else if params.Width > params.Height {
+		size = openai.CreateImageSize1792x1024
+	}
+
+	resp, err := client.CreateImage(ctx, openai.ImageRequest{
+		Prompt:         prompt,
+		Model:          model,
+		N:              1,
+		Size:           size,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating image: %v", err)
+	}
+
+	if len(resp.Data) == 0 {
+		return nil, fmt.Errorf("no image data received")
+	}
+
+	imageData, err := base64.StdEncoding.DecodeString(resp.Data[0].B64JSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 image data: %v", err)
+	}
+
+	return imageData, nil
+}
+
+// localImageGenerator talks to a self-hosted Stable Diffusion server exposing
+// the Automatic1111 txt2img API (ComfyUI works through an A1111 compatible bridge).
+// The server is configured with LOCAL_SD_URL
+type localImageGenerator struct{}
+
+func (g localImageGenerator) Name() string { return ImageProviderLocal }
+
+func (g localImageGenerator) GenerateImage(ctx context.Context, prompt string, params ImageParams) ([]byte, error) {
+	baseURL := os.Getenv("LOCAL_SD_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:7860"
+	}
+
+	type txt2imgRequest struct {
+		Prompt           string            `json:"prompt"`
+		NegativePrompt   string            `json:"negative_prompt,omitempty"`
+		Steps            int               `json:"steps"`
+		CFGScale         float64           `json:"cfg_scale"`
+		Width            int               `json:"width"`
+		Height           int               `json:"height"`
+		Seed             int               `json:"seed"`
+		BatchSize        int               `json:"batch_size"`
+		OverrideSettings map[string]string `json:"override_settings,omitempty"`
+	}
+
+	reqBody := txt2imgRequest{
+		Prompt:         prompt,
+		NegativePrompt: params.NegativePrompt,
+		Steps:          params.NumInferenceSteps,
+		CFGScale:       params.GuidanceScale,
+		Width:          params.Width,
+		Height:         params.Height,
+		Seed:           -1,
+		BatchSize:      1,
+	}
+
+	if params.Seed != nil {
+		reqBody.Seed = *params.Seed
+	}
+
+	if model := params.Models[ImageProviderLocal]; model != "" {
+		reqBody.OverrideSettings = map[string]string{"sd_model_checkpoint": model}
+	}
+
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(baseURL, "/")+"/sdapi/v1/txt2img", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API request failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	var txt2imgResp struct {
+		Images []string `json:"images"`
+	}
+	if err := json.Unmarshal(body, &txt2imgResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if len(txt2imgResp.Images) == 0 {
+		return nil, fmt.Errorf("no image data received")
+	}
+
+	imageData, err := base64.StdEncoding.DecodeString(txt2imgResp.Images[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64 image data: %v", err)
+	}
+
+	return imageData, nil
+}
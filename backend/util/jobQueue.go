@@ -0,0 +1,605 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	JobTypeCreateVideo     = "create_video"
+	JobTypeRegenerateScene = "regenerate_scene"
+	JobTypeRollbackScene   = "rollback_scene"
+
+	jobLeaseDuration     = 2 * time.Minute
+	jobHeartbeatInterval = 30 * time.Second
+	jobPollInterval      = 5 * time.Second
+	jobRetryBackoff      = 30 * time.Second
+)
+
+// VideoGenerationJobTypes are the jobs that change the artifacts of a video.
+// Only one of them runs for a video at a time and they can be cancelled
+var VideoGenerationJobTypes = []string{JobTypeCreateVideo, JobTypeRegenerateScene, JobTypeRollbackScene}
+
+// ErrVideoGenerating is returned when enqueueing a generation job for a video
+// that already has one queued or running
+var ErrVideoGenerating = errors.New("the video is already being generated")
+
+// JobHandler runs a single job. Returning an error makes the job retry
+// until it runs out of attempts
+type JobHandler func(ctx context.Context, job *models.Job) error
+
+var jobHandlers = map[string]JobHandler{}
+
+// wakes up an idle worker as soon as something is enqueued
+var jobWakeup = make(chan struct{}, 1)
+
+// cancels the context of the jobs running in this process, by job ID
+var (
+	runningJobsMu sync.Mutex
+	runningJobs   = map[string]context.CancelFunc{}
+)
+
+type CreateVideoJobPayload struct {
+	// optional stage to force a rerun from, see CreateVideo
+	FromStage string `json:"fromStage"`
+}
+
+type RegenerateSceneJobPayload struct {
+	SceneIndex int    `json:"sceneIndex"`
+	Prompt     string `json:"prompt"` // optional, replaces the generated prompt
+	Style      string `json:"style"`  // optional, defaults to the style of the video
+	Seed       *int   `json:"seed"`   // optional, a random one is used otherwise
+}
+
+type RollbackSceneJobPayload struct {
+	SceneIndex int `json:"sceneIndex"`
+	Version    int `json:"version"`
+}
+
+func init() {
+	RegisterJobHandler(JobTypeCreateVideo, handleCreateVideoJob)
+	RegisterJobHandler(JobTypeRegenerateScene, handleRegenerateSceneJob)
+	RegisterJobHandler(JobTypeRollbackScene, handleRollbackSceneJob)
+}
+
+func RegisterJobHandler(jobType string, handler JobHandler) {
+	jobHandlers[jobType] = handler
+}
+
+func EnqueueJob(jobType string, videoID string, payload interface{}, maxAttempts int) (*models.Job, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job payload: %v", err)
+	}
+
+	job := &models.Job{
+		Type:        jobType,
+		VideoID:     videoID,
+		Payload:     string(payloadBytes),
+		Status:      models.JobStatusQueued,
+		MaxAttempts: maxAttempts,
+		RunAfter:    time.Now(),
+	}
+
+	generation := Contains(VideoGenerationJobTypes, jobType)
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		// the lock waits for a deletion of the video in progress, see
+		// DeleteVideoRows, so no job is left behind for a deleted video.
+		// Generation jobs take it exclusively so two requests can't both
+		// pass the check for an active one
+		if videoID != "" {
+			strength := "SHARE"
+			if generation {
+				strength = "UPDATE"
+			}
+
+			var videos []models.Video
+			txn := tx.Clauses(clause.Locking{Strength: strength}).Select("id").Where("id = ?", videoID).Find(&videos)
+			if txn.Error != nil {
+				return txn.Error
+			}
+			if len(videos) == 0 {
+				return fmt.Errorf("video %s doesn't exist", videoID)
+			}
+		}
+
+		if generation {
+			var activeJobs int64
+			txn := tx.Model(&models.Job{}).
+				Where("video_id = ? AND type IN ? AND status IN ?", videoID, VideoGenerationJobTypes, []string{models.JobStatusQueued, models.JobStatusRunning}).
+				Count(&activeJobs)
+			if txn.Error != nil {
+				return txn.Error
+			}
+			if activeJobs > 0 {
+				return ErrVideoGenerating
+			}
+		}
+
+		return tx.Create(job).Error
+	})
+	if errors.Is(err, ErrVideoGenerating) {
+		return nil, err
+	}
+	if err != nil {
+		log.Printf("[ERROR] Error creating job: %v", err)
+		return nil, err
+	}
+
+	log.Printf("[INFO] Enqueued %s job %s for video %s", jobType, job.ID, videoID)
+
+	select {
+	case jobWakeup <- struct{}{}:
+	default:
+	}
+
+	return job, nil
+}
+
+// EnqueueCreateVideo schedules CreateVideo to run on one of the workers
+func EnqueueCreateVideo(videoID string, fromStage string) (*models.Job, error) {
+	maxAttempts := 3
+	if value, err := strconv.Atoi(os.Getenv("VIDEO_JOB_MAX_ATTEMPTS")); err == nil && value > 0 {
+		maxAttempts = value
+	}
+
+	return EnqueueJob(JobTypeCreateVideo, videoID, CreateVideoJobPayload{FromStage: fromStage}, maxAttempts)
+}
+
+func EnqueueRegenerateScene(videoID string, payload RegenerateSceneJobPayload) (*models.Job, error) {
+	return EnqueueJob(JobTypeRegenerateScene, videoID, payload, 3)
+}
+
+// EnqueueRollbackScene schedules the rollback of a scene along with the
+// stitching, so a rollback is never left without a stitched video
+func EnqueueRollbackScene(videoID string, payload RollbackSceneJobPayload) (*models.Job, error) {
+	return EnqueueJob(JobTypeRollbackScene, videoID, payload, 3)
+}
+
+// StartJobWorkers starts the worker pool. The number of workers (and so the
+// number of videos generated at once) is capped by VIDEO_WORKER_CONCURRENCY.
+// Jobs left behind by a previous process are picked up once their lease runs out
+func StartJobWorkers() {
+	concurrency := 2
+	if value, err := strconv.Atoi(os.Getenv("VIDEO_WORKER_CONCURRENCY")); err == nil && value > 0 {
+		concurrency = value
+	}
+
+	hostname, _ := os.Hostname()
+
+	log.Printf("[INFO] Starting %d job workers", concurrency)
+
+	for i := 0; i < concurrency; i++ {
+		workerID := fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.New().String()[:8])
+		go runJobWorker(workerID)
+	}
+}
+
+func runJobWorker(workerID string) {
+	for {
+		job, err := claimJob(workerID)
+		if err != nil {
+			log.Printf("[ERROR] Worker %s failed to claim job: %v", workerID, err)
+		}
+
+		if job == nil {
+			select {
+			case <-jobWakeup:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		runJob(workerID, job)
+	}
+}
+
+// claimJob locks the oldest runnable job (queued, or running with an expired
+// lease) and takes a lease on it. SKIP LOCKED lets several servers share the table.
+// A generation job waits while another one holds a lease on the same video
+func claimJob(workerID string) (*models.Job, error) {
+	var claimed, abandoned *models.Job
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		job := new(models.Job)
+		now := time.Now()
+
+		txn := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("(status = ? AND run_after <= ?) OR (status = ? AND lease_expires_at < ?)",
+				models.JobStatusQueued, now, models.JobStatusRunning, now).
+			Where("NOT (type IN ? AND EXISTS (SELECT 1 FROM jobs AS running WHERE running.video_id = jobs.video_id AND running.id <> jobs.id AND running.type IN ? AND running.status = ? AND running.lease_expires_at >= ?))",
+				VideoGenerationJobTypes, VideoGenerationJobTypes, models.JobStatusRunning, now).
+			Order("run_after asc").
+			Limit(1).
+			Find(job)
+		if txn.Error != nil {
+			return txn.Error
+		}
+
+		if txn.RowsAffected == 0 {
+			return nil
+		}
+
+		if job.Status == models.JobStatusRunning {
+			log.Printf("[INFO] Picking up abandoned job %s (lease held by %s)", job.ID, job.LeaseOwner)
+
+			if job.Attempts >= job.MaxAttempts {
+				job.Status = models.JobStatusFailed
+				job.Error = fmt.Sprintf("job abandoned after %d attempts", job.Attempts)
+				job.LeaseOwner = ""
+				job.LeaseExpiresAt = nil
+				job.FinishedAt = &now
+				if err := tx.Save(job).Error; err != nil {
+					return err
+				}
+
+				abandoned = job
+				return nil
+			}
+		}
+
+		leaseExpiresAt := now.Add(jobLeaseDuration)
+
+		job.Status = models.JobStatusRunning
+		job.Attempts++
+		job.LeaseOwner = workerID
+		job.LeaseExpiresAt = &leaseExpiresAt
+		job.HeartbeatAt = &now
+		if job.StartedAt == nil {
+			job.StartedAt = &now
+		}
+
+		if err := tx.Save(job).Error; err != nil {
+			return err
+		}
+
+		claimed = job
+		return nil
+	})
+
+	if err == nil && abandoned != nil {
+		publishVideoJobFailure(abandoned, false)
+	}
+
+	return claimed, err
+}
+
+func runJob(workerID string, job *models.Job) {
+	handler, ok := jobHandlers[job.Type]
+	if !ok {
+		finishJob(workerID, job, fmt.Errorf("no handler registered for job type %s", job.Type), false)
+		return
+	}
+
+	log.Printf("[INFO] Worker %s running %s job %s (attempt %d/%d)", workerID, job.Type, job.ID, job.Attempts, job.MaxAttempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runningJobsMu.Lock()
+	runningJobs[job.ID] = cancel
+	runningJobsMu.Unlock()
+
+	defer func() {
+		runningJobsMu.Lock()
+		delete(runningJobs, job.ID)
+		runningJobsMu.Unlock()
+	}()
+
+	go heartbeatJob(ctx, cancel, workerID, job.ID)
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+		return handler(ctx, job)
+	}()
+
+	finishJob(workerID, job, err, true)
+}
+
+// heartbeatJob keeps extending the lease while the job runs. If the lease was
+// taken over by another worker or the job was cancelled, the context is cancelled
+func heartbeatJob(ctx context.Context, cancel context.CancelFunc, workerID string, jobID string) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			txn := db.DB.Model(&models.Job{}).
+				Where("id = ? AND lease_owner = ?", jobID, workerID).
+				Updates(map[string]interface{}{
+					"lease_expires_at": now.Add(jobLeaseDuration),
+					"heartbeat_at":     now,
+				})
+			if txn.Error != nil {
+				log.Printf("[ERROR] Error sending heartbeat for job %s: %v", jobID, txn.Error)
+				continue
+			}
+
+			if txn.RowsAffected == 0 {
+				log.Printf("[ERROR] Worker %s lost the lease on job %s", workerID, jobID)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func finishJob(workerID string, job *models.Job, jobErr error, retryable bool) {
+	now := time.Now()
+
+	updates := map[string]interface{}{
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+	}
+
+	switch {
+	case jobErr == nil:
+		log.Printf("[INFO] Job %s completed", job.ID)
+		updates["status"] = models.JobStatusCompleted
+		updates["error"] = ""
+		updates["finished_at"] = now
+	case retryable && job.Attempts < job.MaxAttempts:
+		log.Printf("[ERROR] Job %s failed, retrying: %v", job.ID, jobErr)
+		updates["status"] = models.JobStatusQueued
+		updates["error"] = jobErr.Error()
+		updates["run_after"] = now.Add(time.Duration(job.Attempts) * jobRetryBackoff)
+	default:
+		log.Printf("[ERROR] Job %s failed: %v", job.ID, jobErr)
+		updates["status"] = models.JobStatusFailed
+		updates["error"] = jobErr.Error()
+		updates["finished_at"] = now
+	}
+
+	txn := db.DB.Model(&models.Job{}).
+		Where("id = ? AND lease_owner = ?", job.ID, workerID).
+		Updates(updates)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving job %s: %v", job.ID, txn.Error)
+		return
+	}
+
+	// a cancelled job lost its lease, the cancelled event is sent instead
+	if jobErr != nil && txn.RowsAffected > 0 {
+		publishVideoJobFailure(job, updates["status"] == models.JobStatusQueued)
+	}
+}
+
+// publishVideoJobFailure tells the clients watching the video whether the
+// failed job runs again or the video failed for good
+func publishVideoJobFailure(job *models.Job, retrying bool) {
+	if !Contains(VideoGenerationJobTypes, job.Type) {
+		return
+	}
+
+	event := VideoEvent{VideoID: job.VideoID, Type: VideoEventFailed}
+	if retrying {
+		event.Type = VideoEventRetrying
+	}
+
+	if video, err := GetVideoById(job.VideoID); err == nil {
+		event.Progress = video.Progress
+		if !retrying {
+			event.Message = video.Error
+		}
+	}
+
+	PublishVideoEvent(event)
+}
+
+func handleCreateVideoJob(ctx context.Context, job *models.Job) error {
+	var payload CreateVideoJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal job payload: %v", err)
+	}
+
+	video, err := GetVideoById(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get video by ID: %v", err)
+	}
+
+	// a retried (or abandoned) job resumes from the first incomplete stage,
+	// so the forced stage only applies to the first attempt
+	fromStage := payload.FromStage
+	if job.Attempts > 1 {
+		fromStage = ""
+	}
+
+	return runCreateVideo(ctx, job, video, fromStage)
+}
+
+// runCreateVideo runs the pipeline for the video of the job and turns the
+// error recorded on the video into the error of the job
+func runCreateVideo(ctx context.Context, job *models.Job, video *models.Video, fromStage string) error {
+	if _, err := CreateVideo(ctx, video, fromStage); err != nil {
+		if ctx.Err() != nil && isJobCancelled(job.ID) {
+			finishCancelledVideo(job.VideoID)
+		}
+		return err
+	}
+
+	// CreateVideo records pipeline errors on the video itself
+	video, err := GetVideoById(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get video by ID: %v", err)
+	}
+
+	if video.Error != "" {
+		return fmt.Errorf("video generation failed: %s", video.Error)
+	}
+
+	return nil
+}
+
+// handleRegenerateSceneJob regenerates one scene and stitches the video again
+func handleRegenerateSceneJob(ctx context.Context, job *models.Job) error {
+	var payload RegenerateSceneJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal job payload: %v", err)
+	}
+
+	video, err := GetVideoById(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get video by ID: %v", err)
+	}
+
+	// CreateVideo resets the stitched video right after the new image is in
+	// place, so a retry of a failed stitch doesn't regenerate the image again
+	if job.Attempts == 1 || video.VideoStitched {
+		if _, err := regenerateScene(ctx, video, payload.SceneIndex, payload.Prompt, payload.Style, payload.Seed); err != nil {
+			if ctx.Err() != nil && isJobCancelled(job.ID) {
+				finishCancelledVideo(job.VideoID)
+			}
+			return err
+		}
+	}
+
+	return runCreateVideo(ctx, job, video, StageStitch)
+}
+
+// handleRollbackSceneJob brings back an earlier version of a scene and
+// stitches the video again. Putting the version back is repeated on a retry,
+// it only copies the image
+func handleRollbackSceneJob(ctx context.Context, job *models.Job) error {
+	var payload RollbackSceneJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal job payload: %v", err)
+	}
+
+	video, err := GetVideoById(job.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get video by ID: %v", err)
+	}
+
+	if _, err := RollbackScene(ctx, video, payload.SceneIndex, payload.Version); err != nil {
+		if ctx.Err() != nil && isJobCancelled(job.ID) {
+			finishCancelledVideo(job.VideoID)
+		}
+		return err
+	}
+
+	return runCreateVideo(ctx, job, video, StageStitch)
+}
+
+// CancelVideo cancels the queued and running generation jobs of a video. A job running
+// in this process stops right away, one running on another server stops at
+// its next heartbeat; either way its worker cleans up after the pipeline
+// returned. Videos with only queued jobs are cleaned up here. It returns
+// false if nothing was being generated
+func CancelVideo(videoID string) (bool, error) {
+	var jobs []models.Job
+	txn := db.DB.Where("video_id = ? AND type IN ? AND status IN ?", videoID, VideoGenerationJobTypes,
+		[]string{models.JobStatusQueued, models.JobStatusRunning}).Find(&jobs)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting jobs to cancel: %v", txn.Error)
+		return false, txn.Error
+	}
+
+	if len(jobs) == 0 {
+		return false, nil
+	}
+
+	var jobIDs []string
+	running := false
+	for _, job := range jobs {
+		jobIDs = append(jobIDs, job.ID)
+		if job.Status == models.JobStatusRunning {
+			running = true
+		}
+	}
+
+	// clearing the lease makes the heartbeat of the worker fail and keeps
+	// finishJob from overwriting the status
+	txn = db.DB.Model(&models.Job{}).
+		Where("id IN ? AND status IN ?", jobIDs, []string{models.JobStatusQueued, models.JobStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":           models.JobStatusCancelled,
+			"error":            "cancelled by the user",
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+			"finished_at":      time.Now(),
+		})
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error cancelling jobs: %v", txn.Error)
+		return false, txn.Error
+	}
+
+	log.Printf("[INFO] Cancelled %d jobs of video %s", len(jobIDs), videoID)
+
+	runningJobsMu.Lock()
+	for _, jobID := range jobIDs {
+		if cancel, ok := runningJobs[jobID]; ok {
+			cancel()
+		}
+	}
+	runningJobsMu.Unlock()
+
+	if running {
+		// shown right away, the worker sets it again once it stopped
+		txn = db.DB.Model(&models.Video{}).Where("id = ?", videoID).Update("cancelled", true)
+		if txn.Error != nil {
+			log.Printf("[ERROR] Error marking video %s as cancelled: %v", videoID, txn.Error)
+		}
+	} else {
+		finishCancelledVideo(videoID)
+	}
+
+	return true, nil
+}
+
+func isJobCancelled(jobID string) bool {
+	job := new(models.Job)
+	txn := db.DB.Where("id = ?", jobID).First(job)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error getting job %s: %v", jobID, txn.Error)
+		return false
+	}
+	return job.Status == models.JobStatusCancelled
+}
+
+// finishCancelledVideo marks the video as cancelled once nothing works on it
+// anymore and removes the partial artifacts of the interrupted stage
+func finishCancelledVideo(videoID string) {
+	video, err := GetVideoById(videoID)
+	if err != nil {
+		log.Printf("[ERROR] Error getting cancelled video %s: %v", videoID, err)
+		return
+	}
+
+	if err := discardIncompleteStages(video); err != nil {
+		log.Printf("[ERROR] Error discarding stages of cancelled video %s: %v", videoID, err)
+		return
+	}
+	video.Cancelled = true
+	video.Error = ""
+
+	video, err = SetVideo(video)
+	if err != nil {
+		log.Printf("[ERROR] Error saving cancelled video %s: %v", videoID, err)
+		return
+	}
+
+	PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventCancelled, Progress: video.Progress})
+}
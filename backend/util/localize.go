@@ -0,0 +1,450 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// PrimaryLanguage is the language scripts are written in, other languages
+// are translated from it
+const PrimaryLanguage = "en"
+
+const translationAttempts = 2
+
+// the languages videos can be localized to, with the name the translation
+// prompt uses. Only latin and cyrillic scripts: the captions are rendered
+// with Roboto and wrapped on spaces
+var supportedLanguages = map[string]string{
+	"de": "German",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"id": "Indonesian",
+	"it": "Italian",
+	"nl": "Dutch",
+	"pl": "Polish",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"tr": "Turkish",
+}
+
+// the TTS providers whose voices speak every supported language
+var multilingualTTSProviders = []string{TTSProviderOpenAI}
+
+func IsValidLanguage(language string) bool {
+	_, ok := supportedLanguages[language]
+	return ok
+}
+
+// NormalizeLanguages validates the languages requested for a video and
+// returns the ones it needs variants for: lowercased, without duplicates and
+// without the primary language
+func NormalizeLanguages(languages []string) ([]string, error) {
+	var normalized []string
+	for _, language := range languages {
+		language = strings.ToLower(strings.TrimSpace(language))
+		if !IsValidLanguage(language) {
+			return nil, fmt.Errorf("unsupported language %q", language)
+		}
+
+		if language == PrimaryLanguage || Contains(normalized, language) {
+			continue
+		}
+		normalized = append(normalized, language)
+	}
+	return normalized, nil
+}
+
+// GetNarratorForLanguage picks the voice of a variant: the narrator of the
+// video if it speaks the language, otherwise a narrator of the language
+// (preferably of the same provider). Multilingual voices speak any language
+func GetNarratorForLanguage(narratorName string, language string) (*models.Narrator, error) {
+	narrator, err := GetNarratorByName(narratorName)
+	if err != nil {
+		return nil, err
+	}
+
+	if narrator.Language == language {
+		return narrator, nil
+	}
+
+	var narrators []models.Narrator
+	if err := db.DB.Where("language = ? AND enabled = ?", language, true).Order("name asc").Find(&narrators).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range narrators {
+		if narrators[i].Provider == narrator.Provider {
+			return &narrators[i], nil
+		}
+	}
+
+	if len(narrators) > 0 {
+		return &narrators[0], nil
+	}
+
+	if Contains(multilingualTTSProviders, narrator.Provider) {
+		return narrator, nil
+	}
+
+	return nil, fmt.Errorf("no narrator speaks %s", language)
+}
+
+func getVariantFolderPath(videoID string, language string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "languages", language)
+}
+
+func getVariantAudioPath(videoID string, language string) string {
+	return filepath.Join(getVariantFolderPath(videoID, language), "audio", "full_audio.mp3")
+}
+
+func getVariantSubtitlesPath(videoID string, language string) string {
+	return filepath.Join(getVariantFolderPath(videoID, language), "subtitles", "subtitles.json")
+}
+
+func getVariantClipPath(videoID string, language string, index int) string {
+	return filepath.Join(getVariantFolderPath(videoID, language), "clips", fmt.Sprintf("clip_%d.mp4", index+1))
+}
+
+func getVariantMixPath(videoID string, language string) string {
+	return filepath.Join(getVariantFolderPath(videoID, language), "master", "mix.flac")
+}
+
+func getVariantVideoPath(videoID string, language string) string {
+	return filepath.Join(getVariantFolderPath(videoID, language), "final", "video.mp4")
+}
+
+// translateSentences translates the sentences of a script one to one, so the
+// scenes of the video still line up with them
+func translateSentences(ctx context.Context, client *openai.Client, video *models.Video, sentences []string, language string) ([]string, error) {
+	var numbered strings.Builder
+	for i, sentence := range sentences {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, sentence)
+	}
+
+	functionDescription := openai.FunctionDefinition{
+		Name:        "translate_script",
+		Description: "Translate the sentences of a video script",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"sentences": {
+					"type": "array",
+					"items": {"type": "string"},
+					"description": "The translation of every sentence, in the same order. Exactly one translated sentence per sentence, without the numbers."
+				}
+			},
+			"required": ["sentences"]
+		}`),
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= translationAttempts; attempt++ {
+		resp, err := client.CreateChatCompletion(
+			ctx,
+			openai.ChatCompletionRequest{
+				Model: openai.GPT4oMini,
+				Messages: []openai.ChatCompletionMessage{
+					{
+						Role:    openai.ChatMessageRoleSystem,
+						Content: fmt.Sprintf("You translate the narration of short-form videos to %s. Keep the tone, keep it natural to say out loud, and keep every sentence about as long as the original so it fits the same visuals.", supportedLanguages[language]),
+					},
+					{
+						Role:    openai.ChatMessageRoleUser,
+						Content: fmt.Sprintf("Topic: %s\n\nSentences:\n%s", video.Topic, numbered.String()),
+					},
+				},
+				Functions: []openai.FunctionDefinition{
+					functionDescription,
+				},
+				FunctionCall: openai.FunctionCall{
+					Name: "translate_script",
+				},
+			},
+		)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("error translating script: %v", err)
+			continue
+		}
+
+		if len(resp.Choices) == 0 || resp.Choices[0].Message.FunctionCall == nil {
+			lastErr = fmt.Errorf("no translation returned")
+			continue
+		}
+
+		var result struct {
+			Sentences []string `json:"sentences"`
+		}
+		if err := json.Unmarshal([]byte(resp.Choices[0].Message.FunctionCall.Arguments), &result); err != nil {
+			lastErr = fmt.Errorf("error parsing translation: %v", err)
+			continue
+		}
+
+		translated, err := checkTranslation(result.Sentences, len(sentences))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		return translated, nil
+	}
+
+	return nil, lastErr
+}
+
+// checkTranslation makes sure every sentence was translated, and puts each
+// on a single line since the script of a variant is split on them again
+func checkTranslation(translated []string, count int) ([]string, error) {
+	if len(translated) != count {
+		return nil, fmt.Errorf("expected %d translated sentences, got %d", count, len(translated))
+	}
+
+	cleaned := make([]string, len(translated))
+	for i, sentence := range translated {
+		cleaned[i] = strings.Join(strings.Fields(sentence), " ")
+		if cleaned[i] == "" {
+			return nil, fmt.Errorf("sentence %d wasn't translated", i+1)
+		}
+	}
+	return cleaned, nil
+}
+
+// localizeVideo makes the variants of the video that aren't ready yet. A
+// variant that fails is marked as such and doesn't fail the video, it is
+// retried when the video is recreated
+func localizeVideo(ctx context.Context, client *openai.Client, video *models.Video) error {
+	variants, err := GetVideoVariants(video.ID)
+	if err != nil {
+		return err
+	}
+
+	byLanguage := map[string]*models.VideoVariant{}
+	for i := range variants {
+		byLanguage[variants[i].Language] = &variants[i]
+	}
+
+	asr, err := readASRForVideo(video.ID)
+	if err != nil {
+		return err
+	}
+
+	var sentences []string
+	for _, sentence := range asr.Sentences {
+		sentences = append(sentences, strings.TrimSpace(sentence.Text))
+	}
+
+	for _, language := range video.Languages {
+		variant, ok := byLanguage[language]
+		if !ok {
+			variant = &models.VideoVariant{VideoID: video.ID, Language: language, Status: models.VariantStatusPending}
+		}
+
+		if variant.Status == models.VariantStatusReady {
+			continue
+		}
+
+		log.Printf("[INFO] Localizing video %s to %s", video.ID, language)
+
+		variantErr := localizeVariant(ctx, client, video, variant, sentences)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if variantErr != nil {
+			log.Printf("[ERROR] Error localizing video %s to %s: %v", video.ID, language, variantErr)
+			variant.Status = models.VariantStatusFailed
+			variant.Error = variantErr.Error()
+		} else {
+			variant.Status = models.VariantStatusReady
+			variant.Error = ""
+		}
+
+		if _, err := SetVideoVariant(variant); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localizeVariant runs the script, TTS, timing, mastering and render of one language.
+// Every step that finished is saved, so a retry continues after it
+func localizeVariant(ctx context.Context, client *openai.Client, video *models.Video, variant *models.VideoVariant, sentences []string) error {
+	language := variant.Language
+
+	var translated []string
+	if variant.Script != "" {
+		translated = strings.Split(variant.Script, "\n")
+	}
+
+	if len(translated) != len(sentences) {
+		var err error
+		translated, err = translateSentences(ctx, client, video, sentences, language)
+		if err != nil {
+			return err
+		}
+
+		variant.Script = strings.Join(translated, "\n")
+		variant.TTSURL = ""
+		variant.SRTURL = ""
+		os.RemoveAll(getVariantFolderPath(video.ID, language))
+
+		if _, err := SetVideoVariant(variant); err != nil {
+			return err
+		}
+	}
+
+	audioPath := getVariantAudioPath(video.ID, language)
+	if variant.TTSURL == "" || !fileExists(audioPath) {
+		narrator, err := GetNarratorForLanguage(video.Narrator, language)
+		if err != nil {
+			return err
+		}
+
+		audioData, err := SynthesizeForNarrator(ctx, strings.Join(translated, " "), narrator.Name)
+		if err != nil {
+			return fmt.Errorf("error generating TTS: %v", err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(audioPath), 0755); err != nil {
+			return fmt.Errorf("error creating audio folder: %v", err)
+		}
+
+		if err := ioutil.WriteFile(audioPath, audioData, 0644); err != nil {
+			return fmt.Errorf("error writing audio: %v", err)
+		}
+
+		audioKey, err := storeVideoArtifact(ctx, audioPath)
+		if err != nil {
+			return err
+		}
+
+		variant.Narrator = narrator.Name
+		variant.TTSURL = audioKey
+		variant.SRTURL = ""
+		if _, err := SetVideoVariant(variant); err != nil {
+			return err
+		}
+	}
+
+	audioDuration, err := probeMediaDuration(ctx, audioPath)
+	if err != nil {
+		return err
+	}
+
+	subtitlesPath := getVariantSubtitlesPath(video.ID, language)
+	if variant.SRTURL == "" || !fileExists(subtitlesPath) {
+		asr := alignVariant(ctx, audioPath, translated, audioDuration)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		content, err := json.Marshal(asr)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(subtitlesPath), 0755); err != nil {
+			return fmt.Errorf("error creating subtitles folder: %v", err)
+		}
+
+		if err := ioutil.WriteFile(subtitlesPath, content, 0644); err != nil {
+			return fmt.Errorf("error writing subtitles: %v", err)
+		}
+
+		subtitlesKey, err := storeVideoArtifact(ctx, subtitlesPath)
+		if err != nil {
+			return err
+		}
+
+		variant.SRTURL = subtitlesKey
+		variant.TimingsEstimated = asr.Estimated
+		if _, err := SetVideoVariant(variant); err != nil {
+			return err
+		}
+	}
+
+	asr, err := readASRFile(subtitlesPath)
+	if err != nil {
+		return err
+	}
+
+	n := narration{
+		FolderPath: getVariantFolderPath(video.ID, language),
+		AudioPath:  audioPath,
+		Sentences:  asr.Sentences,
+		MixPath:    getVariantMixPath(video.ID, language),
+		OutputPath: getVariantVideoPath(video.ID, language),
+	}
+
+	for _, sentence := range asr.Sentences {
+		n.Words = append(n.Words, sceneWords(sentence))
+	}
+
+	// the stock clips were cut to the sentences of the video, they are cut
+	// again to the length of the translated ones
+	if clipPaths, hasClips := stockClipPaths(video.ID, len(asr.Sentences)); video.MediaType == "stock" && hasClips {
+		for i, window := range sentenceWindows(asr.Sentences, audioDuration) {
+			clipPath := getVariantClipPath(video.ID, language, i)
+			if err := os.MkdirAll(filepath.Dir(clipPath), 0755); err != nil {
+				return fmt.Errorf("error creating clips folder: %v", err)
+			}
+
+			if err := prepareStockClip(ctx, clipPaths[i], clipPath, window[1]-window[0]); err != nil {
+				return fmt.Errorf("error preparing clip %d: %v", i+1, err)
+			}
+			n.ClipPaths = append(n.ClipPaths, clipPath)
+		}
+	}
+
+	// mastered like the video, ducking under the translated narration
+	if err := masterAudio(ctx, *video, n); err != nil {
+		return err
+	}
+
+	outputPath, err := renderSlideshow(ctx, *video, n)
+	if err != nil {
+		return fmt.Errorf("failed to render slideshow: %v", err)
+	}
+
+	videoKey, err := storeVideoArtifact(ctx, outputPath)
+	if err != nil {
+		return err
+	}
+
+	variant.VideoURL = videoKey
+	return nil
+}
+
+// alignVariant times the translated narration with the ASR service. The
+// sentences have to line up with the scenes, so when the service splits them
+// differently (or is down) the timings are estimated instead
+func alignVariant(ctx context.Context, audioPath string, sentences []string, audioDuration float64) ASR {
+	content, err := generateSRTWithWhisper(ctx, audioPath, strings.Join(sentences, " "))
+	if err == nil {
+		var asr ASR
+		if err = json.Unmarshal([]byte(content), &asr); err == nil {
+			if len(asr.Sentences) == len(sentences) {
+				return asr
+			}
+			err = fmt.Errorf("expected %d sentences, got %d", len(sentences), len(asr.Sentences))
+		}
+	}
+
+	log.Printf("[ERROR] Error aligning translated narration, estimating the timings: %v", err)
+	return estimateASRForSentences(sentences, audioDuration)
+}
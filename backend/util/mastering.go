@@ -0,0 +1,270 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	models "go-authentication-boilerplate/models"
+)
+
+const (
+	// what YouTube, TikTok and Instagram normalize to, louder mixes are
+	// turned down and lose their punch
+	DefaultLoudnessTarget = -14.0
+	minLoudnessTarget     = -24.0
+	maxLoudnessTarget     = -9.0
+	masterTruePeak        = -1.5 // dBTP, headroom for the AAC encoder
+	masterLoudnessRange   = 11.0
+
+	// the music is at musicDuckedVolume under the narration and comes up to
+	// musicOpenVolume where nobody speaks
+	musicDuckedVolume = 0.15
+	musicOpenVolume   = 0.35
+	// how long the music takes to dip before a sentence and to come back
+	// after it, in seconds
+	duckAttack  = 0.25
+	duckRelease = 0.5
+	// pauses shorter than this stay ducked, music pumping between the
+	// sentences is distracting. Longer than attack and release together so
+	// the ramps of two sentences never overlap
+	duckMinGap = 1.0
+
+	transitionSFX       = "15. Whoosh Swoosh.wav"
+	transitionSFXVolume = 0.5
+	// the whoosh starts this much before the cut so it peaks on it
+	transitionSFXLead = 0.2
+)
+
+func IsValidLoudnessTarget(target float64) bool {
+	return target >= minLoudnessTarget && target <= maxLoudnessTarget
+}
+
+func getLoudnessTarget(video models.Video) float64 {
+	if IsValidLoudnessTarget(video.LoudnessTarget) {
+		return video.LoudnessTarget
+	}
+	return DefaultLoudnessTarget
+}
+
+func getMasteredAudioPath(videoID string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "master", "mix.flac")
+}
+
+// masterAudio mixes the narration with the background music, ducked under
+// the speech, and the transition effects, then normalizes the mix to the
+// loudness target of the video. The mix is written to n.MixPath
+func masterAudio(ctx context.Context, video models.Video, n narration) error {
+	audioDuration, err := probeMediaDuration(ctx, n.AudioPath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(n.MixPath), 0755); err != nil {
+		return fmt.Errorf("error creating master folder: %v", err)
+	}
+
+	premixPath := filepath.Join(filepath.Dir(n.MixPath), "premix.wav")
+	defer os.Remove(premixPath)
+
+	if err := mixAudio(ctx, video, n, audioDuration, premixPath); err != nil {
+		return fmt.Errorf("error mixing audio: %v", err)
+	}
+
+	if err := normalizeLoudness(ctx, premixPath, n.MixPath, getLoudnessTarget(video)); err != nil {
+		return fmt.Errorf("error normalizing loudness: %v", err)
+	}
+
+	log.Printf("[INFO] Mastered audio of video %s to %.1f LUFS", video.ID, getLoudnessTarget(video))
+	return nil
+}
+
+// mixAudio puts the narration, the music and the effects together, at the
+// length of the narration
+func mixAudio(ctx context.Context, video models.Video, n narration, audioDuration float64, outputPath string) error {
+	args := []string{"-i", n.AudioPath}
+	mixInputs := []string{"[0:a]"}
+	var filters []string
+
+	musicPath := ""
+	if video.BackgroundMusic != "" {
+		var err error
+		musicPath, err = getBackgroundMusicPath(ctx, video.ID, video.BackgroundMusic)
+		if err != nil {
+			log.Printf("[ERROR] Background music %s unavailable, mastering without it: %v", video.BackgroundMusic, err)
+		}
+	}
+
+	if musicPath != "" {
+		input := len(mixInputs)
+		args = append(args, "-stream_loop", "-1", "-i", musicPath)
+		filters = append(filters, fmt.Sprintf("[%d:a]volume='%s':eval=frame[music]", input, duckingExpression(speechWindows(n.Sentences))))
+		mixInputs = append(mixInputs, "[music]")
+	}
+
+	sfxPath := getPublicAssetPath(transitionSFX)
+	if boundaries := sceneBoundaries(n.Sentences, audioDuration); video.TransitionSFX && len(boundaries) > 0 {
+		if fileExists(sfxPath) {
+			args = append(args, "-i", sfxPath)
+
+			split := fmt.Sprintf("[%d:a]volume=%.2f,asplit=%d", len(mixInputs), transitionSFXVolume, len(boundaries))
+			for i := range boundaries {
+				split += fmt.Sprintf("[sfx%d]", i)
+			}
+			filters = append(filters, split)
+
+			for i, delay := range transitionSFXDelays(boundaries) {
+				filters = append(filters, fmt.Sprintf("[sfx%d]adelay=%d:all=1[whoosh%d]", i, delay, i))
+				mixInputs = append(mixInputs, fmt.Sprintf("[whoosh%d]", i))
+			}
+		} else {
+			log.Printf("[ERROR] Transition effect not found at %s, mastering without it", sfxPath)
+		}
+	}
+
+	if len(mixInputs) > 1 {
+		filters = append(filters, fmt.Sprintf("%samix=inputs=%d:duration=first:dropout_transition=0:normalize=0[mix]", strings.Join(mixInputs, ""), len(mixInputs)))
+	} else {
+		filters = append(filters, "[0:a]anull[mix]")
+	}
+
+	args = append(args,
+		"-filter_complex", strings.Join(filters, ";"),
+		"-map", "[mix]",
+		"-ar", "48000", "-ac", "2",
+		"-t", fmt.Sprintf("%.3f", audioDuration),
+		outputPath,
+	)
+
+	return runFFmpeg(ctx, args...)
+}
+
+// speechWindows returns when the narration speaks, from the ASR timings.
+// Sentences with short pauses between them are merged
+func speechWindows(sentences []ASRSentences) [][2]float64 {
+	var windows [][2]float64
+	for _, sentence := range sentences {
+		start, end := asrSeconds(sentence.Start), asrSeconds(sentence.End)
+		if end <= start {
+			continue
+		}
+
+		if last := len(windows) - 1; last >= 0 && start-windows[last][1] < duckMinGap {
+			if end > windows[last][1] {
+				windows[last][1] = end
+			}
+			continue
+		}
+		windows = append(windows, [2]float64{start, end})
+	}
+	return windows
+}
+
+// duckingExpression is the volume of the music over time, for ffmpeg's
+// volume filter: every speech window is a trapezoid that ramps the music
+// down before it and back up after it
+func duckingExpression(windows [][2]float64) string {
+	if len(windows) == 0 {
+		return fmt.Sprintf("%.3f", musicOpenVolume)
+	}
+
+	ramps := make([]string, len(windows))
+	for i, window := range windows {
+		ramps[i] = fmt.Sprintf("clip((t-(%.3f))/%.3f,0,1)*clip((%.3f-t)/%.3f,0,1)",
+			window[0]-duckAttack, duckAttack, window[1]+duckRelease, duckRelease)
+	}
+
+	return fmt.Sprintf("%.3f-%.3f*(%s)", musicOpenVolume, musicOpenVolume-musicDuckedVolume, strings.Join(ramps, "+"))
+}
+
+// sceneBoundaries returns when the visuals change, the start of every
+// sentence but the first
+func sceneBoundaries(sentences []ASRSentences, audioDuration float64) []float64 {
+	var boundaries []float64
+	for i, window := range sentenceWindows(sentences, audioDuration) {
+		if i > 0 {
+			boundaries = append(boundaries, window[0])
+		}
+	}
+	return boundaries
+}
+
+// transitionSFXDelays returns when each whoosh starts, in milliseconds, so it
+// peaks on the cut of its boundary
+func transitionSFXDelays(boundaries []float64) []int {
+	delays := make([]int, len(boundaries))
+	for i, boundary := range boundaries {
+		delays[i] = int(math.Max(math.Round((boundary-transitionSFXLead)*1000), 0))
+	}
+	return delays
+}
+
+// loudnessMeasurement is what the first pass of loudnorm measured
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// measureLoudness runs the first pass of loudnorm over the file
+func measureLoudness(ctx context.Context, path string, filter string) (*loudnessMeasurement, error) {
+	var stderr bytes.Buffer
+
+	// the measurement is printed at the info level
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats", "-i", path,
+		"-af", filter+":print_format=json", "-f", "null", "-")
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %v: %s", err, stderr.String())
+	}
+
+	output := stderr.String()
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no loudness measurement in the output of ffmpeg")
+	}
+
+	var measurement loudnessMeasurement
+	if err := json.Unmarshal([]byte(output[start:end+1]), &measurement); err != nil {
+		return nil, fmt.Errorf("error parsing loudness measurement: %v", err)
+	}
+
+	// silence measures as -inf, there is nothing to normalize
+	if _, err := strconv.ParseFloat(measurement.InputI, 64); err != nil {
+		return nil, fmt.Errorf("unusable loudness measurement %q", measurement.InputI)
+	}
+	return &measurement, nil
+}
+
+// normalizeLoudness normalizes the file to the target in two passes, the
+// measured values let loudnorm apply a constant gain instead of compressing
+// the mix. When the measurement fails the single pass (dynamic) mode is used
+func normalizeLoudness(ctx context.Context, inputPath string, outputPath string, target float64) error {
+	filter := fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f", target, masterTruePeak, masterLoudnessRange)
+
+	measurement, err := measureLoudness(ctx, inputPath, filter)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[ERROR] Error measuring loudness of %s, normalizing in one pass: %v", inputPath, err)
+	} else {
+		filter += fmt.Sprintf(":measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			measurement.InputI, measurement.InputTP, measurement.InputLRA, measurement.InputThresh, measurement.TargetOffset)
+	}
+
+	// loudnorm works at 192kHz, the mix goes back to 48kHz
+	return runFFmpeg(ctx, "-i", inputPath, "-af", filter, "-ar", "48000", "-c:a", "flac", outputPath)
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSpeechWindows(t *testing.T) {
+	tests := []struct {
+		name      string
+		sentences []ASRSentences
+		want      [][2]float64
+	}{
+		{"no sentences", nil, nil},
+		{"one sentence", []ASRSentences{{Start: 500, End: 2000}}, [][2]float64{{0.5, 2}}},
+		{
+			"short pause is merged",
+			[]ASRSentences{{Start: 0, End: 2000}, {Start: 2500, End: 4000}},
+			[][2]float64{{0, 4}},
+		},
+		{
+			"long pause opens the music",
+			[]ASRSentences{{Start: 0, End: 2000}, {Start: 3000, End: 4000}},
+			[][2]float64{{0, 2}, {3, 4}},
+		},
+		{
+			"empty sentences are skipped",
+			[]ASRSentences{{Start: 0, End: 2000}, {Start: 2500, End: 2500}, {Start: 5000, End: 6000}},
+			[][2]float64{{0, 2}, {5, 6}},
+		},
+		{
+			"overlapping sentence keeps the later end",
+			[]ASRSentences{{Start: 0, End: 5000}, {Start: 1000, End: 3000}},
+			[][2]float64{{0, 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := speechWindows(tt.sentences); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("speechWindows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuckingExpression(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows [][2]float64
+		want    string
+	}{
+		{"no speech", nil, "0.350"},
+		{
+			"one window",
+			[][2]float64{{1, 2}},
+			"0.350-0.200*(clip((t-(0.750))/0.250,0,1)*clip((2.500-t)/0.500,0,1))",
+		},
+		{
+			"ramp before the start",
+			[][2]float64{{0.1, 2}, {4, 5.25}},
+			"0.350-0.200*(clip((t-(-0.150))/0.250,0,1)*clip((2.500-t)/0.500,0,1)+clip((t-(3.750))/0.250,0,1)*clip((5.750-t)/0.500,0,1))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := duckingExpression(tt.windows); got != tt.want {
+				t.Errorf("duckingExpression(%v) = %q, want %q", tt.windows, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransitionSFXOffsets(t *testing.T) {
+	tests := []struct {
+		name       string
+		sentences  []ASRSentences
+		duration   float64
+		boundaries []float64
+		delays     []int
+	}{
+		{"one sentence", []ASRSentences{{Start: 0, End: 3000}}, 3, nil, []int{}},
+		{
+			"cut on every sentence but the first",
+			[]ASRSentences{{Start: 300, End: 1000}, {Start: 1500, End: 2200}, {Start: 2300, End: 3000}, {Start: 3200, End: 5000}},
+			6,
+			[]float64{1.5, 2.3, 3.2},
+			[]int{1300, 2100, 3000},
+		},
+		{
+			"early cut starts at zero",
+			[]ASRSentences{{Start: 0, End: 100}, {Start: 100, End: 2000}},
+			2,
+			[]float64{0.1},
+			[]int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boundaries := sceneBoundaries(tt.sentences, tt.duration)
+			if !reflect.DeepEqual(boundaries, tt.boundaries) {
+				t.Fatalf("sceneBoundaries() = %v, want %v", boundaries, tt.boundaries)
+			}
+
+			if delays := transitionSFXDelays(boundaries); !reflect.DeepEqual(delays, tt.delays) {
+				t.Errorf("transitionSFXDelays(%v) = %v, want %v", boundaries, delays, tt.delays)
+			}
+		})
+	}
+}
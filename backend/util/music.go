@@ -0,0 +1,268 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// uploaded tracks are kept under music/ in the blob store, outside of the
+	// video prefixes the sweeper looks after
+	musicBlobPrefix = "music/"
+
+	MaxMusicUploadSize = 20 << 20
+
+	// shorter tracks loop too often to be pleasant, longer ones are albums
+	minMusicDuration = 5.0
+	maxMusicDuration = 15 * 60.0
+)
+
+var ErrInvalidMusicFile = errors.New("the file isn't a supported audio file")
+
+// musicUploadFormats are the extensions accepted for uploads and one of the
+// formats ffprobe has to report for them, so a renamed file is caught
+var musicUploadFormats = map[string]string{
+	".mp3":  "mp3",
+	".wav":  "wav",
+	".m4a":  "m4a",
+	".aac":  "aac",
+	".ogg":  "ogg",
+	".flac": "flac",
+}
+
+// the tracks that used to be hard-coded, bundled with the frontend and
+// seeded into the catalog
+var defaultMusicTracks = []models.MusicTrack{
+	{Name: "_another-love", Title: "Another Love", StoragePath: "_another-love.mp3", Enabled: true},
+	{Name: "_bladerunner-2049", Title: "Bladerunner 2049", StoragePath: "_bladerunner-2049.mp3", Enabled: true},
+	{Name: "_constellations", Title: "Constellations", StoragePath: "_constellations.mp3", Enabled: true},
+	{Name: "_fallen", Title: "Fallen", StoragePath: "_fallen.mp3", Enabled: true},
+	{Name: "_hotline", Title: "Hotline", StoragePath: "_hotline.mp3", Enabled: true},
+	{Name: "_izzamuzzic", Title: "Izzamuzzic", StoragePath: "_izzamuzzic.mp3", Enabled: true},
+	{Name: "_nas", Title: "Nas", StoragePath: "_nas.mp3", Enabled: true},
+	{Name: "_paris-else", Title: "Paris Else", StoragePath: "_paris-else.mp3", Enabled: true},
+	{Name: "_snowfall", Title: "Snowfall", StoragePath: "_snowfall.mp3", Enabled: true},
+}
+
+func getBackgroundMusicDir() string {
+	if dir := os.Getenv("BACKGROUND_MUSIC_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("..", "frontend", "public", "music")
+}
+
+// SeedMusicTracks adds the bundled tracks that are missing from the catalog
+func SeedMusicTracks() {
+	for _, track := range defaultMusicTracks {
+		var count int64
+		db.DB.Model(&models.MusicTrack{}).Where("name = ?", track.Name).Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		track := track
+		if _, duration, err := probeAudioFile(context.Background(), filepath.Join(getBackgroundMusicDir(), track.StoragePath)); err == nil {
+			track.Duration = duration
+		}
+
+		if err := db.DB.Create(&track).Error; err != nil {
+			log.Printf("[ERROR] Error seeding music track %s: %v", track.Name, err)
+		}
+	}
+}
+
+// IsValidBackgroundMusic tells whether the user can pick the track: it is in
+// the catalog, or one they uploaded
+func IsValidBackgroundMusic(name string, userID string) bool {
+	if name == "" {
+		return false
+	}
+
+	track, err := GetMusicTrackByName(name)
+	if err != nil {
+		return false
+	}
+	return track.Enabled && (track.OwnerID == "" || track.OwnerID == userID)
+}
+
+// IsAdmin tells whether the user manages the catalog, admins are listed by
+// email in ADMIN_EMAILS
+func IsAdmin(userID string) bool {
+	user, err := GetUserById(userID)
+	if err != nil {
+		return false
+	}
+
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" && strings.EqualFold(email, user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// probeAudioFile returns the container format of an audio file, as ffprobe
+// names it (e.g. mov,mp4,m4a), and its duration in seconds
+func probeAudioFile(ctx context.Context, filePath string) (string, float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=codec_type:format=format_name,duration",
+		"-of", "default=noprint_wrappers=1", filePath).Output()
+	if err != nil {
+		return "", 0, fmt.Errorf("ffprobe failed for %s: %v", filePath, err)
+	}
+
+	values := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if parts := strings.SplitN(strings.TrimSpace(line), "=", 2); len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	if values["codec_type"] != "audio" {
+		return "", 0, fmt.Errorf("%s has no audio stream", filePath)
+	}
+
+	duration, err := strconv.ParseFloat(values["duration"], 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to parse duration of %s: %v", filePath, err)
+	}
+	return values["format_name"], duration, nil
+}
+
+// validateMusicFile checks an upload is audio in the format its extension
+// claims, and returns its duration
+func validateMusicFile(ctx context.Context, filePath string, ext string) (float64, error) {
+	expected, ok := musicUploadFormats[ext]
+	if !ok {
+		return 0, fmt.Errorf("%w: %s files aren't supported", ErrInvalidMusicFile, ext)
+	}
+
+	format, duration, err := probeAudioFile(ctx, filePath)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidMusicFile, err)
+	}
+
+	if !Contains(strings.Split(format, ","), expected) {
+		return 0, fmt.Errorf("%w: the file is %s, not %s", ErrInvalidMusicFile, format, expected)
+	}
+
+	if duration < minMusicDuration || duration > maxMusicDuration {
+		return 0, fmt.Errorf("%w: tracks must be between %.0f seconds and %.0f minutes long", ErrInvalidMusicFile, minMusicDuration, maxMusicDuration/60)
+	}
+	return duration, nil
+}
+
+// CreateMusicTrack validates an uploaded file, stores it and adds the track.
+// The title, mood, BPM, license and owner (empty for the catalog) are set on
+// the track by the caller. Invalid files return ErrInvalidMusicFile
+func CreateMusicTrack(ctx context.Context, track *models.MusicTrack, filePath string, ext string) error {
+	ext = strings.ToLower(ext)
+
+	duration, err := validateMusicFile(ctx, filePath, ext)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", filePath, err)
+	}
+
+	track.Name = uuid.New().String()
+	track.Duration = duration
+	track.StoragePath = musicBlobPrefix + track.Name + ext
+	track.Enabled = true
+
+	if err := blobStore.Put(ctx, track.StoragePath, file, info.Size(), blobContentType(track.StoragePath)); err != nil {
+		return fmt.Errorf("error storing %s: %v", track.StoragePath, err)
+	}
+
+	if err := db.DB.Create(track).Error; err != nil {
+		if err := blobStore.Delete(ctx, track.StoragePath); err != nil {
+			log.Printf("[ERROR] Error deleting music %s: %v", track.StoragePath, err)
+		}
+		return fmt.Errorf("error saving music track: %v", err)
+	}
+
+	log.Printf("[INFO] Added music track %s (%s)", track.Name, track.Title)
+	return nil
+}
+
+// DeleteMusicTrack removes a track and its upload. Videos that still use it
+// are rendered without music
+func DeleteMusicTrack(ctx context.Context, track *models.MusicTrack) error {
+	if err := db.DB.Delete(track).Error; err != nil {
+		return fmt.Errorf("error deleting music track: %v", err)
+	}
+
+	if strings.HasPrefix(track.StoragePath, musicBlobPrefix) {
+		if err := blobStore.Delete(ctx, track.StoragePath); err != nil && !errors.Is(err, ErrBlobNotFound) {
+			log.Printf("[ERROR] Error deleting music %s: %v", track.StoragePath, err)
+		}
+	}
+	return nil
+}
+
+// getBackgroundMusicPath returns where the track of a video is on disk.
+// Uploaded tracks are fetched into the folder of the video
+func getBackgroundMusicPath(ctx context.Context, videoID string, name string) (string, error) {
+	track, err := GetMusicTrackByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown music track %s: %v", name, err)
+	}
+
+	if !strings.HasPrefix(track.StoragePath, musicBlobPrefix) {
+		musicPath := filepath.Join(getBackgroundMusicDir(), filepath.FromSlash(track.StoragePath))
+		if !fileExists(musicPath) {
+			return "", fmt.Errorf("music track %s not found at %s", name, musicPath)
+		}
+		return musicPath, nil
+	}
+
+	musicPath := filepath.Join(getVideoFolderPath(videoID), "music"+path.Ext(track.StoragePath))
+	if fileExists(musicPath) {
+		return musicPath, nil
+	}
+
+	reader, err := blobStore.Get(ctx, track.StoragePath)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %v", track.StoragePath, err)
+	}
+	defer reader.Close()
+
+	if err := os.MkdirAll(filepath.Dir(musicPath), 0755); err != nil {
+		return "", fmt.Errorf("error creating folder: %v", err)
+	}
+
+	file, err := os.Create(musicPath)
+	if err != nil {
+		return "", fmt.Errorf("error creating %s: %v", musicPath, err)
+	}
+
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		os.Remove(musicPath)
+		return "", fmt.Errorf("error writing %s: %v", musicPath, err)
+	}
+	return musicPath, file.Close()
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	models "go-authentication-boilerplate/models"
+)
+
+const (
+	JobTypePublishVideo = "publish_video"
+
+	DestinationYouTube  = "youtube"
+	DestinationTelegram = "telegram"
+)
+
+// PublishResult identifies the post created on the destination
+type PublishResult struct {
+	RemoteID  string
+	RemoteURL string
+}
+
+// Publisher posts a stitched video to one destination of Video.PostingMethod
+// using the account the owner linked for it
+type Publisher interface {
+	Name() string
+	Publish(ctx context.Context, video *models.Video, account *models.PublishingAccount, filePath string) (*PublishResult, error)
+}
+
+var publishers = map[string]Publisher{
+	DestinationYouTube:  youtubePublisher{},
+	DestinationTelegram: telegramPublisher{},
+}
+
+// permanentPublishError is a failure retrying won't fix, like a revoked
+// permission or a file over the size limit of the destination
+type permanentPublishError struct {
+	err error
+}
+
+func (e *permanentPublishError) Error() string {
+	return e.err.Error()
+}
+
+func IsPublishingDestination(destination string) bool {
+	_, ok := publishers[destination]
+	return ok
+}
+
+type PublishVideoJobPayload struct {
+	PublicationID string `json:"publicationID"`
+}
+
+func init() {
+	RegisterJobHandler(JobTypePublishVideo, handlePublishVideoJob)
+}
+
+// EnqueuePublications queues the publishing of a stitched video to every
+// destination of its PostingMethod that has a publisher. Destinations it was
+// already published to are left alone, so stitching again doesn't post twice
+func EnqueuePublications(video *models.Video) ([]models.Publication, error) {
+	maxAttempts := 5
+	if value, err := strconv.Atoi(os.Getenv("PUBLISH_JOB_MAX_ATTEMPTS")); err == nil && value > 0 {
+		maxAttempts = value
+	}
+
+	existing, err := GetPublicationsByVideo(video.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	byDestination := map[string]models.Publication{}
+	for _, publication := range existing {
+		byDestination[publication.Destination] = publication
+	}
+
+	var queued []models.Publication
+	for _, destination := range video.PostingMethod {
+		if !IsPublishingDestination(destination) {
+			continue
+		}
+
+		publication, ok := byDestination[destination]
+		if ok && publication.Status != models.PublicationStatusFailed {
+			continue
+		}
+
+		if !ok {
+			publication = models.Publication{VideoID: video.ID, Destination: destination}
+		}
+
+		publication.Status = models.PublicationStatusPending
+		publication.Error = ""
+		publication.Attempts = 0
+
+		if _, err := SetPublication(&publication); err != nil {
+			return queued, err
+		}
+
+		if _, err := EnqueueJob(JobTypePublishVideo, video.ID, PublishVideoJobPayload{PublicationID: publication.ID}, maxAttempts); err != nil {
+			return queued, err
+		}
+
+		queued = append(queued, publication)
+	}
+
+	return queued, nil
+}
+
+func handlePublishVideoJob(ctx context.Context, job *models.Job) error {
+	var payload PublishVideoJobPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal job payload: %v", err)
+	}
+
+	publication, err := GetPublicationById(payload.PublicationID)
+	if err != nil {
+		return fmt.Errorf("failed to get publication: %v", err)
+	}
+
+	if publication.Status == models.PublicationStatusPublished {
+		return nil
+	}
+
+	video, err := GetVideoById(publication.VideoID)
+	if err != nil {
+		return fmt.Errorf("failed to get video by ID: %v", err)
+	}
+
+	fail := func(err error, retryable bool) error {
+		publication.Error = err.Error()
+		publication.Status = models.PublicationStatusPending
+		if !retryable || job.Attempts >= job.MaxAttempts {
+			publication.Status = models.PublicationStatusFailed
+		}
+
+		if _, saveErr := SetPublication(publication); saveErr != nil {
+			log.Printf("[ERROR] Error saving publication %s: %v", publication.ID, saveErr)
+		}
+
+		if !retryable {
+			log.Printf("[ERROR] Publishing video %s to %s failed: %v", video.ID, publication.Destination, err)
+			return nil
+		}
+		return err
+	}
+
+	publisher, ok := publishers[publication.Destination]
+	if !ok {
+		return fail(fmt.Errorf("no publisher for %s", publication.Destination), false)
+	}
+
+	if !video.VideoStitched || video.StitchedVideoURL == "" {
+		return fail(fmt.Errorf("video isn't stitched"), false)
+	}
+
+	videoPath, err := fetchVideoArtifact(ctx, video.StitchedVideoURL)
+	if err != nil {
+		return fail(err, true)
+	}
+
+	account, err := GetPublishingAccount(video.OwnerID, publication.Destination)
+	if err != nil {
+		return fail(fmt.Errorf("no %s account linked", publication.Destination), false)
+	}
+
+	publication.Status = models.PublicationStatusPublishing
+	publication.Attempts = job.Attempts
+	if _, err := SetPublication(publication); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Publishing video %s to %s", video.ID, publisher.Name())
+
+	result, err := publisher.Publish(ctx, video, account, videoPath)
+	if err != nil {
+		_, permanent := err.(*permanentPublishError)
+		return fail(err, !permanent)
+	}
+
+	now := time.Now()
+	publication.Status = models.PublicationStatusPublished
+	publication.RemoteID = result.RemoteID
+	publication.RemoteURL = result.RemoteURL
+	publication.Error = ""
+	publication.PublishedAt = &now
+
+	if _, err := SetPublication(publication); err != nil {
+		log.Printf("[ERROR] Error saving publication %s: %v", publication.ID, err)
+	}
+
+	log.Printf("[INFO] Published video %s to %s as %s", video.ID, publisher.Name(), result.RemoteID)
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func getSceneImagePath(videoID string, index int) string {
+	return filepath.Join(getVideoFolderPath(videoID), "images", fmt.Sprintf("image_%d.png", index+1))
+}
+
+func getSceneVersionPath(videoID string, index int, version int) string {
+	return filepath.Join(getVideoFolderPath(videoID), "images", "versions", fmt.Sprintf("image_%d_v%d.png", index+1, version))
+}
+
+// syncScenes lines the storyboard of a video up with its ASR sentences
+// before the media of the scenes is generated. assetPath is where the media
+// of a scene is stored: a scene whose media is already there (e.g. from an
+// interrupted run) is ready, every other one is pending
+func syncScenes(video *models.Video, sentences []ASRSentences, assetPath func(index int) string) ([]models.Scene, error) {
+	existing, err := GetScenesByVideo(video.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	byIndex := map[int]models.Scene{}
+	for _, scene := range existing {
+		byIndex[scene.SceneIndex] = scene
+	}
+
+	var scenes []models.Scene
+	for i, sentence := range sentences {
+		scene, ok := byIndex[i]
+		if !ok {
+			scene = models.Scene{VideoID: video.ID, SceneIndex: i}
+		}
+
+		scene.Sentence = strings.TrimSpace(sentence.Text)
+		scene.Start = asrSeconds(sentence.Start)
+		scene.End = asrSeconds(sentence.End)
+		scene.Words = sceneWords(sentence)
+
+		path := assetPath(i)
+		if fileExists(path) {
+			scene.AssetPath = videoArtifactKey(path)
+			scene.Status = models.SceneStatusReady
+			scene.Error = ""
+		} else {
+			scene.Prompt = ""
+			scene.Provider = ""
+			scene.Seed = nil
+			scene.Version = 0
+			scene.AssetPath = ""
+			scene.Status = models.SceneStatusPending
+			scene.Error = ""
+		}
+
+		scenes = append(scenes, scene)
+	}
+
+	if err := SetScenes(video.ID, scenes); err != nil {
+		return nil, err
+	}
+
+	return scenes, nil
+}
+
+// finishScene records the media generated for a scene, or why it failed.
+// assetPath is the file in the work dir, the scene keeps its blob key
+func finishScene(scene *models.Scene, assetPath string, sceneErr error) {
+	if sceneErr != nil {
+		scene.Status = models.SceneStatusFailed
+		scene.Error = sceneErr.Error()
+	} else {
+		scene.Status = models.SceneStatusReady
+		scene.AssetPath = videoArtifactKey(assetPath)
+		scene.Error = ""
+	}
+
+	if _, err := SetScene(scene); err != nil {
+		log.Printf("[ERROR] Error saving scene %d of video %s: %v", scene.SceneIndex+1, scene.VideoID, err)
+	}
+}
+
+// addSceneVersion stores the image as the next version of the scene and
+// returns the version. The image the scene is rendered with isn't touched
+func addSceneVersion(ctx context.Context, scene *models.Scene, imageData []byte, prompt string, style string, provider string, seed *int) (*models.SceneVersion, error) {
+	versions, err := GetSceneVersions(scene.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	next := 1
+	if len(versions) > 0 {
+		next = versions[0].Version + 1
+	}
+
+	assetPath := getSceneVersionPath(scene.VideoID, scene.SceneIndex, next)
+	if err := os.MkdirAll(filepath.Dir(assetPath), 0755); err != nil {
+		return nil, fmt.Errorf("error creating versions folder: %v", err)
+	}
+
+	if err := ioutil.WriteFile(assetPath, imageData, 0644); err != nil {
+		return nil, fmt.Errorf("error saving scene version: %v", err)
+	}
+
+	key, err := storeVideoArtifact(ctx, assetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateSceneVersion(&models.SceneVersion{
+		SceneID:   scene.ID,
+		VideoID:   scene.VideoID,
+		Version:   next,
+		Prompt:    prompt,
+		Style:     style,
+		Provider:  provider,
+		Seed:      seed,
+		AssetPath: key,
+	})
+}
+
+// useSceneVersion makes the scene render with the given version
+func useSceneVersion(ctx context.Context, scene *models.Scene, version *models.SceneVersion) error {
+	versionPath, err := fetchVideoArtifact(ctx, version.AssetPath)
+	if err != nil {
+		return err
+	}
+
+	imageData, err := ioutil.ReadFile(versionPath)
+	if err != nil {
+		return fmt.Errorf("error reading scene version %d: %v", version.Version, err)
+	}
+
+	assetPath := getSceneImagePath(scene.VideoID, scene.SceneIndex)
+	if err := os.MkdirAll(filepath.Dir(assetPath), 0755); err != nil {
+		return fmt.Errorf("error creating images folder: %v", err)
+	}
+
+	if err := ioutil.WriteFile(assetPath, imageData, 0644); err != nil {
+		return fmt.Errorf("error saving scene image: %v", err)
+	}
+
+	if _, err := storeVideoArtifact(ctx, assetPath); err != nil {
+		return err
+	}
+
+	scene.Prompt = version.Prompt
+	scene.Provider = version.Provider
+	scene.Seed = version.Seed
+	scene.Version = version.Version
+	finishScene(scene, assetPath, nil)
+
+	return nil
+}
+
+// regenerateScene generates a new image for a single scene, optionally from
+// a custom prompt or in another style, and keeps the previous image as a
+// version so the scene can be rolled back. Without a seed a random one is
+// used, the style's seed would give the same image for the same prompt
+func regenerateScene(ctx context.Context, video *models.Video, index int, customPrompt string, style string, seed *int) (*models.Scene, error) {
+	// the subtitles and images may only be in the store
+	if err := restoreVideoFolder(ctx, video.ID); err != nil {
+		return nil, err
+	}
+
+	scene, err := GetSceneByIndex(video.ID, index)
+	if err != nil {
+		return nil, fmt.Errorf("error getting scene %d: %v", index+1, err)
+	}
+
+	if style == "" {
+		style = video.VideoStyle
+	}
+
+	// the image the scene had before its first regeneration is kept as version 1
+	if scene.Version == 0 && scene.Status == models.SceneStatusReady {
+		imagePath, err := fetchVideoArtifact(ctx, scene.AssetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		imageData, err := ioutil.ReadFile(imagePath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading scene image: %v", err)
+		}
+
+		original, err := addSceneVersion(ctx, scene, imageData, scene.Prompt, video.VideoStyle, scene.Provider, scene.Seed)
+		if err != nil {
+			return nil, err
+		}
+
+		scene.Version = original.Version
+		if _, err := SetScene(scene); err != nil {
+			return nil, err
+		}
+	}
+
+	prompt := strings.TrimSpace(customPrompt)
+	if prompt == "" {
+		asr, err := readASRForVideo(video.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		sentences := SplitScriptASRIntoSentences(asr.Sentences)
+		if index >= len(sentences) {
+			return nil, fmt.Errorf("scene %d is out of range", index+1)
+		}
+
+		lastSentence := ""
+		if len(sentences) > 1 {
+			lastSentence = sentences[len(sentences)-1]
+		}
+
+		styled := *video
+		styled.VideoStyle = style
+
+		prompt, err = generateDallEPromptForSentence(ctx, openai.NewClient(OPENAI_API_KEY), sentences[index], &styled, lastSentence)
+		if err != nil {
+			return nil, fmt.Errorf("error generating prompt for scene %d: %v", index+1, err)
+		}
+	}
+
+	imageParams := GetImageParamsForStyle(style)
+	if seed == nil {
+		randomSeed := int(rand.Int31())
+		seed = &randomSeed
+	}
+	imageParams.Seed = seed
+
+	imageData, provider, err := generateImageWithFallback(ctx, GetImageProvidersForUser(video.OwnerID), prompt, imageParams)
+	if err != nil {
+		return nil, fmt.Errorf("error generating image for scene %d: %v", index+1, err)
+	}
+
+	if !imageProviderUsesSeed(provider) {
+		seed = nil
+	}
+
+	version, err := addSceneVersion(ctx, scene, imageData, prompt, style, provider, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := useSceneVersion(ctx, scene, version); err != nil {
+		return nil, err
+	}
+
+	log.Printf("[INFO] Regenerated scene %d of video %s (version %d)", index+1, video.ID, version.Version)
+
+	PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventScene, Stage: StageImages, Progress: video.Progress, Scene: index + 1})
+
+	return scene, nil
+}
+
+// RollbackScene brings back an earlier version of a scene. The video has to
+// be stitched again afterwards
+func RollbackScene(ctx context.Context, video *models.Video, index int, version int) (*models.Scene, error) {
+	scene, err := GetSceneByIndex(video.ID, index)
+	if err != nil {
+		return nil, err
+	}
+
+	sceneVersion, err := GetSceneVersion(scene.ID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := useSceneVersion(ctx, scene, sceneVersion); err != nil {
+		return nil, err
+	}
+
+	return scene, nil
+}
@@ -0,0 +1,265 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	schedulerInterval = time.Minute
+
+	// how many of the last topics of a schedule aren't used again
+	recentTopicsKept = 10
+
+	topicGenerationAttempts = 3
+)
+
+// NextScheduleRun returns when the schedule ticks next after the given time
+func NextScheduleRun(schedule *models.Schedule, after time.Time) (time.Time, error) {
+	cron, err := ParseCron(schedule.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	location, err := time.LoadLocation(schedule.Timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timezone %s: %v", schedule.Timezone, err)
+	}
+
+	next := cron.Next(after.In(location))
+	if next.IsZero() {
+		return next, fmt.Errorf("cron expression %s never runs", schedule.Cron)
+	}
+	return next, nil
+}
+
+// StartScheduler creates the videos of the due schedules every minute.
+// Like the job workers it can run on several servers at once
+func StartScheduler() {
+	log.Printf("[INFO] Starting scheduler")
+
+	go func() {
+		for {
+			runDueSchedules()
+			time.Sleep(schedulerInterval)
+		}
+	}()
+}
+
+func runDueSchedules() {
+	for {
+		schedule, err := claimDueSchedule()
+		if err != nil {
+			log.Printf("[ERROR] Error claiming schedule: %v", err)
+			return
+		}
+
+		if schedule == nil {
+			return
+		}
+
+		runSchedule(schedule)
+	}
+}
+
+// claimDueSchedule locks a due schedule and moves it to its next tick. Ticks
+// missed while the server was down are skipped rather than run in a burst
+func claimDueSchedule() (*models.Schedule, error) {
+	var claimed *models.Schedule
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		schedule := new(models.Schedule)
+		now := time.Now()
+
+		txn := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("enabled = ? AND next_run_at <= ?", true, now).
+			Order("next_run_at asc").
+			Limit(1).
+			Find(schedule)
+		if txn.Error != nil {
+			return txn.Error
+		}
+
+		if txn.RowsAffected == 0 {
+			return nil
+		}
+
+		// only the columns of the tick are written, an edit of the schedule
+		// made meanwhile isn't overwritten
+		next, err := NextScheduleRun(schedule, now)
+		if err != nil {
+			log.Printf("[ERROR] Disabling schedule %s: %v", schedule.ID, err)
+			return tx.Model(schedule).Updates(map[string]interface{}{
+				"enabled":     false,
+				"next_run_at": nil,
+				"last_error":  err.Error(),
+			}).Error
+		}
+
+		if err := tx.Model(schedule).Updates(map[string]interface{}{
+			"next_run_at": next,
+			"last_run_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		claimed = schedule
+		return nil
+	})
+
+	return claimed, err
+}
+
+func runSchedule(schedule *models.Schedule) {
+	video, err := createScheduledVideo(schedule)
+
+	updates := map[string]interface{}{"recent_topics": schedule.RecentTopics, "last_error": ""}
+	if err != nil {
+		log.Printf("[ERROR] Error running schedule %s: %v", schedule.ID, err)
+		updates["last_error"] = err.Error()
+	} else {
+		log.Printf("[INFO] Schedule %s created video %s about '%s'", schedule.ID, video.ID, video.Topic)
+	}
+
+	txn := db.DB.Model(&models.Schedule{}).Where("id = ?", schedule.ID).Updates(updates)
+	if txn.Error != nil {
+		log.Printf("[ERROR] Error saving schedule %s: %v", schedule.ID, txn.Error)
+	}
+}
+
+// createScheduledVideo creates and enqueues a video with the defaults of the
+// schedule and a topic it didn't use recently
+func createScheduledVideo(schedule *models.Schedule) (*models.Video, error) {
+	topic, err := pickScheduleTopic(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	video, err := SetVideo(&models.Video{
+		Topic:           topic,
+		Description:     schedule.Description,
+		Narrator:        schedule.Narrator,
+		VideoStyle:      schedule.VideoStyle,
+		VideoTheme:      schedule.VideoTheme,
+		BackgroundMusic: schedule.BackgroundMusic,
+		CaptionStyle:    schedule.CaptionStyle,
+		CaptionPosition: schedule.CaptionPosition,
+		Languages:       schedule.Languages,
+		LoudnessTarget:  schedule.LoudnessTarget,
+		TransitionSFX:   schedule.TransitionSFX,
+		MediaType:       schedule.MediaType,
+		ScriptProvider:  schedule.ScriptProvider,
+		PostingMethod:   schedule.PostingMethod,
+		IsOneTime:       false,
+		ScheduleID:      schedule.ID,
+		OwnerID:         schedule.OwnerID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating video: %v", err)
+	}
+
+	schedule.RecentTopics = append(schedule.RecentTopics, topic)
+	if len(schedule.RecentTopics) > recentTopicsKept {
+		schedule.RecentTopics = schedule.RecentTopics[len(schedule.RecentTopics)-recentTopicsKept:]
+	}
+
+	if _, err := EnqueueCreateVideo(video.ID, ""); err != nil {
+		return nil, fmt.Errorf("error enqueueing video: %v", err)
+	}
+
+	return video, nil
+}
+
+func isRecentTopic(schedule *models.Schedule, topic string) bool {
+	for _, recent := range schedule.RecentTopics {
+		if strings.EqualFold(strings.TrimSpace(recent), strings.TrimSpace(topic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickScheduleTopic picks a random topic of the pool that wasn't used
+// recently. Once the pool is used up the topic is generated from the prompt,
+// or, without a prompt, the pool topic used the longest time ago is reused
+func pickScheduleTopic(schedule *models.Schedule) (string, error) {
+	var fresh []string
+	for _, topic := range schedule.TopicPool {
+		if strings.TrimSpace(topic) != "" && !isRecentTopic(schedule, topic) {
+			fresh = append(fresh, topic)
+		}
+	}
+
+	if len(fresh) > 0 {
+		return fresh[rand.Intn(len(fresh))], nil
+	}
+
+	if strings.TrimSpace(schedule.TopicPrompt) != "" {
+		return generateScheduleTopic(schedule)
+	}
+
+	for _, recent := range schedule.RecentTopics {
+		for _, topic := range schedule.TopicPool {
+			if strings.EqualFold(strings.TrimSpace(recent), strings.TrimSpace(topic)) {
+				return topic, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("schedule has neither topics nor a topic prompt")
+}
+
+// generateScheduleTopic asks the LLM for a new topic following the prompt of
+// the schedule, telling it which topics were used recently
+func generateScheduleTopic(schedule *models.Schedule) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	client := openai.NewClient(OPENAI_API_KEY)
+
+	instructions := "You come up with the topic of the next short-form video of a channel. Reply with the topic only: a single line, no quotes, no numbering."
+	if len(schedule.RecentTopics) > 0 {
+		instructions += "\n\nThese topics were used recently, pick something different:\n- " + strings.Join(schedule.RecentTopics, "\n- ")
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < topicGenerationAttempts; attempt++ {
+		resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+			Model: openai.GPT4oMini,
+			Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: instructions},
+				{Role: openai.ChatMessageRoleUser, Content: schedule.TopicPrompt},
+			},
+		})
+		if err != nil {
+			lastErr = fmt.Errorf("error generating topic: %v", err)
+			continue
+		}
+
+		if len(resp.Choices) == 0 {
+			lastErr = fmt.Errorf("no topic returned")
+			continue
+		}
+
+		topic := strings.Trim(strings.TrimSpace(resp.Choices[0].Message.Content), `"`)
+		if topic == "" || isRecentTopic(schedule, topic) {
+			lastErr = fmt.Errorf("generated topic '%s' was empty or used recently", topic)
+			continue
+		}
+
+		return topic, nil
+	}
+
+	return "", lastErr
+}
@@ -0,0 +1,162 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	ScriptProviderAnthropic = "anthropic"
+	ScriptProviderOpenAI    = "openai"
+	ScriptProviderGemini    = "gemini"
+)
+
+type GeneratedScript struct {
+	Topic   string
+	Script  string
+	Essence string
+}
+
+// ScriptWriter turns the topic and description given by the user into a
+// cleaned topic, the narration script and a short essence for stock footage
+type ScriptWriter interface {
+	Name() string
+	WriteScript(ctx context.Context, topic, description string) (*GeneratedScript, error)
+}
+
+type anthropicScriptWriter struct{}
+
+func (w anthropicScriptWriter) Name() string { return ScriptProviderAnthropic }
+
+func (w anthropicScriptWriter) WriteScript(ctx context.Context, topic, description string) (*GeneratedScript, error) {
+	cleanedTopic, script, essence, err := GenerateScriptClaude(ctx, topic, description)
+	if err != nil {
+		return nil, err
+	}
+	return &GeneratedScript{Topic: cleanedTopic, Script: script, Essence: essence}, nil
+}
+
+type openAIScriptWriter struct{}
+
+func (w openAIScriptWriter) Name() string { return ScriptProviderOpenAI }
+
+func (w openAIScriptWriter) WriteScript(ctx context.Context, topic, description string) (*GeneratedScript, error) {
+	cleanedTopic, script, essence, err := processContent(ctx, openai.NewClient(OPENAI_API_KEY), topic, description)
+	if err != nil {
+		return nil, err
+	}
+	return &GeneratedScript{Topic: cleanedTopic, Script: script, Essence: essence}, nil
+}
+
+type geminiScriptWriter struct{}
+
+func (w geminiScriptWriter) Name() string { return ScriptProviderGemini }
+
+func (w geminiScriptWriter) WriteScript(ctx context.Context, topic, description string) (*GeneratedScript, error) {
+	cleanedTopic, script, essence, err := processContentGemini(ctx, topic, description)
+	if err != nil {
+		return nil, err
+	}
+	return &GeneratedScript{Topic: cleanedTopic, Script: script, Essence: essence}, nil
+}
+
+var scriptWriters = map[string]ScriptWriter{
+	ScriptProviderAnthropic: anthropicScriptWriter{},
+	ScriptProviderOpenAI:    openAIScriptWriter{},
+	ScriptProviderGemini:    geminiScriptWriter{},
+}
+
+func IsValidScriptProvider(provider string) bool {
+	_, ok := scriptWriters[provider]
+	return ok
+}
+
+// defaultScriptProviders is the fallback chain, configurable through
+// SCRIPT_PROVIDERS (e.g. "anthropic,openai,gemini")
+func defaultScriptProviders() []string {
+	providers := []string{ScriptProviderAnthropic, ScriptProviderOpenAI, ScriptProviderGemini}
+
+	if value := os.Getenv("SCRIPT_PROVIDERS"); value != "" {
+		providers = []string{}
+		for _, provider := range strings.Split(value, ",") {
+			provider = strings.TrimSpace(provider)
+			if IsValidScriptProvider(provider) {
+				providers = append(providers, provider)
+			} else {
+				log.Printf("[ERROR] Unknown script provider in SCRIPT_PROVIDERS: %s", provider)
+			}
+		}
+	}
+
+	// dev mode prefers the free tier of Gemini
+	if isDevMode() {
+		providers = append([]string{ScriptProviderGemini}, providers...)
+	}
+
+	return providers
+}
+
+// scriptProvidersForVideo orders the providers to try for a video: the one
+// picked for the video, then the one preferred by its owner, then the defaults
+func scriptProvidersForVideo(video *models.Video) []string {
+	candidates := []string{video.ScriptProvider, video.Owner.ScriptProvider}
+	candidates = append(candidates, defaultScriptProviders()...)
+
+	var providers []string
+	for _, provider := range candidates {
+		if provider == "" || !IsValidScriptProvider(provider) || Contains(providers, provider) {
+			continue
+		}
+		providers = append(providers, provider)
+	}
+	return providers
+}
+
+// WriteScriptForVideo tries each script provider in order until one succeeds
+// and returns the script along with the provider that wrote it
+func WriteScriptForVideo(ctx context.Context, video *models.Video) (*GeneratedScript, string, error) {
+	var errors []string
+
+	for _, provider := range scriptProvidersForVideo(video) {
+		log.Printf("[INFO] Writing script for video %s with %s", video.ID, provider)
+
+		script, err := scriptWriters[provider].WriteScript(ctx, video.Topic, video.Description)
+		if err == nil {
+			err = validateGeneratedScript(script)
+		}
+		if err == nil {
+			return script, provider, nil
+		}
+
+		// don't fall back to the next provider for a cancelled video
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+
+		log.Printf("[ERROR] Script provider %s failed: %v", provider, err)
+		errors = append(errors, fmt.Sprintf("%s: %v", provider, err))
+	}
+
+	return nil, "", fmt.Errorf("all script providers failed: %s", strings.Join(errors, "; "))
+}
+
+// validateGeneratedScript rejects a reply that parsed but left a field empty,
+// the video would go on to TTS with nothing to say
+func validateGeneratedScript(script *GeneratedScript) error {
+	switch {
+	case script == nil || strings.TrimSpace(script.Script) == "":
+		return fmt.Errorf("empty script")
+	case strings.TrimSpace(script.Topic) == "":
+		return fmt.Errorf("empty topic")
+	case strings.TrimSpace(script.Essence) == "":
+		return fmt.Errorf("empty essence")
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	models "go-authentication-boilerplate/models"
+)
+
+type fakeScriptWriter struct {
+	name   string
+	script *GeneratedScript
+	calls  *[]string
+}
+
+func (w fakeScriptWriter) Name() string { return w.name }
+
+func (w fakeScriptWriter) WriteScript(ctx context.Context, topic, description string) (*GeneratedScript, error) {
+	*w.calls = append(*w.calls, w.name)
+	return w.script, nil
+}
+
+func TestWriteScriptForVideoFallsBackOnEmptyScripts(t *testing.T) {
+	valid := &GeneratedScript{Topic: "The deep sea", Script: "Down there it is dark.", Essence: "deep sea"}
+
+	tests := []struct {
+		name      string
+		anthropic *GeneratedScript
+		openai    *GeneratedScript
+		provider  string
+		err       string
+	}{
+		{name: "first provider", anthropic: valid, openai: valid, provider: ScriptProviderAnthropic},
+		{name: "blank script", anthropic: &GeneratedScript{Topic: "The deep sea", Script: "  ", Essence: "deep sea"}, openai: valid, provider: ScriptProviderOpenAI},
+		{name: "empty topic", anthropic: &GeneratedScript{Script: "Down there it is dark.", Essence: "deep sea"}, openai: valid, provider: ScriptProviderOpenAI},
+		{name: "empty essence", anthropic: &GeneratedScript{Topic: "The deep sea", Script: "Down there it is dark."}, openai: valid, provider: ScriptProviderOpenAI},
+		{name: "no script", anthropic: nil, openai: valid, provider: ScriptProviderOpenAI},
+		{name: "all empty", anthropic: &GeneratedScript{}, openai: &GeneratedScript{}, err: "anthropic: empty script; openai: empty script"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SCRIPT_PROVIDERS", "anthropic,openai")
+			t.Setenv("USE_GEMINI", "")
+
+			var calls []string
+			writers := scriptWriters
+			scriptWriters = map[string]ScriptWriter{
+				ScriptProviderAnthropic: fakeScriptWriter{name: ScriptProviderAnthropic, script: tt.anthropic, calls: &calls},
+				ScriptProviderOpenAI:    fakeScriptWriter{name: ScriptProviderOpenAI, script: tt.openai, calls: &calls},
+			}
+			t.Cleanup(func() { scriptWriters = writers })
+
+			script, provider, err := WriteScriptForVideo(context.Background(), &models.Video{Topic: "deep sea"})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("WriteScriptForVideo() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("WriteScriptForVideo() error = %v", err)
+			}
+			if provider != tt.provider || script != valid {
+				t.Errorf("WriteScriptForVideo() = %+v, %s, want the script of %s (calls %v)", script, provider, tt.provider, calls)
+			}
+		})
+	}
+}
@@ -1,35 +1,81 @@
 package util
 
 import (
+	"context"
 	"encoding/base64"
 	"os"
 	"strings"
 	"bufio"
+	"time"
 )
 
+// ASRSentences is a sentence of the narration as returned by the ASR service.
+// Start and End are in milliseconds
 type ASRSentences struct {
 	End float64 `json:"end"`
 	Start float64 `json:"start"`
 	Text string `json:"text"`
+	// only there when the ASR service returned word timestamps
+	Words []ASRWord `json:"words,omitempty"`
+}
+
+// ASRWord is a word of a sentence, Start and End in milliseconds
+type ASRWord struct {
+	End float64 `json:"end"`
+	Start float64 `json:"start"`
+	Text string `json:"text"`
 }
 
 type ASR struct {
 	Sentences []ASRSentences `json:"sentences"`
+	// the timings weren't measured but estimated from the script, see estimateASR
+	Estimated bool `json:"estimated,omitempty"`
+}
+
+// asrSeconds converts an ASR timestamp to seconds
+func asrSeconds(ms float64) float64 {
+	return ms / 1000
+}
+
+type PexelsVideoFile struct {
+	Link     string `json:"link"`
+	Quality  string `json:"quality"`
+	FileType string `json:"file_type"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
 }
 
 type PexelsVideo struct {
-	Duration   int `json:"duration"`
-	VideoFiles []struct {
-		Link     string `json:"link"`
-		Quality  string `json:"quality"`
-		FileType string `json:"file_type"`
-	} `json:"video_files"`
+	ID       int    `json:"id"`
+	URL      string `json:"url"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Duration int    `json:"duration"`
+	User     struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	} `json:"user"`
+	VideoFiles []PexelsVideoFile `json:"video_files"`
 }
 
 type PexelsResponse struct {
 	Videos []PexelsVideo `json:"videos"`
 }
 
+// sleepContext waits for d, or less if ctx is cancelled. It reports whether
+// the full duration elapsed
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func isDevMode() bool {
 	return os.Getenv("USE_GEMINI") == "true"
 }
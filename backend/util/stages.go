@@ -0,0 +1,216 @@
+package util
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	models "go-authentication-boilerplate/models"
+)
+
+// the stages of CreateVideo, in the order they run
+const (
+	StageScript = "script"
+	StageTTS    = "tts"
+	StageSRT    = "srt"
+	StageImages = "images"
+	// the mix of narration, music and effects, normalized to the loudness target
+	StageMaster = "master"
+	StageStitch = "stitch"
+	// the language variants, only for videos with Languages
+	StageLocalize = "localize"
+)
+
+var VideoStages = []string{StageScript, StageTTS, StageSRT, StageImages, StageMaster, StageStitch, StageLocalize}
+
+func IsValidVideoStage(stage string) bool {
+	return Contains(VideoStages, stage)
+}
+
+func stageIndex(stage string) int {
+	for i, s := range VideoStages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func getAudioFilePath(videoID string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "audio", "full_audio.mp3")
+}
+
+func getSubtitlesFilePath(videoID string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "subtitles", "subtitles.json")
+}
+
+// isVideoStageComplete checks both the flag on the video and, where there is
+// one, that the artifact of the stage is still on disk
+func isVideoStageComplete(video *models.Video, stage string) bool {
+	switch stage {
+	case StageScript:
+		return video.ScriptGenerated && video.Script != ""
+	case StageTTS:
+		return video.TTSGenerated && fileExists(getAudioFilePath(video.ID))
+	case StageSRT:
+		return video.SRTGenerated && fileExists(getSubtitlesFilePath(video.ID))
+	case StageImages:
+		return video.DALLEGenerated
+	case StageMaster:
+		return video.AudioMastered && fileExists(getMasteredAudioPath(video.ID))
+	case StageStitch:
+		return video.VideoStitched && video.StitchedVideoURL != ""
+	case StageLocalize:
+		return variantsReady(video)
+	}
+	return false
+}
+
+// variantsReady tells whether there is a finished variant for every language
+// of the video
+func variantsReady(video *models.Video) bool {
+	if len(video.Languages) == 0 {
+		return true
+	}
+
+	variants, err := GetVideoVariants(video.ID)
+	if err != nil {
+		return false
+	}
+
+	ready := 0
+	for _, variant := range variants {
+		if Contains(video.Languages, variant.Language) && variant.Status == models.VariantStatusReady && variant.VideoURL != "" {
+			ready++
+		}
+	}
+	return ready == len(video.Languages)
+}
+
+// firstIncompleteStage returns the stage CreateVideo has to start from.
+// Everything after an incomplete stage is considered stale
+func firstIncompleteStage(video *models.Video) string {
+	for _, stage := range VideoStages {
+		if !isVideoStageComplete(video, stage) {
+			return stage
+		}
+	}
+	return ""
+}
+
+// resetVideoFromStage clears the flags of the given stage and every stage
+// after it. Artifacts of later stages are removed since they were built from
+// stale inputs. The artifacts of the starting stage itself are only removed
+// when forced, so a partially finished stage (e.g. half the images) can be reused
+func resetVideoFromStage(video *models.Video, fromStage string, force bool) error {
+	start := stageIndex(fromStage)
+	if start < 0 {
+		return nil
+	}
+
+	folderPath := getVideoFolderPath(video.ID)
+
+	for i, stage := range VideoStages[start:] {
+		removeArtifacts := force || i > 0
+
+		switch stage {
+		case StageScript:
+			video.ScriptGenerated = false
+			// a new script of a draft has to be reviewed again
+			video.ScriptApproved = false
+		case StageTTS:
+			video.TTSGenerated = false
+			video.TTSURL = ""
+			if removeArtifacts {
+				removeStageFolder(filepath.Join(folderPath, "audio"))
+			}
+		case StageSRT:
+			video.SRTGenerated = false
+			video.SRTURL = ""
+			video.TimingsEstimated = false
+			if removeArtifacts {
+				removeStageFolder(filepath.Join(folderPath, "subtitles"))
+			}
+		case StageImages:
+			video.DALLEPromptGenerated = false
+			video.DALLEGenerated = false
+			if removeArtifacts {
+				removeStageFolder(filepath.Join(folderPath, "images"))
+				removeStageFolder(getClipsFolderPath(video.ID))
+				if err := DeleteScenesByVideo(video.ID); err != nil {
+					return err
+				}
+			}
+		case StageMaster:
+			video.AudioMastered = false
+			video.MasteredAudioURL = ""
+			if removeArtifacts {
+				removeStageFolder(filepath.Dir(getMasteredAudioPath(video.ID)))
+			}
+		case StageStitch:
+			video.VideoStitched = false
+			video.VideoUploaded = false
+			video.VideoURL = ""
+			video.StitchedVideoURL = ""
+			removeStageFolder(filepath.Dir(getStitchedVideoPath(video.ID)))
+		case StageLocalize:
+			// failed variants are retried either way, ready ones are only
+			// made again when they are stale
+			if removeArtifacts {
+				removeStageFolder(filepath.Join(folderPath, "languages"))
+				if err := DeleteVideoVariants(video.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	video.Progress = stageProgress(fromStage)
+	return nil
+}
+
+// discardIncompleteStages removes the partial artifacts of the stage that
+// was interrupted and of everything after it. Completed stages are kept so
+// the video can still be resumed
+func discardIncompleteStages(video *models.Video) error {
+	if stage := firstIncompleteStage(video); stage != "" {
+		return resetVideoFromStage(video, stage, true)
+	}
+	return nil
+}
+
+// removeStageFolder deletes a folder of the work dir along with its stored copy
+func removeStageFolder(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		log.Printf("[ERROR] Error deleting folder: %v", err)
+	}
+
+	if err := deleteBlobPrefix(context.Background(), blobStore, videoArtifactKey(path)+"/"); err != nil {
+		log.Printf("[ERROR] Error deleting stored artifacts of %s: %v", path, err)
+	}
+}
+
+// stageProgress is the progress of a video right before the stage starts
+func stageProgress(stage string) int {
+	switch stage {
+	case StageTTS:
+		return 10
+	case StageSRT:
+		return 30
+	case StageImages:
+		return 50
+	case StageMaster:
+		return 80
+	case StageStitch:
+		return 85
+	case StageLocalize:
+		return 90
+	}
+	return 0
+}
@@ -0,0 +1,500 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const pexelsLicense = "Pexels License (https://www.pexels.com/license/)"
+
+func getClipsFolderPath(videoID string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "clips")
+}
+
+func getStockClipPath(videoID string, index int) string {
+	return filepath.Join(getClipsFolderPath(videoID), fmt.Sprintf("clip_%d.mp4", index+1))
+}
+
+// stockClipPaths returns the prepared clips of a video, and whether there is
+// one for every sentence
+func stockClipPaths(videoID string, numSentences int) ([]string, bool) {
+	var paths []string
+	for i := 0; i < numSentences; i++ {
+		path := getStockClipPath(videoID, i)
+		if !fileExists(path) {
+			return nil, false
+		}
+		paths = append(paths, path)
+	}
+	return paths, numSentences > 0
+}
+
+// pickPexelsVideoFile picks the mp4 rendition that is closest to (but ideally
+// not smaller than) the output height, preferring portrait files
+func pickPexelsVideoFile(video PexelsVideo) (*PexelsVideoFile, error) {
+	var best *PexelsVideoFile
+	bestScore := 0
+
+	for i := range video.VideoFiles {
+		file := &video.VideoFiles[i]
+		if file.FileType != "video/mp4" || file.Link == "" {
+			continue
+		}
+
+		longSide := file.Height
+		if file.Width > longSide {
+			longSide = file.Width
+		}
+
+		// penalise renditions that would have to be upscaled, prefer portrait ones
+		score := 100000 - abs(longSide-outputHeight)
+		if longSide < outputHeight {
+			score -= 50000
+		}
+		if file.Height > file.Width {
+			score += 1000
+		}
+
+		if best == nil || score > bestScore {
+			best = file
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no mp4 file for Pexels video %d", video.ID)
+	}
+	return best, nil
+}
+
+// stockMatch is the clip picked for a sentence and why
+type stockMatch struct {
+	Video PexelsVideo
+	Query string
+	Score float64
+}
+
+var stockQueryStopWords = map[string]bool{
+	"a": true, "an": true, "the": true, "and": true, "or": true, "but": true, "if": true, "of": true,
+	"to": true, "in": true, "on": true, "at": true, "by": true, "for": true, "with": true, "from": true,
+	"is": true, "are": true, "was": true, "were": true, "be": true, "been": true, "it": true, "its": true,
+	"this": true, "that": true, "these": true, "those": true, "you": true, "your": true, "we": true,
+	"our": true, "they": true, "their": true, "he": true, "she": true, "his": true, "her": true,
+	"i": true, "me": true, "my": true, "so": true, "just": true, "like": true, "can": true, "will": true,
+	"what": true, "when": true, "how": true, "why": true, "who": true, "into": true, "about": true,
+	"than": true, "then": true, "there": true, "here": true, "have": true, "has": true, "had": true,
+	"do": true, "does": true, "did": true, "not": true, "no": true, "yes": true, "all": true, "more": true,
+}
+
+// keywordStockQuery builds a search query out of the longest meaningful words
+// of a sentence. It is the fallback when the LLM can't generate the queries
+func keywordStockQuery(sentence string, essence string) string {
+	words := strings.FieldsFunc(strings.ToLower(sentence), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+
+	var keywords []string
+	for _, word := range words {
+		if len(word) > 2 && !stockQueryStopWords[word] && !Contains(keywords, word) {
+			keywords = append(keywords, word)
+		}
+	}
+
+	sort.SliceStable(keywords, func(i, j int) bool {
+		return len(keywords[i]) > len(keywords[j])
+	})
+
+	if len(keywords) > 3 {
+		keywords = keywords[:3]
+	}
+
+	if len(keywords) == 0 {
+		return essence
+	}
+	return strings.Join(keywords, " ")
+}
+
+// generateStockQueries asks the LLM for a short, visual search query per
+// sentence, falling back to keyword extraction for the ones it didn't give
+func generateStockQueries(ctx context.Context, client *openai.Client, video *models.Video, sentences []ASRSentences) []string {
+	queries := make([]string, len(sentences))
+
+	var numbered strings.Builder
+	for i, sentence := range sentences {
+		fmt.Fprintf(&numbered, "%d. %s\n", i+1, strings.TrimSpace(sentence.Text))
+	}
+
+	functionDescription := openai.FunctionDefinition{
+		Name:        "generate_stock_queries",
+		Description: "Generate a stock footage search query for each sentence of a video script",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"queries": {
+					"type": "array",
+					"items": {"type": "string"},
+					"description": "One 1-4 word search query per sentence, in the same order. Describe something that can be filmed (objects, places, actions), not abstract ideas."
+				}
+			},
+			"required": ["queries"]
+		}`),
+	}
+
+	resp, err := client.CreateChatCompletion(
+		ctx,
+		openai.ChatCompletionRequest{
+			Model: openai.GPT4oMini,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role:    openai.ChatMessageRoleSystem,
+					Content: "You pick stock footage for short-form videos. For every sentence of the script you write the search query that would find the best matching clip on Pexels.",
+				},
+				{
+					Role:    openai.ChatMessageRoleUser,
+					Content: fmt.Sprintf("Topic: %s\nEssence: %s\n\nSentences:\n%s", video.Topic, video.Essence, numbered.String()),
+				},
+			},
+			Functions: []openai.FunctionDefinition{
+				functionDescription,
+			},
+			FunctionCall: openai.FunctionCall{
+				Name: "generate_stock_queries",
+			},
+		},
+	)
+
+	var result struct {
+		Queries []string `json:"queries"`
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Error generating stock queries, using keywords: %v", err)
+	} else if len(resp.Choices) == 0 || resp.Choices[0].Message.FunctionCall == nil {
+		log.Printf("[ERROR] No stock queries returned, using keywords")
+	} else if err := json.Unmarshal([]byte(resp.Choices[0].Message.FunctionCall.Arguments), &result); err != nil {
+		log.Printf("[ERROR] Error parsing stock queries, using keywords: %v", err)
+	}
+
+	for i, sentence := range sentences {
+		if i < len(result.Queries) && strings.TrimSpace(result.Queries[i]) != "" {
+			queries[i] = strings.TrimSpace(result.Queries[i])
+		} else {
+			queries[i] = keywordStockQuery(sentence.Text, video.Essence)
+		}
+	}
+
+	return queries
+}
+
+func searchPexelsVideos(ctx context.Context, query string, perPage int) ([]PexelsVideo, error) {
+	httpClient := &http.Client{}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://api.pexels.com/videos/search", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", os.Getenv("PEXELS_API_KEY"))
+	req.Header.Set("Accept", "application/json")
+
+	params := url.Values{}
+	params.Add("query", query)
+	params.Add("orientation", "portrait")
+	params.Add("per_page", fmt.Sprintf("%d", perPage))
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Pexels search failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	var pexelsResponse PexelsResponse
+	err = json.Unmarshal(body, &pexelsResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	return pexelsResponse.Videos, nil
+}
+
+// rankPexelsVideo scores a candidate for a sentence between 0 and 1 on how
+// well its duration fits (clips that have to loop score low), its
+// orientation (portrait needs no cropping) and its resolution
+func rankPexelsVideo(video PexelsVideo, sentenceDuration float64) float64 {
+	duration := float64(video.Duration)
+
+	durationFit := 0.0
+	if sentenceDuration <= 0 || duration >= sentenceDuration {
+		// a bit of slack is fine, much longer clips just get trimmed
+		excess := (duration - sentenceDuration) / (sentenceDuration*4 + 1)
+		if excess > 1 {
+			excess = 1
+		}
+		durationFit = 1 - excess*0.3
+	} else {
+		durationFit = 0.5 * duration / sentenceDuration
+	}
+
+	orientation := 0.3
+	if video.Height > video.Width {
+		orientation = 1
+	} else if video.Height == video.Width {
+		orientation = 0.6
+	}
+
+	resolution := 0.0
+	if file, err := pickPexelsVideoFile(video); err == nil {
+		longSide := file.Height
+		if file.Width > longSide {
+			longSide = file.Width
+		}
+		resolution = float64(longSide) / float64(outputHeight)
+		if resolution > 1 {
+			resolution = 1
+		}
+	}
+
+	return 0.5*durationFit + 0.3*orientation + 0.2*resolution
+}
+
+func bestUnusedPexelsVideo(candidates []PexelsVideo, used map[int]bool, sentenceDuration float64) (*PexelsVideo, float64) {
+	var best *PexelsVideo
+	bestScore := -1.0
+
+	for i := range candidates {
+		candidate := &candidates[i]
+		if used[candidate.ID] {
+			continue
+		}
+
+		if _, err := pickPexelsVideoFile(*candidate); err != nil {
+			continue
+		}
+
+		score := rankPexelsVideo(*candidate, sentenceDuration)
+		if score > bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+
+	return best, bestScore
+}
+
+// matchStockClipsToSentences searches Pexels with a query per sentence and
+// picks the best ranked clip for it. A clip is never used twice in a video;
+// when a query runs dry, the essence of the video is searched instead
+func matchStockClipsToSentences(ctx context.Context, client *openai.Client, video *models.Video, sentences []ASRSentences) ([]stockMatch, error) {
+	if len(sentences) == 0 {
+		return nil, fmt.Errorf("no sentences to match clips to")
+	}
+
+	queries := generateStockQueries(ctx, client, video, sentences)
+
+	searchCache := map[string][]PexelsVideo{}
+	search := func(query string) []PexelsVideo {
+		if results, ok := searchCache[query]; ok {
+			return results
+		}
+
+		results, err := searchPexelsVideos(ctx, query, 15)
+		if err != nil {
+			log.Printf("[ERROR] Error searching Pexels for '%s': %v", query, err)
+		}
+
+		searchCache[query] = results
+		return results
+	}
+
+	used := map[int]bool{}
+	var matches []stockMatch
+
+	for i, sentence := range sentences {
+		sentenceDuration := asrSeconds(sentence.End - sentence.Start)
+		query := queries[i]
+
+		best, score := bestUnusedPexelsVideo(search(query), used, sentenceDuration)
+		if best == nil && video.Essence != "" && query != video.Essence {
+			query = video.Essence
+			best, score = bestUnusedPexelsVideo(search(query), used, sentenceDuration)
+		}
+
+		if best == nil {
+			return nil, fmt.Errorf("no unused clip found for sentence %d", i+1)
+		}
+
+		log.Printf("[INFO] Sentence %d: '%s' matched Pexels video %d (score %.2f)", i+1, query, best.ID, score)
+
+		used[best.ID] = true
+		matches = append(matches, stockMatch{Video: *best, Query: query, Score: score})
+	}
+
+	return matches, nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func downloadFile(ctx context.Context, url string, destPath string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading %s: status code %d", url, resp.StatusCode)
+	}
+
+	// write to a temporary file first so an interrupted download is never reused
+	tmpPath := destPath + ".part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing %s: %v", destPath, err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file: %v", err)
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+// prepareStockClip cuts (or loops) a downloaded clip to the given duration and
+// scales and crops it to the vertical output format, without audio
+func prepareStockClip(ctx context.Context, sourcePath string, destPath string, duration float64) error {
+	return runFFmpeg(ctx,
+		"-stream_loop", "-1", "-i", sourcePath,
+		"-t", fmt.Sprintf("%.3f", duration),
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase,crop=%d:%d,setsar=1,fps=%d,format=yuv420p",
+			outputWidth, outputHeight, outputWidth, outputHeight, outputFPS),
+		"-an",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "20",
+		destPath,
+	)
+}
+
+// downloadStockClips downloads the clip matched to every sentence, prepares
+// it for stitching and records the assignment and attribution on the video
+func downloadStockClips(ctx context.Context, video *models.Video, sentences []ASRSentences, matches []stockMatch) error {
+	if len(matches) != len(sentences) {
+		return fmt.Errorf("expected %d clips, got %d", len(sentences), len(matches))
+	}
+
+	audioDuration, err := probeMediaDuration(ctx, getAudioFilePath(video.ID))
+	if err != nil {
+		return err
+	}
+
+	folderPath := getClipsFolderPath(video.ID)
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		return fmt.Errorf("error creating clips folder: %v", err)
+	}
+
+	scenes, err := syncScenes(video, sentences, func(index int) string {
+		return getStockClipPath(video.ID, index)
+	})
+	if err != nil {
+		return fmt.Errorf("error preparing scenes: %v", err)
+	}
+
+	var clips []models.StockClip
+
+	for i, window := range sentenceWindows(sentences, audioDuration) {
+		pexelsVideo := matches[i].Video
+
+		file, err := pickPexelsVideoFile(pexelsVideo)
+		if err != nil {
+			return err
+		}
+
+		scenes[i].Prompt = matches[i].Query
+		scenes[i].Provider = "pexels"
+		scenes[i].Seed = nil
+
+		// a clip that is already on disk (e.g. from an interrupted run) is reused
+		sourcePath := filepath.Join(folderPath, fmt.Sprintf("pexels_%d.mp4", pexelsVideo.ID))
+		if !fileExists(sourcePath) {
+			log.Printf("[INFO] Downloading Pexels video %d for sentence %d", pexelsVideo.ID, i+1)
+			if err := downloadFile(ctx, file.Link, sourcePath); err != nil {
+				finishScene(&scenes[i], "", err)
+				return err
+			}
+		}
+
+		duration := window[1] - window[0]
+		clipPath := getStockClipPath(video.ID, i)
+
+		if err := prepareStockClip(ctx, sourcePath, clipPath, duration); err != nil {
+			finishScene(&scenes[i], "", err)
+			return fmt.Errorf("error preparing clip %d: %v", i+1, err)
+		}
+
+		// only the prepared clip is stored, the Pexels source is scratch
+		clipKey, err := storeVideoArtifact(ctx, clipPath)
+		if err != nil {
+			finishScene(&scenes[i], "", err)
+			return err
+		}
+
+		finishScene(&scenes[i], clipPath, nil)
+
+		clips = append(clips, models.StockClip{
+			SentenceIndex: i,
+			Sentence:      strings.TrimSpace(sentences[i].Text),
+			Query:         matches[i].Query,
+			Score:         matches[i].Score,
+			Provider:      "pexels",
+			ProviderID:    pexelsVideo.ID,
+			PageURL:       pexelsVideo.URL,
+			SourceURL:     file.Link,
+			Author:        pexelsVideo.User.Name,
+			AuthorURL:     pexelsVideo.User.URL,
+			License:       pexelsLicense,
+			Duration:      duration,
+			FilePath:      clipKey,
+		})
+
+		PublishVideoEvent(VideoEvent{VideoID: video.ID, Type: VideoEventScene, Stage: StageImages, Progress: video.Progress, Scene: i + 1, Scenes: len(sentences)})
+	}
+
+	return SetStockClips(video.ID, clips)
+}
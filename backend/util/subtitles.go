@@ -0,0 +1,297 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	SubtitleFormatSRT  = "srt"
+	SubtitleFormatVTT  = "vtt"
+	SubtitleFormatASS  = "ass"
+	SubtitleFormatJSON = "json"
+)
+
+var ErrNoSubtitles = errors.New("the video has no subtitles yet")
+
+// SubtitleOptions are the limits the cues of an exported subtitle file keep
+// to. The defaults follow the usual broadcast guidelines
+type SubtitleOptions struct {
+	MaxLineChars int
+	MaxLines     int
+	MaxDuration  time.Duration
+	MinDuration  time.Duration
+}
+
+var DefaultSubtitleOptions = SubtitleOptions{
+	MaxLineChars: 42,
+	MaxLines:     2,
+	MaxDuration:  7 * time.Second,
+	MinDuration:  time.Second,
+}
+
+// subtitleCue is a caption on screen, times in seconds
+type subtitleCue struct {
+	Index int      `json:"index"`
+	Start float64  `json:"start"`
+	End   float64  `json:"end"`
+	Lines []string `json:"lines"`
+}
+
+// IsValidSubtitleFormat tells whether subtitles can be exported in the format
+func IsValidSubtitleFormat(format string) bool {
+	switch format {
+	case SubtitleFormatSRT, SubtitleFormatVTT, SubtitleFormatASS, SubtitleFormatJSON:
+		return true
+	}
+	return false
+}
+
+// SubtitleContentType is the content type of an exported subtitle file
+func SubtitleContentType(format string) string {
+	switch format {
+	case SubtitleFormatSRT:
+		return "application/x-subrip; charset=utf-8"
+	case SubtitleFormatVTT:
+		return "text/vtt; charset=utf-8"
+	case SubtitleFormatASS:
+		return "text/x-ssa; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// RenderSubtitles renders the stored ASR timings (the SRTURL of a video or
+// of one of its variants) as a subtitle file
+func RenderSubtitles(ctx context.Context, subtitlesKey string, format string, options SubtitleOptions) ([]byte, error) {
+	if subtitlesKey == "" || validBlobKey(subtitlesKey) != nil {
+		return nil, ErrNoSubtitles
+	}
+
+	subtitlesPath, err := fetchVideoArtifact(ctx, subtitlesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	asr, err := readASRFile(subtitlesPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cues := buildSubtitleCues(asr.Sentences, options)
+
+	switch format {
+	case SubtitleFormatSRT:
+		return renderSRT(cues), nil
+	case SubtitleFormatVTT:
+		return renderVTT(cues), nil
+	case SubtitleFormatASS:
+		return renderASS(cues), nil
+	case SubtitleFormatJSON:
+		if cues == nil {
+			cues = []subtitleCue{}
+		}
+		return json.Marshal(cues)
+	}
+	return nil, fmt.Errorf("unknown subtitle format %s", format)
+}
+
+// buildSubtitleCues splits the sentences into cues that fit the line and
+// duration limits. A sentence is split at word boundaries and its time is
+// shared out by the length of the pieces
+func buildSubtitleCues(sentences []ASRSentences, options SubtitleOptions) []subtitleCue {
+	var cues []subtitleCue
+
+	for _, sentence := range sentences {
+		words := strings.Fields(sentence.Text)
+		if len(words) == 0 {
+			continue
+		}
+
+		start := asrSeconds(sentence.Start)
+		end := asrSeconds(sentence.End)
+		if end < start {
+			end = start
+		}
+
+		var pieces [][]string
+		for _, piece := range splitWordsToFit(words, options.MaxLineChars, options.MaxLines) {
+			pieces = append(pieces, splitWordsByDuration(piece, wordsDuration(piece, words, end-start), options.MaxDuration)...)
+		}
+
+		totalChars := 0
+		for _, piece := range pieces {
+			totalChars += utf8.RuneCountInString(strings.Join(piece, " "))
+		}
+
+		cursor := start
+		for i, piece := range pieces {
+			text := strings.Join(piece, " ")
+
+			pieceEnd := end
+			if i < len(pieces)-1 && totalChars > 0 {
+				pieceEnd = cursor + (end-start)*float64(utf8.RuneCountInString(text))/float64(totalChars)
+			}
+
+			cues = append(cues, subtitleCue{
+				Start: cursor,
+				End:   pieceEnd,
+				Lines: strings.Split(wrapCaption(text, options.MaxLineChars), "\n"),
+			})
+			cursor = pieceEnd
+		}
+	}
+
+	for i := range cues {
+		cues[i].Index = i + 1
+
+		if maxDuration := options.MaxDuration.Seconds(); maxDuration > 0 && cues[i].End-cues[i].Start > maxDuration {
+			cues[i].End = cues[i].Start + maxDuration
+		}
+
+		// short cues stay up longer, as long as they don't run into the next one
+		if minDuration := options.MinDuration.Seconds(); cues[i].End-cues[i].Start < minDuration {
+			end := cues[i].Start + minDuration
+			if i < len(cues)-1 && end > cues[i+1].Start {
+				end = math.Max(cues[i].End, cues[i+1].Start)
+			}
+			cues[i].End = end
+		}
+	}
+
+	return cues
+}
+
+// splitWordsToFit groups the words into pieces that wrap to at most maxLines
+// lines of maxLineChars characters. A piece ends early after punctuation when
+// it is already half full, so cues break where the narration pauses
+func splitWordsToFit(words []string, maxLineChars int, maxLines int) [][]string {
+	var pieces [][]string
+	var piece []string
+
+	fits := func(words []string) bool {
+		return len(strings.Split(wrapCaption(strings.Join(words, " "), maxLineChars), "\n")) <= maxLines
+	}
+
+	for _, word := range words {
+		if len(piece) > 0 && !fits(append(piece[:len(piece):len(piece)], word)) {
+			pieces = append(pieces, piece)
+			piece = nil
+		}
+		piece = append(piece, word)
+
+		if strings.ContainsAny(word[len(word)-1:], ",;:.!?") &&
+			utf8.RuneCountInString(strings.Join(piece, " ")) >= maxLineChars*maxLines/2 {
+			pieces = append(pieces, piece)
+			piece = nil
+		}
+	}
+
+	if len(piece) > 0 {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+// wordsDuration estimates how long the piece is spoken, from its share of the
+// characters of the sentence
+func wordsDuration(piece []string, sentence []string, sentenceDuration float64) float64 {
+	sentenceChars := utf8.RuneCountInString(strings.Join(sentence, " "))
+	if sentenceChars == 0 {
+		return 0
+	}
+	return sentenceDuration * float64(utf8.RuneCountInString(strings.Join(piece, " "))) / float64(sentenceChars)
+}
+
+// splitWordsByDuration splits a piece that would stay on screen longer than
+// maxDuration into even pieces
+func splitWordsByDuration(words []string, duration float64, maxDuration time.Duration) [][]string {
+	if maxDuration <= 0 || duration <= maxDuration.Seconds() || len(words) < 2 {
+		return [][]string{words}
+	}
+
+	count := int(math.Ceil(duration / maxDuration.Seconds()))
+	if count > len(words) {
+		count = len(words)
+	}
+
+	var pieces [][]string
+	for i := 0; i < count; i++ {
+		pieces = append(pieces, words[i*len(words)/count:(i+1)*len(words)/count])
+	}
+	return pieces
+}
+
+// formatSubtitleTime formats seconds as HH:MM:SS followed by the separator
+// and the milliseconds
+func formatSubtitleTime(seconds float64, separator string) string {
+	ms := int64(math.Round(seconds * 1000))
+	if ms < 0 {
+		ms = 0
+	}
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+func renderSRT(cues []subtitleCue) []byte {
+	var b bytes.Buffer
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", cue.Index,
+			formatSubtitleTime(cue.Start, ","), formatSubtitleTime(cue.End, ","), strings.Join(cue.Lines, "\n"))
+	}
+	return b.Bytes()
+}
+
+// vttEscaper escapes the characters WebVTT treats as markup
+var vttEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func renderVTT(cues []subtitleCue) []byte {
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&b, "%d\n%s --> %s\n%s\n\n", cue.Index,
+			formatSubtitleTime(cue.Start, "."), formatSubtitleTime(cue.End, "."), vttEscaper.Replace(strings.Join(cue.Lines, "\n")))
+	}
+	return b.Bytes()
+}
+
+// formatASSTime formats seconds as H:MM:SS.cc, ASS only has centiseconds
+func formatASSTime(seconds float64) string {
+	cs := int64(math.Round(seconds * 100))
+	if cs < 0 {
+		cs = 0
+	}
+	return fmt.Sprintf("%d:%02d:%02d.%02d", cs/360000, cs/6000%60, cs/100%60, cs%100)
+}
+
+// assEscaper keeps the text from being read as override tags
+var assEscaper = strings.NewReplacer("\\", "/", "{", "(", "}", ")")
+
+// renderASS renders the cues in the look of the burned in captions: white
+// bold Roboto with a black outline, in the lower third of a vertical video
+func renderASS(cues []subtitleCue) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "[Script Info]\nScriptType: v4.00+\nPlayResX: %d\nPlayResY: %d\nWrapStyle: 2\nScaledBorderAndShadow: yes\n\n", outputWidth, outputHeight)
+
+	b.WriteString("[V4+ Styles]\n")
+	b.WriteString("Format: Name, Fontname, Fontsize, PrimaryColour, SecondaryColour, OutlineColour, BackColour, Bold, Italic, Underline, StrikeOut, ScaleX, ScaleY, Spacing, Angle, BorderStyle, Outline, Shadow, Alignment, MarginL, MarginR, MarginV, Encoding\n")
+	fmt.Fprintf(&b, "Style: Default,Roboto,%d,&H00FFFFFF,&H00FFFFFF,&H00000000,&H00000000,-1,0,0,0,100,100,0,0,1,5,0,2,60,60,%d,1\n\n", captionFontSize, outputHeight*25/100)
+
+	b.WriteString("[Events]\n")
+	b.WriteString("Format: Layer, Start, End, Style, Name, MarginL, MarginR, MarginV, Effect, Text\n")
+	for _, cue := range cues {
+		lines := make([]string, len(cue.Lines))
+		for i, line := range cue.Lines {
+			lines[i] = assEscaper.Replace(line)
+		}
+		fmt.Fprintf(&b, "Dialogue: 0,%s,%s,Default,,0,0,0,,%s\n", formatASSTime(cue.Start), formatASSTime(cue.End), strings.Join(lines, "\\N"))
+	}
+
+	return b.Bytes()
+}
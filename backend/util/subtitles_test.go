@@ -0,0 +1,206 @@
+package util
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatSubtitleTime(t *testing.T) {
+	tests := []struct {
+		seconds   float64
+		separator string
+		want      string
+		wantASS   string
+	}{
+		{0, ",", "00:00:00,000", "0:00:00.00"},
+		{1.5, ".", "00:00:01.500", "0:00:01.50"},
+		{61.25, ",", "00:01:01,250", "0:01:01.25"},
+		{3661.5, ",", "01:01:01,500", "1:01:01.50"},
+		{59.9996, ",", "00:01:00,000", "0:01:00.00"},
+		{0.004, ".", "00:00:00.004", "0:00:00.00"},
+		{-2, ",", "00:00:00,000", "0:00:00.00"},
+	}
+
+	for _, tt := range tests {
+		if got := formatSubtitleTime(tt.seconds, tt.separator); got != tt.want {
+			t.Errorf("formatSubtitleTime(%v, %q) = %q, want %q", tt.seconds, tt.separator, got, tt.want)
+		}
+		if got := formatASSTime(tt.seconds); got != tt.wantASS {
+			t.Errorf("formatASSTime(%v) = %q, want %q", tt.seconds, got, tt.wantASS)
+		}
+	}
+}
+
+func TestSplitWordsToFit(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		maxLineChars int
+		maxLines     int
+		want         [][]string
+	}{
+		{"fits", "one two", 10, 1, [][]string{{"one", "two"}}},
+		{"one line each", "one two three four", 10, 1, [][]string{{"one", "two"}, {"three", "four"}}},
+		{"two lines", "aaaa bbbb cccc dddd eeee", 10, 2, [][]string{{"aaaa", "bbbb", "cccc", "dddd"}, {"eeee"}}},
+		{"breaks after punctuation", "Well, yes no", 10, 1, [][]string{{"Well,"}, {"yes", "no"}}},
+		{"punctuation early in the piece", "Hi, there friend.", 10, 1, [][]string{{"Hi,", "there"}, {"friend."}}},
+		{"word longer than a line", "extraordinarily long", 5, 1, [][]string{{"extraordinarily"}, {"long"}}},
+		{"no words", "", 10, 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitWordsToFit(strings.Fields(tt.text), tt.maxLineChars, tt.maxLines)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitWordsToFit(%q, %d, %d) = %q, want %q", tt.text, tt.maxLineChars, tt.maxLines, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildSubtitleCues(t *testing.T) {
+	defaults := SubtitleOptions{MaxLineChars: 42, MaxLines: 2, MaxDuration: 7 * time.Second, MinDuration: time.Second}
+
+	tests := []struct {
+		name      string
+		sentences []ASRSentences
+		options   SubtitleOptions
+		want      []subtitleCue
+	}{
+		{
+			name:      "one sentence",
+			sentences: []ASRSentences{{Start: 0, End: 2000, Text: "Hello there."}},
+			options:   defaults,
+			want:      []subtitleCue{{Index: 1, Start: 0, End: 2, Lines: []string{"Hello there."}}},
+		},
+		{
+			name: "empty sentences are skipped",
+			sentences: []ASRSentences{
+				{Start: 0, End: 1500, Text: "First."},
+				{Start: 1500, End: 2000, Text: "  "},
+				{Start: 2000, End: 3500, Text: "Second."},
+			},
+			options: defaults,
+			want: []subtitleCue{
+				{Index: 1, Start: 0, End: 1.5, Lines: []string{"First."}},
+				{Index: 2, Start: 2, End: 3.5, Lines: []string{"Second."}},
+			},
+		},
+		{
+			name: "short cue stays up the minimum",
+			sentences: []ASRSentences{
+				{Start: 0, End: 300, Text: "Hi."},
+				{Start: 2000, End: 3000, Text: "Bye."},
+			},
+			options: defaults,
+			want: []subtitleCue{
+				{Index: 1, Start: 0, End: 1, Lines: []string{"Hi."}},
+				{Index: 2, Start: 2, End: 3, Lines: []string{"Bye."}},
+			},
+		},
+		{
+			name: "short cue doesn't run into the next",
+			sentences: []ASRSentences{
+				{Start: 0, End: 300, Text: "Hi."},
+				{Start: 500, End: 2000, Text: "There."},
+			},
+			options: defaults,
+			want: []subtitleCue{
+				{Index: 1, Start: 0, End: 0.5, Lines: []string{"Hi."}},
+				{Index: 2, Start: 0.5, End: 2, Lines: []string{"There."}},
+			},
+		},
+		{
+			name:      "end before start",
+			sentences: []ASRSentences{{Start: 1000, End: 500, Text: "Oops."}},
+			options:   defaults,
+			want:      []subtitleCue{{Index: 1, Start: 1, End: 2, Lines: []string{"Oops."}}},
+		},
+		{
+			name:      "wrapped lines",
+			sentences: []ASRSentences{{Start: 0, End: 2000, Text: "aaaa bbbb cccc"}},
+			options:   SubtitleOptions{MaxLineChars: 10, MaxLines: 2},
+			want:      []subtitleCue{{Index: 1, Start: 0, End: 2, Lines: []string{"aaaa bbbb", "cccc"}}},
+		},
+		{
+			name:      "split by length, time shared by characters",
+			sentences: []ASRSentences{{Start: 0, End: 1900, Text: "aaaa bbbb cccc dddd"}},
+			options:   SubtitleOptions{MaxLineChars: 10, MaxLines: 1},
+			want: []subtitleCue{
+				{Index: 1, Start: 0, End: 0.95, Lines: []string{"aaaa bbbb"}},
+				{Index: 2, Start: 0.95, End: 1.9, Lines: []string{"cccc dddd"}},
+			},
+		},
+		{
+			name:      "split by duration",
+			sentences: []ASRSentences{{Start: 0, End: 8000, Text: "one two three four"}},
+			options:   SubtitleOptions{MaxLineChars: 42, MaxLines: 2, MaxDuration: 2 * time.Second},
+			want: []subtitleCue{
+				{Index: 1, Start: 0, End: 1.6, Lines: []string{"one"}},
+				{Index: 2, Start: 1.6, End: 3.2, Lines: []string{"two"}},
+				// the longer words are capped at the maximum duration
+				{Index: 3, Start: 3.2, End: 5.2, Lines: []string{"three"}},
+				{Index: 4, Start: 8 * 11.0 / 15, End: 8*11.0/15 + 2, Lines: []string{"four"}},
+			},
+		},
+		{
+			name:      "no sentences",
+			sentences: nil,
+			options:   defaults,
+			want:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := buildSubtitleCues(tt.sentences, tt.options)
+			if len(got) != len(tt.want) {
+				t.Fatalf("buildSubtitleCues() = %+v, want %+v", got, tt.want)
+			}
+
+			for i, want := range tt.want {
+				cue := got[i]
+				if cue.Index != want.Index || math.Abs(cue.Start-want.Start) > 1e-9 || math.Abs(cue.End-want.End) > 1e-9 ||
+					!reflect.DeepEqual(cue.Lines, want.Lines) {
+					t.Errorf("cue %d = %+v, want %+v", i, cue, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderSubtitlesEscaping(t *testing.T) {
+	cues := []subtitleCue{
+		{Index: 1, Start: 0, End: 1.5, Lines: []string{"a < b & c > d", `{\b1}bold\N`}},
+	}
+
+	tests := []struct {
+		format string
+		render func([]subtitleCue) []byte
+		want   string
+	}{
+		// SRT players show the text as is
+		{SubtitleFormatSRT, renderSRT, "1\n00:00:00,000 --> 00:00:01,500\na < b & c > d\n{\\b1}bold\\N\n\n"},
+		{SubtitleFormatVTT, renderVTT, "WEBVTT\n\n1\n00:00:00.000 --> 00:00:01.500\na &lt; b &amp; c &gt; d\n{\\b1}bold\\N\n\n"},
+		{SubtitleFormatASS, renderASS, "Dialogue: 0,0:00:00.00,0:00:01.50,Default,,0,0,0,,a < b & c > d\\N(/b1)bold/N\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got := string(tt.render(cues))
+			if tt.format == SubtitleFormatASS {
+				if !strings.HasSuffix(got, tt.want) || strings.Count(got, "Dialogue:") != 1 {
+					t.Errorf("renderASS() = %q, want it to end with %q", got, tt.want)
+				}
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("render %s = %q, want %q", tt.format, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+)
+
+const (
+	defaultSweeperInterval = time.Hour
+
+	// how long the work dir of an existing video is kept after it was last
+	// touched. The blob store has everything needed to restore it
+	workDirRetention = 24 * time.Hour
+
+	// keys of the advisory locks that let a single server run each sweep of
+	// the shared database and blob store
+	sweepExpiredVideosLock = 7318001
+	sweepOrphanedBlobsLock = 7318002
+)
+
+// retentionDaysByPlan is how long videos are kept before the sweeper deletes
+// them, keyed by the first word of the plan name like imageProvidersByPlan.
+// 0 keeps them forever
+var retentionDaysByPlan = map[string]int{
+	"":         7,
+	"Basic":    30,
+	"Standard": 90,
+	"Pro":      365,
+	"Premium":  0,
+}
+
+// DeleteVideo deletes a video, its rows and all of its stored artifacts. It
+// returns ErrVideoBusy when a job is working on it
+func DeleteVideo(ctx context.Context, video *models.Video) error {
+	if err := DeleteVideoRows(video.ID); err != nil {
+		return err
+	}
+
+	// artifacts that couldn't be deleted are orphaned, the sweeper gets them
+	if err := deleteVideoArtifacts(ctx, video.ID); err != nil {
+		log.Printf("[ERROR] Error deleting artifacts of video %s: %v", video.ID, err)
+	}
+
+	log.Printf("[INFO] Deleted video %s", video.ID)
+	return nil
+}
+
+func deleteVideoArtifacts(ctx context.Context, videoID string) error {
+	if err := os.RemoveAll(getVideoFolderPath(videoID)); err != nil {
+		return fmt.Errorf("error deleting work folder: %v", err)
+	}
+
+	prefix := videoArtifactKey(getVideoFolderPath(videoID)) + "/"
+	if err := deleteBlobPrefix(ctx, blobStore, prefix); err != nil {
+		return fmt.Errorf("error deleting stored artifacts: %v", err)
+	}
+	return nil
+}
+
+// getSweeperInterval is SWEEPER_INTERVAL (e.g. 30m) or an hour
+func getSweeperInterval() time.Duration {
+	if interval, err := time.ParseDuration(os.Getenv("SWEEPER_INTERVAL")); err == nil && interval > 0 {
+		return interval
+	}
+	return defaultSweeperInterval
+}
+
+// StartSweeper periodically deletes the videos past the retention of their
+// owner's plan, and the artifacts left behind by deleted videos and old runs
+func StartSweeper() {
+	interval := getSweeperInterval()
+	log.Printf("[INFO] Starting sweeper, running every %s", interval)
+
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			withSweepLock(ctx, sweepExpiredVideosLock, "expired videos", sweepExpiredVideos)
+			// every server has a work dir of its own
+			sweepWorkDir()
+			withSweepLock(ctx, sweepOrphanedBlobsLock, "orphaned artifacts", sweepOrphanedBlobs)
+			cancel()
+
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// withSweepLock runs the sweep unless another server is running it. The
+// advisory lock belongs to a session, so it's taken and released on a
+// connection of its own
+func withSweepLock(ctx context.Context, key int64, name string, sweep func(ctx context.Context)) {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		log.Printf("[ERROR] Error getting database for the %s sweep: %v", name, err)
+		return
+	}
+
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Error getting connection for the %s sweep: %v", name, err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&locked); err != nil {
+		log.Printf("[ERROR] Error locking the %s sweep: %v", name, err)
+		return
+	}
+
+	if !locked {
+		log.Printf("[INFO] Another server is sweeping %s", name)
+		return
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+			log.Printf("[ERROR] Error unlocking the %s sweep: %v", name, err)
+		}
+	}()
+
+	sweep(ctx)
+}
+
+// videoExists tells whether there is a video with the ID. Errors count as
+// existing so nothing gets deleted when the database is unreachable
+func videoExists(videoID string) bool {
+	var count int64
+	if err := db.DB.Model(&models.Video{}).Where("id = ?", videoID).Count(&count).Error; err != nil {
+		log.Printf("[ERROR] Error checking video %s: %v", videoID, err)
+		return true
+	}
+	return count > 0
+}
+
+// videoBusy tells whether a job is queued or running for the video
+func videoBusy(videoID string) bool {
+	job, err := GetActiveJobByVideo(videoID)
+	return err != nil || job != nil
+}
+
+// getRetentionForUser returns how long the videos of a user are kept, 0 for
+// forever
+func getRetentionForUser(userID string) (time.Duration, error) {
+	tier := ""
+	subscription, err := GetActiveSubscriptionByUserID(userID)
+	if err != nil {
+		return 0, err
+	}
+	if subscription != nil {
+		tier = strings.Split(subscription.PlanName, " ")[0]
+	}
+
+	days, ok := retentionDaysByPlan[tier]
+	if !ok {
+		days = retentionDaysByPlan[""]
+	}
+	return time.Duration(days) * 24 * time.Hour, nil
+}
+
+// sweepExpiredVideos deletes the videos older than the retention of the plan
+// of their owner
+func sweepExpiredVideos(ctx context.Context) {
+	shortest := time.Duration(0)
+	for _, days := range retentionDaysByPlan {
+		retention := time.Duration(days) * 24 * time.Hour
+		if days > 0 && (shortest == 0 || retention < shortest) {
+			shortest = retention
+		}
+	}
+	if shortest == 0 {
+		return
+	}
+
+	// nothing younger than the shortest retention can be expired. created_at
+	// is an ISO string, compared as a timestamp
+	cutoff := time.Now().Add(-shortest)
+
+	var videos []models.Video
+	if err := db.DB.Where("CAST(created_at AS timestamptz) < ?", cutoff).Find(&videos).Error; err != nil {
+		log.Printf("[ERROR] Error getting videos to expire: %v", err)
+		return
+	}
+
+	retentions := map[string]time.Duration{}
+	for i := range videos {
+		video := &videos[i]
+
+		retention, ok := retentions[video.OwnerID]
+		if !ok {
+			var err error
+			retention, err = getRetentionForUser(video.OwnerID)
+			if err != nil {
+				log.Printf("[ERROR] Error getting retention of user %s: %v", video.OwnerID, err)
+				continue
+			}
+			retentions[video.OwnerID] = retention
+		}
+
+		createdAt, err := time.Parse(time.RFC3339, video.CreatedAt)
+		if err != nil || retention == 0 || time.Since(createdAt) < retention {
+			continue
+		}
+
+		if err := DeleteVideo(ctx, video); err != nil && !errors.Is(err, ErrVideoBusy) {
+			log.Printf("[ERROR] Error deleting expired video %s: %v", video.ID, err)
+		}
+	}
+}
+
+// sweepWorkDir removes the folders of deleted videos from the work dir, and
+// the ones of videos that haven't been worked on in a while
+func sweepWorkDir() {
+	entries, err := ioutil.ReadDir(getVideoWorkDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[ERROR] Error reading work dir: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		videoID := entry.Name()
+		if videoExists(videoID) {
+			if time.Since(entry.ModTime()) < workDirRetention || videoBusy(videoID) {
+				continue
+			}
+		}
+
+		if err := os.RemoveAll(filepath.Join(getVideoWorkDir(), videoID)); err != nil {
+			log.Printf("[ERROR] Error deleting work folder of %s: %v", videoID, err)
+		}
+	}
+}
+
+// sweepOrphanedBlobs deletes the stored artifacts of videos that don't exist
+// anymore
+func sweepOrphanedBlobs(ctx context.Context) {
+	keys, err := blobStore.List(ctx, "videos/")
+	if err != nil {
+		log.Printf("[ERROR] Error listing stored artifacts: %v", err)
+		return
+	}
+
+	checked := map[string]bool{}
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, "videos/"), "/", 2)
+		videoID := parts[0]
+		if checked[videoID] {
+			continue
+		}
+		checked[videoID] = true
+
+		if videoExists(videoID) {
+			continue
+		}
+
+		log.Printf("[INFO] Deleting orphaned artifacts of video %s", videoID)
+		if err := deleteBlobPrefix(ctx, blobStore, "videos/"+videoID+"/"); err != nil {
+			log.Printf("[ERROR] Error deleting orphaned artifacts of %s: %v", videoID, err)
+		}
+	}
+}
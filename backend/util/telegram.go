@@ -0,0 +1,334 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	models "go-authentication-boilerplate/models"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	// bots can't upload files bigger than this through the Bot API
+	telegramMaxUploadSize = 50 * 1024 * 1024
+
+	telegramCaptionMaxLength = 1024
+
+	// how long the user has to post the link code in the chat
+	telegramLinkCodeExpiry = 15 * time.Minute
+)
+
+// contextHTTPClient sends the requests of the bot with a context, which
+// tgbotapi doesn't support itself
+type contextHTTPClient struct {
+	ctx context.Context
+}
+
+func (c contextHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return http.DefaultClient.Do(req.WithContext(c.ctx))
+}
+
+// newTelegramBot creates the bot that posts the videos. TELEGRAM_API_ENDPOINT
+// can point it at a local stand-in of the Bot API
+func newTelegramBot(ctx context.Context) (*tgbotapi.BotAPI, error) {
+	endpoint := os.Getenv("TELEGRAM_API_ENDPOINT")
+	if endpoint == "" {
+		endpoint = tgbotapi.APIEndpoint
+	}
+
+	bot, err := tgbotapi.NewBotAPIWithClient(os.Getenv("TELEGRAM_API_KEY"), endpoint, contextHTTPClient{ctx: ctx})
+	if err != nil {
+		return nil, fmt.Errorf("error creating telegram bot: %v", err)
+	}
+	return bot, nil
+}
+
+// telegramChatConfig accepts a chat ID or a public @username
+func telegramChatConfig(chat string) tgbotapi.ChatConfig {
+	chat = strings.TrimSpace(chat)
+	if id, err := strconv.ParseInt(chat, 10, 64); err == nil {
+		return tgbotapi.ChatConfig{ChatID: id}
+	}
+
+	if !strings.HasPrefix(chat, "@") {
+		chat = "@" + chat
+	}
+	return tgbotapi.ChatConfig{SuperGroupUsername: chat}
+}
+
+// errTelegramChatAccess is returned when the bot is in the chat but isn't
+// allowed to post in it
+var errTelegramChatAccess = errors.New("the bot can't post in the chat")
+
+// ErrTelegramLinkCodeNotFound is returned when the link code wasn't posted
+// in the chat, or not by an admin of it
+var ErrTelegramLinkCodeNotFound = errors.New("the link code wasn't posted in the chat")
+
+var telegramLinkCodePattern = regexp.MustCompile(`link-[0-9a-f]{10}`)
+
+// isTelegramAccessError tells apart the answers of telegram that the bot
+// lost access to the chat (chat not found, bot kicked) from network errors
+func isTelegramAccessError(err error) bool {
+	if errors.Is(err, errTelegramChatAccess) {
+		return true
+	}
+
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusForbidden
+	}
+	return false
+}
+
+// verifyTelegramChat checks the bot can post to the chat. In channels and
+// groups the bot has to be an admin (allowed to post, in channels), a private
+// chat only has to be started with the bot
+func verifyTelegramChat(bot *tgbotapi.BotAPI, config tgbotapi.ChatConfig) (*tgbotapi.Chat, error) {
+	chat, err := bot.GetChat(tgbotapi.ChatInfoConfig{ChatConfig: config})
+	if err != nil {
+		return nil, fmt.Errorf("the bot can't access the chat: %w", err)
+	}
+
+	if chat.IsPrivate() {
+		return &chat, nil
+	}
+
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: bot.Self.ID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting the bot membership: %w", err)
+	}
+
+	if !member.IsAdministrator() && !member.IsCreator() {
+		return nil, fmt.Errorf("%w: the bot isn't an admin of the chat", errTelegramChatAccess)
+	}
+
+	if chat.IsChannel() && member.IsAdministrator() && !member.CanPostMessages {
+		return nil, fmt.Errorf("%w: the bot isn't allowed to post in the channel", errTelegramChatAccess)
+	}
+
+	return &chat, nil
+}
+
+func telegramChatName(chat *tgbotapi.Chat) string {
+	if chat.UserName != "" {
+		return "@" + chat.UserName
+	}
+	if chat.Title != "" {
+		return chat.Title
+	}
+	return strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+}
+
+// StartTelegramLink verifies the bot can post to the chat and creates the
+// code the user has to post in it, to prove they run the chat
+func StartTelegramLink(ctx context.Context, ownerID string, chatRef string) (*models.TelegramLink, error) {
+	bot, err := newTelegramBot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := verifyTelegramChat(bot, telegramChatConfig(chatRef))
+	if err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, 5)
+	if _, err := rand.Read(random); err != nil {
+		return nil, fmt.Errorf("error generating link code: %v", err)
+	}
+
+	return SetTelegramLink(&models.TelegramLink{
+		OwnerID:   ownerID,
+		ChatID:    chat.ID,
+		Name:      telegramChatName(chat),
+		Code:      "link-" + hex.EncodeToString(random),
+		ExpiresAt: time.Now().Add(telegramLinkCodeExpiry),
+	})
+}
+
+// ConfirmTelegramLink looks for the code of the link in the chat and returns
+// the account to save for it
+func ConfirmTelegramLink(ctx context.Context, link *models.TelegramLink) (*models.PublishingAccount, error) {
+	bot, err := newTelegramBot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !link.Confirmed {
+		if err := scanTelegramLinkCodes(bot); err != nil {
+			return nil, err
+		}
+
+		link, err = GetTelegramLinkByOwner(link.OwnerID)
+		if err != nil {
+			return nil, err
+		}
+		if !link.Confirmed {
+			return nil, ErrTelegramLinkCodeNotFound
+		}
+	}
+
+	// the rights of the bot could have changed while the user posted the code
+	chat, err := verifyTelegramChat(bot, tgbotapi.ChatConfig{ChatID: link.ChatID})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.PublishingAccount{
+		OwnerID:     link.OwnerID,
+		Destination: DestinationTelegram,
+		ExternalID:  strconv.FormatInt(chat.ID, 10),
+		Name:        telegramChatName(chat),
+	}, nil
+}
+
+// scanTelegramLinkCodes reads the messages the bot received and confirms the
+// links whose code was posted by an admin of the chat. Every pending link is
+// checked in the same pass, so the updates can be acknowledged
+func scanTelegramLinkCodes(bot *tgbotapi.BotAPI) error {
+	offset := 0
+	for {
+		updates, err := bot.GetUpdates(tgbotapi.UpdateConfig{
+			Offset:         offset,
+			Limit:          100,
+			AllowedUpdates: []string{"message", "channel_post"},
+		})
+		if err != nil {
+			return fmt.Errorf("error getting telegram updates: %v", err)
+		}
+
+		if len(updates) == 0 {
+			return nil
+		}
+
+		for _, update := range updates {
+			offset = update.UpdateID + 1
+
+			message := update.Message
+			if message == nil {
+				message = update.ChannelPost
+			}
+			if message == nil || message.Chat == nil {
+				continue
+			}
+
+			for _, code := range telegramLinkCodePattern.FindAllString(message.Text, -1) {
+				if !isTelegramChatAdminMessage(bot, message) {
+					log.Printf("[INFO] Ignoring telegram link code %s posted by a non admin of chat %d", code, message.Chat.ID)
+					break
+				}
+
+				if _, err := ConfirmTelegramLinkCode(message.Chat.ID, code); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// isTelegramChatAdminMessage checks the message was sent by someone who runs
+// the chat: only admins post in channels, anonymous admins of groups post as
+// the group itself and a private chat is the user's own
+func isTelegramChatAdminMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) bool {
+	chat := message.Chat
+	if chat.IsChannel() {
+		return true
+	}
+
+	if message.SenderChat != nil {
+		return message.SenderChat.ID == chat.ID
+	}
+
+	if message.From == nil {
+		return false
+	}
+
+	if chat.IsPrivate() {
+		return message.From.ID == chat.ID
+	}
+
+	member, err := bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chat.ID, UserID: message.From.ID},
+	})
+	if err != nil {
+		log.Printf("[ERROR] Error getting telegram chat member %d of %d: %v", message.From.ID, chat.ID, err)
+		return false
+	}
+	return member.IsAdministrator() || member.IsCreator()
+}
+
+type telegramPublisher struct{}
+
+func (telegramPublisher) Name() string {
+	return DestinationTelegram
+}
+
+func telegramCaption(video *models.Video) string {
+	caption := strings.TrimSpace(video.Topic)
+	if runes := []rune(caption); len(runes) > telegramCaptionMaxLength {
+		caption = string(runes[:telegramCaptionMaxLength])
+	}
+	return caption
+}
+
+// Publish sends the video to the linked chat. The admin rights of the bot are
+// checked again since they can be revoked after linking
+func (telegramPublisher) Publish(ctx context.Context, video *models.Video, account *models.PublishingAccount, filePath string) (*PublishResult, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading video file: %v", err)
+	}
+
+	if info.Size() > telegramMaxUploadSize {
+		return nil, &permanentPublishError{fmt.Errorf("video is %d bytes, telegram accepts up to %d", info.Size(), telegramMaxUploadSize)}
+	}
+
+	chatID, err := strconv.ParseInt(account.ExternalID, 10, 64)
+	if err != nil {
+		return nil, &permanentPublishError{fmt.Errorf("invalid telegram chat %s", account.ExternalID)}
+	}
+
+	bot, err := newTelegramBot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := verifyTelegramChat(bot, tgbotapi.ChatConfig{ChatID: chatID})
+	if err != nil {
+		if isTelegramAccessError(err) {
+			return nil, &permanentPublishError{err}
+		}
+		return nil, err
+	}
+
+	upload := tgbotapi.NewVideo(chatID, tgbotapi.FilePath(filePath))
+	upload.Caption = telegramCaption(video)
+	upload.SupportsStreaming = true
+
+	message, err := bot.Send(upload)
+	if err != nil {
+		return nil, fmt.Errorf("error sending video to telegram: %v", err)
+	}
+
+	result := &PublishResult{RemoteID: strconv.Itoa(message.MessageID)}
+
+	// only messages of public chats have a link
+	if chat.UserName != "" {
+		result.RemoteURL = fmt.Sprintf("https://t.me/%s/%d", chat.UserName, message.MessageID)
+	}
+
+	return result, nil
+}
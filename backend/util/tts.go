@@ -0,0 +1,162 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	db "go-authentication-boilerplate/database"
+	models "go-authentication-boilerplate/models"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	TTSProviderOpenAI = "openai"
+	TTSProviderLocal  = "local"
+)
+
+// SpeechSynthesizer turns the script into MP3 narration with the given voice
+type SpeechSynthesizer interface {
+	Name() string
+	Synthesize(ctx context.Context, text string, narrator *models.Narrator) ([]byte, error)
+}
+
+var speechSynthesizers = map[string]SpeechSynthesizer{
+	TTSProviderOpenAI: openAISpeechSynthesizer{},
+	TTSProviderLocal:  localSpeechSynthesizer{},
+}
+
+// the OpenAI voices that used to be hard-coded, seeded into the registry
+var defaultNarrators = []models.Narrator{
+	{Name: "alloy", Description: "Male, confident and friendly.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceAlloy), Language: "en", PreviewURL: "/audio/alloy.mp3", Enabled: true},
+	{Name: "echo", Description: "Male, Confident. You would want to listen to him.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceEcho), Language: "en", PreviewURL: "/audio/echo.mp3", Enabled: true},
+	{Name: "fable", Description: "Male, Ready to tell your story.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceFable), Language: "en", PreviewURL: "/audio/fable.mp3", Enabled: true},
+	{Name: "onyx", Description: "Male, Deep and confident.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceOnyx), Language: "en", PreviewURL: "/audio/onyx.mp3", Enabled: true},
+	{Name: "nova", Description: "Female, confident and friendly.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceNova), Language: "en", PreviewURL: "/audio/nova.mp3", Enabled: true},
+	{Name: "shimmer", Description: "Female, calm and soothing.", Provider: TTSProviderOpenAI, VoiceID: string(openai.VoiceShimmer), Language: "en", PreviewURL: "/audio/shimmer.mp3", Enabled: true},
+}
+
+// SeedNarrators adds the default narrators that are missing from the registry
+func SeedNarrators() {
+	for _, narrator := range defaultNarrators {
+		var count int64
+		db.DB.Model(&models.Narrator{}).Where("name = ?", narrator.Name).Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		narrator := narrator
+		if err := db.DB.Create(&narrator).Error; err != nil {
+			log.Printf("[ERROR] Error seeding narrator %s: %v", narrator.Name, err)
+		}
+	}
+}
+
+type openAISpeechSynthesizer struct{}
+
+func (s openAISpeechSynthesizer) Name() string { return TTSProviderOpenAI }
+
+func (s openAISpeechSynthesizer) Synthesize(ctx context.Context, text string, narrator *models.Narrator) ([]byte, error) {
+	client := openai.NewClient(OPENAI_API_KEY)
+
+	req := openai.CreateSpeechRequest{
+		Model:          openai.TTSModel1HD,
+		Input:          text,
+		Voice:          openai.SpeechVoice(narrator.VoiceID),
+		ResponseFormat: openai.SpeechResponseFormatMp3,
+	}
+
+	resp, err := client.CreateSpeech(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("speech creation failed: %v", err)
+	}
+	defer resp.Close()
+
+	return io.ReadAll(resp)
+}
+
+// localSpeechSynthesizer talks to a self-hosted TTS server (Coqui TTS, or
+// Piper behind the same API) at LOCAL_TTS_URL. The WAV it returns is
+// converted to MP3 with ffmpeg so the rest of the pipeline stays the same
+type localSpeechSynthesizer struct{}
+
+func (s localSpeechSynthesizer) Name() string { return TTSProviderLocal }
+
+func (s localSpeechSynthesizer) Synthesize(ctx context.Context, text string, narrator *models.Narrator) ([]byte, error) {
+	baseURL := os.Getenv("LOCAL_TTS_URL")
+	if baseURL == "" {
+		baseURL = "http://127.0.0.1:5500"
+	}
+
+	query := url.Values{}
+	query.Add("text", text)
+	query.Add("speaker_id", narrator.VoiceID)
+	query.Add("language_id", narrator.Language)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(baseURL, "/")+"/api/tts?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("TTS request failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	if strings.Contains(resp.Header.Get("Content-Type"), "mpeg") {
+		return body, nil
+	}
+
+	return convertAudioToMP3(ctx, body)
+}
+
+func convertAudioToMP3(ctx context.Context, audio []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-i", "pipe:0", "-f", "mp3", "-b:a", "192k", "pipe:1")
+	cmd.Stdin = bytes.NewReader(audio)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed to convert audio: %v: %s", err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// SynthesizeForNarrator looks up the narrator in the registry and runs the
+// synthesizer of its provider
+func SynthesizeForNarrator(ctx context.Context, text string, narratorName string) ([]byte, error) {
+	narrator, err := GetNarratorByName(narratorName)
+	if err != nil {
+		return nil, fmt.Errorf("unknown narrator %s: %v", narratorName, err)
+	}
+
+	synthesizer, ok := speechSynthesizers[narrator.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown TTS provider %s for narrator %s", narrator.Provider, narrator.Name)
+	}
+
+	log.Printf("[INFO] Synthesizing speech with %s (voice %s)", synthesizer.Name(), narrator.VoiceID)
+
+	return synthesizer.Synthesize(ctx, text, narrator)
+}
@@ -1,29 +1,61 @@
 package util
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 
 	models "go-authentication-boilerplate/models"
+)
 
-	"net/http"
-	"bytes"
-	"encoding/json"
+const (
+	outputWidth  = 1080
+	outputHeight = 1920
+	outputFPS    = 30
+
+	captionFont         = "Roboto-Bold.ttf"
+	captionFontSize     = 64
+	captionMaxLineChars = 26
 )
 
-type StitchingAPIResponse struct {
-	OutputFile string `json:"output_file"`
+type slide struct {
+	ImagePath string
+	Start     float64
+	End       float64
+}
+
+type caption struct {
+	Text  string
+	Start float64
+	End   float64
 }
 
-func StitchVideo(video models.Video) (models.Video, error) {
+func StitchVideo(ctx context.Context, video models.Video) (models.Video, error) {
 	log.Printf("[INFO] Creating slideshow with subtitles..")
 
 	videoID := video.ID
 
-	outputURL, err := callStitchingAPI(videoID, video.BackgroundMusic)
+	n, err := videoNarration(video)
+	if err != nil {
+		return video, err
+	}
+
+	outputPath, err := renderSlideshow(ctx, video, n)
+	if err != nil {
+		return video, fmt.Errorf("failed to render slideshow: %v", err)
+	}
+
+	videoKey, err := storeVideoArtifact(ctx, outputPath)
 	if err != nil {
-		return video, fmt.Errorf("failed to call stitching API: %v", err)
+		return video, fmt.Errorf("failed to store video: %v", err)
 	}
 
 	videoPtr, err := GetVideoById(videoID)
@@ -33,7 +65,7 @@ func StitchVideo(video models.Video) (models.Video, error) {
 
 	video = *videoPtr
 
-	video.VideoURL = outputURL
+	video.VideoURL = videoKey
 	video.VideoUploaded = true
 	video.VideoStitched = true
 	video.TTSGenerated = true
@@ -41,7 +73,7 @@ func StitchVideo(video models.Video) (models.Video, error) {
 	video.ScriptGenerated = true
 	video.DALLEPromptGenerated = true
 	video.DALLEGenerated = true
-	video.StitchedVideoURL = outputURL
+	video.StitchedVideoURL = videoKey
 
 	videoPtr, err = SetVideo(&video)
 	if err != nil {
@@ -52,68 +84,309 @@ func StitchVideo(video models.Video) (models.Video, error) {
 	log.Printf("[INFO] Successfully created slideshow with subtitles..")
 
 	video = *videoPtr
-	
+
 	return video, nil
 }
 
-func callStitchingAPI(videoID string, musicFile string) (outputUrl string, err error) {
-	req, err := http.NewRequest("POST", "http://127.0.0.1:8080/create_slideshow", nil)
+// getPublicAssetPath resolves a file shipped in backend/public (fonts, sound effects)
+func getPublicAssetPath(name string) string {
+	dir := os.Getenv("PUBLIC_ASSETS_DIR")
+	if dir == "" {
+		dir = "public"
+	}
+	return filepath.Join(dir, name)
+}
+
+func getStitchedVideoPath(videoID string) string {
+	return filepath.Join(getVideoFolderPath(videoID), "final", "video.mp4")
+}
+
+// probeMediaDuration returns the duration of an audio or video file in seconds
+func probeMediaDuration(ctx context.Context, path string) (float64, error) {
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", path).Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+		return 0, fmt.Errorf("ffprobe failed for %s: %v", path, err)
+	}
+
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse duration of %s: %v", path, err)
+	}
+	return duration, nil
+}
+
+func runFFmpeg(ctx context.Context, args ...string) error {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-hide_banner", "-loglevel", "error", "-y"}, args...)...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// escapeFilterValue quotes a value (usually a path) for use inside an ffmpeg filtergraph
+func escapeFilterValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// sentenceWindows returns when each sentence is on screen: from its start
+// until the next sentence starts, so the visuals change with the narration
+func sentenceWindows(sentences []ASRSentences, audioDuration float64) [][2]float64 {
+	var windows [][2]float64
+	for i := range sentences {
+		start := 0.0
+		if i > 0 {
+			start = asrSeconds(sentences[i].Start)
+		}
+
+		end := audioDuration
+		if i < len(sentences)-1 {
+			end = asrSeconds(sentences[i+1].Start)
+		}
+
+		if end <= start {
+			end = start + 0.1
+		}
+
+		windows = append(windows, [2]float64{start, end})
+	}
+	return windows
+}
+
+// buildSlides shows image N while sentence N is narrated
+func buildSlides(videoID string, sentences []ASRSentences, audioDuration float64) ([]slide, error) {
+	if len(sentences) == 0 {
+		return nil, fmt.Errorf("no sentences to build slides from")
+	}
+
+	var slides []slide
+	for i, window := range sentenceWindows(sentences, audioDuration) {
+		imagePath := getSceneImagePath(videoID, i)
+		if !fileExists(imagePath) {
+			return nil, fmt.Errorf("missing image for sentence %d", i+1)
+		}
+
+		slides = append(slides, slide{ImagePath: imagePath, Start: window[0], End: window[1]})
+	}
+
+	return slides, nil
+}
+
+func buildCaptions(sentences []ASRSentences) []caption {
+	var captions []caption
+	for _, sentence := range sentences {
+		text := strings.TrimSpace(sentence.Text)
+		if text == "" {
+			continue
+		}
+
+		captions = append(captions, caption{
+			Text:  wrapCaption(text, captionMaxLineChars),
+			Start: asrSeconds(sentence.Start),
+			End:   asrSeconds(sentence.End),
+		})
+	}
+	return captions
+}
+
+// wrapCaption breaks a caption into lines of at most maxChars characters
+func wrapCaption(text string, maxChars int) string {
+	var lines []string
+	var line string
+
+	for _, word := range strings.Fields(text) {
+		if line != "" && utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > maxChars {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+
+		if line == "" {
+			line = word
+		} else {
+			line += " " + word
+		}
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// writeSlidesConcatFile writes the list of images for ffmpeg's concat demuxer
+func writeSlidesConcatFile(path string, slides []slide) error {
+	var list strings.Builder
+	for _, s := range slides {
+		fmt.Fprintf(&list, "file %s\nduration %.3f\n", escapeFilterValue(s.ImagePath), s.End-s.Start)
 	}
 
-	type SlideshowRequest struct {
-		VideoID string `json:"video_id"`
-		MusicFile string `json:"music"`
+	// the concat demuxer ignores the duration of the last entry unless it is repeated
+	fmt.Fprintf(&list, "file %s\n", escapeFilterValue(slides[len(slides)-1].ImagePath))
+
+	return ioutil.WriteFile(path, []byte(list.String()), 0644)
+}
+
+// writeClipsConcatFile writes the list of prepared stock clips for ffmpeg's
+// concat demuxer. They are already cut to the length of their sentence
+func writeClipsConcatFile(path string, clipPaths []string) error {
+	var list strings.Builder
+	for _, clipPath := range clipPaths {
+		fmt.Fprintf(&list, "file %s\n", escapeFilterValue(clipPath))
 	}
 
-	log.Printf("[INFO] Music file: %v", musicFile)
+	return ioutil.WriteFile(path, []byte(list.String()), 0644)
+}
 
-	// Create the request body
-	slideshowRequest := SlideshowRequest{
-		VideoID: videoID,
-		MusicFile: musicFile,
+// buildCaptionFilters burns each caption in with drawtext. The text is read
+// from a file so it doesn't have to be escaped for the filtergraph
+func buildCaptionFilters(folderPath string, captions []caption, preset captionPreset, position string) ([]string, error) {
+	captionsPath := filepath.Join(folderPath, "captions")
+	if err := os.MkdirAll(captionsPath, 0755); err != nil {
+		return nil, fmt.Errorf("error creating captions folder: %v", err)
 	}
 
-	// Marshal the request body
-	body, err := json.Marshal(slideshowRequest)
+	fontPath, err := filepath.Abs(getPublicAssetPath(preset.Font))
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request body: %v", err)
+		return nil, fmt.Errorf("error resolving caption font: %v", err)
 	}
 
-	// Set the request body
-	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	// the top of the text is at 70% of the height, clear of the UI the
+	// platforms draw at the bottom, or the text is centered
+	y := "h*0.70"
+	if position == CaptionPositionCenter {
+		y = "(h-text_h)/2"
+	}
 
-	// Set the content type
-	req.Header.Set("Content-Type", "application/json")
+	var filters []string
+	for i, c := range captions {
+		textPath := filepath.Join(captionsPath, fmt.Sprintf("caption_%d.txt", i+1))
+		if err := ioutil.WriteFile(textPath, []byte(c.Text), 0644); err != nil {
+			return nil, fmt.Errorf("error writing caption %d: %v", i+1, err)
+		}
 
-	log.Printf("[INFO] Sending request to create slideshow with subtitles..")
+		filters = append(filters, fmt.Sprintf(
+			"drawtext=fontfile=%s:textfile=%s:expansion=none:fontsize=%d:fontcolor=white:borderw=%d:bordercolor=black:line_spacing=14:x=(w-text_w)/2:y=%s:enable='between(t,%.3f,%.3f)'",
+			escapeFilterValue(fontPath), escapeFilterValue(textPath), preset.FontSize, preset.Outline, y, c.Start, c.End,
+		))
+	}
 
-	// Send the request
-	client := &http.Client{}
-	res, err := client.Do(req)
+	return filters, nil
+}
+
+// narration is what a render is made from besides the scenes: the audio of
+// one language, its timings, and where the render goes
+type narration struct {
+	FolderPath string
+	AudioPath  string
+	Sentences  []ASRSentences
+	Words      []models.SceneWords
+	// prepared stock clips, one per sentence. The images are used without them
+	ClipPaths []string
+	// the mastered narration, music and effects, see masterAudio
+	MixPath    string
+	OutputPath string
+}
+
+// videoNarration is the narration of the video in its own language
+func videoNarration(video models.Video) (narration, error) {
+	asr, err := readASRForVideo(video.ID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to create slideshow with subtitles. The response body is: %v with status code: %v", res.Body, res.StatusCode)
-		return "", fmt.Errorf("failed to send request: %v", err)
+		return narration{}, err
+	}
+
+	n := narration{
+		FolderPath: getVideoFolderPath(video.ID),
+		AudioPath:  getAudioFilePath(video.ID),
+		Sentences:  asr.Sentences,
+		Words:      captionWords(video.ID, asr.Sentences),
+		MixPath:    getMasteredAudioPath(video.ID),
+		OutputPath: getStitchedVideoPath(video.ID),
 	}
 
-	if res.StatusCode != http.StatusOK {
-		log.Printf("[ERROR] Failed to create slideshow with subtitles. The response body is: %v with status code: %v", res.Body, res.StatusCode)
-		return "", fmt.Errorf("failed to send request: %v", err)
+	// stock footage is used when a clip was prepared for every sentence,
+	// otherwise (including when the stock search failed) the images are
+	if clipPaths, hasClips := stockClipPaths(video.ID, len(asr.Sentences)); video.MediaType == "stock" && hasClips {
+		n.ClipPaths = clipPaths
 	}
 
-	log.Printf("[INFO] Successfully created slideshow with subtitles. Status code: %v", res.StatusCode)
+	return n, nil
+}
 
-	// Decode the response
-	var response StitchingAPIResponse
+// renderSlideshow renders the final vertical video with ffmpeg: the scene
+// images timed to the ASR sentences, burnt in captions and the mastered mix
+// of the narration
+func renderSlideshow(ctx context.Context, video models.Video, n narration) (string, error) {
+	folderPath := n.FolderPath
+	audioPath := n.AudioPath
 
-	err = json.NewDecoder(res.Body).Decode(&response)
+	audioDuration, err := probeMediaDuration(ctx, audioPath)
 	if err != nil {
-		log.Printf("[ERROR] Failed to decode response: %v", res.Body)
-		return "", fmt.Errorf("failed to decode response: %v", err)
+		return "", err
 	}
 
-	log.Printf("[INFO] Output file: %v", response.OutputFile)
+	concatPath := filepath.Join(folderPath, "slides.txt")
+	if len(n.ClipPaths) > 0 {
+		if err := writeClipsConcatFile(concatPath, n.ClipPaths); err != nil {
+			return "", fmt.Errorf("error writing clips list: %v", err)
+		}
+	} else {
+		slides, err := buildSlides(video.ID, n.Sentences, audioDuration)
+		if err != nil {
+			return "", err
+		}
+
+		if err := writeSlidesConcatFile(concatPath, slides); err != nil {
+			return "", fmt.Errorf("error writing slides list: %v", err)
+		}
+	}
+
+	captionFilters, err := buildVideoCaptionFilters(video, folderPath, n.Sentences, n.Words)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := n.OutputPath
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return "", fmt.Errorf("error creating output folder: %v", err)
+	}
 
-	return response.OutputFile, nil
-}
\ No newline at end of file
+	args := []string{
+		"-f", "concat", "-safe", "0", "-i", concatPath,
+		"-i", n.MixPath,
+	}
+
+	videoFilters := append([]string{
+		fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=increase", outputWidth, outputHeight),
+		fmt.Sprintf("crop=%d:%d", outputWidth, outputHeight),
+		"setsar=1",
+		fmt.Sprintf("fps=%d", outputFPS),
+		"format=yuv420p",
+	}, captionFilters...)
+
+	filterComplex := "[0:v]" + strings.Join(videoFilters, ",") + "[v]"
+
+	args = append(args,
+		"-filter_complex", filterComplex,
+		"-map", "[v]", "-map", "1:a",
+		"-c:v", "libx264", "-preset", "medium", "-crf", "20",
+		"-c:a", "aac", "-b:a", "192k",
+		"-t", fmt.Sprintf("%.3f", audioDuration),
+		"-movflags", "+faststart",
+		outputPath,
+	)
+
+	log.Printf("[INFO] Rendering video %s with ffmpeg", video.ID)
+
+	if err := runFFmpeg(ctx, args...); err != nil {
+		return "", err
+	}
+
+	log.Printf("[INFO] Output file: %v", outputPath)
+
+	return outputPath, nil
+}
@@ -0,0 +1,438 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	models "go-authentication-boilerplate/models"
+)
+
+const (
+	youtubeTitleMaxLength = 100
+
+	// how many times an interrupted upload is resumed before the attempt fails
+	youtubeUploadResumes = 5
+)
+
+// the wait before resuming an interrupted upload grows by this every time
+var youtubeResumeBackoff = 2 * time.Second
+
+// youtubeAPIBaseURL can point at a local stand-in of the YouTube Data API
+func youtubeAPIBaseURL() string {
+	if base := os.Getenv("YOUTUBE_API_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "https://www.googleapis.com"
+}
+
+func youtubeOAuthBaseURL() string {
+	if base := os.Getenv("YOUTUBE_OAUTH_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "https://oauth2.googleapis.com"
+}
+
+type youtubeTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Error        string `json:"error"`
+}
+
+func requestYouTubeToken(ctx context.Context, params url.Values) (*youtubeTokenResponse, error) {
+	params.Set("client_id", os.Getenv("YOUTUBE_CLIENT_ID"))
+	params.Set("client_secret", os.Getenv("YOUTUBE_CLIENT_SECRET"))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", youtubeOAuthBaseURL()+"/token", strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	var token youtubeTokenResponse
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("YouTube token request failed with status code %d: %s", resp.StatusCode, string(body))
+
+		// the refresh token was revoked or expired, the account has to be
+		// linked again
+		if json.Unmarshal(body, &token) == nil && token.Error == "invalid_grant" {
+			return nil, &permanentPublishError{err}
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("no access token returned: %s", token.Error)
+	}
+
+	return &token, nil
+}
+
+// ExchangeYouTubeCode exchanges the code of the OAuth consent screen for a
+// refresh token, which is what gets stored as the account credential
+func ExchangeYouTubeCode(ctx context.Context, code string, redirectURI string) (string, string, error) {
+	token, err := requestYouTubeToken(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if token.RefreshToken == "" {
+		return "", "", fmt.Errorf("no refresh token returned, the consent screen needs access_type=offline")
+	}
+
+	return token.RefreshToken, token.AccessToken, nil
+}
+
+func youtubeAccessToken(ctx context.Context, refreshToken string) (string, error) {
+	token, err := requestYouTubeToken(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+type YouTubeChannel struct {
+	ID    string
+	Title string
+}
+
+// GetYouTubeChannel returns the channel the access token uploads to
+func GetYouTubeChannel(ctx context.Context, accessToken string) (*YouTubeChannel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", youtubeAPIBaseURL()+"/youtube/v3/channels?part=snippet&mine=true", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("YouTube channel request failed with status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	var channels struct {
+		Items []struct {
+			ID      string `json:"id"`
+			Snippet struct {
+				Title string `json:"title"`
+			} `json:"snippet"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(body, &channels); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	if len(channels.Items) == 0 {
+		return nil, fmt.Errorf("the account has no YouTube channel")
+	}
+
+	return &YouTubeChannel{ID: channels.Items[0].ID, Title: channels.Items[0].Snippet.Title}, nil
+}
+
+// youtubeStatusError is an unexpected status of the upload endpoint. Client
+// errors aren't resumed, the attempt fails and the job retries it later
+type youtubeStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *youtubeStatusError) Error() string {
+	return fmt.Sprintf("YouTube upload failed with status code %d: %s", e.StatusCode, e.Body)
+}
+
+type youtubePublisher struct{}
+
+func (youtubePublisher) Name() string {
+	return DestinationYouTube
+}
+
+func youtubeVideoMetadata(video *models.Video) map[string]interface{} {
+	title := strings.TrimSpace(video.Topic)
+	if !strings.Contains(strings.ToLower(title), "#shorts") {
+		title += " #shorts"
+	}
+	if runes := []rune(title); len(runes) > youtubeTitleMaxLength {
+		title = strings.TrimSpace(string(runes[:youtubeTitleMaxLength]))
+	}
+
+	privacy := os.Getenv("YOUTUBE_PRIVACY_STATUS")
+	if privacy == "" {
+		privacy = "public"
+	}
+
+	return map[string]interface{}{
+		"snippet": map[string]interface{}{
+			"title":       title,
+			"description": strings.TrimSpace(video.Script + "\n\n#shorts"),
+			"categoryId":  "22",
+		},
+		"status": map[string]interface{}{
+			"privacyStatus":           privacy,
+			"selfDeclaredMadeForKids": false,
+		},
+	}
+}
+
+// Publish uploads the video with the resumable upload protocol: a session is
+// started with the metadata, then the file is sent to the session URL and
+// resumed from the last byte the server has when the transfer is interrupted
+func (youtubePublisher) Publish(ctx context.Context, video *models.Video, account *models.PublishingAccount, filePath string) (*PublishResult, error) {
+	accessToken, err := youtubeAccessToken(ctx, account.Credential)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading video file: %v", err)
+	}
+
+	sessionURL, err := startYouTubeUpload(ctx, accessToken, youtubeVideoMetadata(video), info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	videoID, err := uploadYouTubeVideo(ctx, accessToken, sessionURL, filePath, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublishResult{
+		RemoteID:  videoID,
+		RemoteURL: "https://youtube.com/shorts/" + videoID,
+	}, nil
+}
+
+func startYouTubeUpload(ctx context.Context, accessToken string, metadata map[string]interface{}, size int64) (string, error) {
+	payload, err := json.Marshal(metadata)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling metadata: %v", err)
+	}
+
+	endpoint := youtubeAPIBaseURL() + "/upload/youtube/v3/videos?uploadType=resumable&part=snippet,status"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "video/mp4")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		statusErr := &youtubeStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+
+		// a rejected video (quota of the channel, invalid metadata, missing
+		// permission) fails the same way every time. An expired token,
+		// timeouts and rate limits are worth retrying
+		if isPermanentYouTubeStatus(resp.StatusCode) {
+			return "", &permanentPublishError{statusErr}
+		}
+		return "", statusErr
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("YouTube didn't return an upload URL")
+	}
+
+	return location, nil
+}
+
+func isPermanentYouTubeStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
+}
+
+// uploadYouTubeVideo sends the file to the upload session and returns the ID
+// of the created video
+func uploadYouTubeVideo(ctx context.Context, accessToken string, sessionURL string, filePath string, size int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening video file: %v", err)
+	}
+	defer file.Close()
+
+	var offset int64
+	var lastErr error
+
+	for resume := 0; resume <= youtubeUploadResumes; resume++ {
+		if resume > 0 {
+			if !sleepContext(ctx, time.Duration(resume)*youtubeResumeBackoff) {
+				return "", ctx.Err()
+			}
+
+			// asks the session how much of the file it already has
+			var videoID string
+			offset, videoID, lastErr = queryYouTubeUpload(ctx, accessToken, sessionURL, size)
+			if lastErr != nil {
+				if _, fatal := lastErr.(*youtubeStatusError); fatal {
+					return "", lastErr
+				}
+				continue
+			}
+
+			// the interrupted request got through after all
+			if videoID != "" {
+				return videoID, nil
+			}
+		}
+
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return "", fmt.Errorf("error seeking video file: %v", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "PUT", sessionURL, io.LimitReader(file, size-offset))
+		if err != nil {
+			return "", fmt.Errorf("error creating request: %v", err)
+		}
+
+		req.ContentLength = size - offset
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Content-Type", "video/mp4")
+		if offset > 0 {
+			req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, size-1, size))
+		}
+
+		videoID, err := readYouTubeUploadResponse(http.DefaultClient.Do(req))
+		if err == nil {
+			return videoID, nil
+		}
+
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		if statusErr, ok := err.(*youtubeStatusError); ok && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusPermanentRedirect {
+			return "", err
+		}
+
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("upload interrupted too many times: %v", lastErr)
+}
+
+func readYouTubeUploadResponse(resp *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", &youtubeStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &uploaded); err != nil {
+		return "", fmt.Errorf("error unmarshalling response: %v", err)
+	}
+
+	if uploaded.ID == "" {
+		return "", fmt.Errorf("YouTube didn't return a video ID")
+	}
+
+	return uploaded.ID, nil
+}
+
+// queryYouTubeUpload returns the offset to resume the upload from. The
+// session answers 308 with the range it received so far, or with the video
+// when the upload already completed
+func queryYouTubeUpload(ctx context.Context, accessToken string, sessionURL string, size int64) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", sessionURL, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("error creating request: %v", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("error sending request: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusPermanentRedirect {
+		videoID, err := readYouTubeUploadResponse(resp, nil)
+		if statusErr, ok := err.(*youtubeStatusError); ok && statusErr.StatusCode >= 500 {
+			return 0, "", fmt.Errorf("YouTube upload status failed with status code %d: %s", statusErr.StatusCode, statusErr.Body)
+		}
+		return 0, videoID, err
+	}
+	resp.Body.Close()
+
+	// "bytes=0-1234" means bytes up to 1234 were received, no header means none
+	received := resp.Header.Get("Range")
+	if received == "" {
+		return 0, "", nil
+	}
+
+	i := strings.LastIndex(received, "-")
+	if i < 0 {
+		return 0, "", fmt.Errorf("invalid range %q", received)
+	}
+
+	last, err := strconv.ParseInt(received[i+1:], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid range %q", received)
+	}
+
+	return last + 1, "", nil
+}
@@ -0,0 +1,314 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "go-authentication-boilerplate/models"
+)
+
+// fakeYouTube is a stand-in of the OAuth and upload endpoints. The upload
+// session keeps the bytes it received, like the real one
+type fakeYouTube struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	received []byte
+	// answers of the next PUTs with a body, the upload completes once they
+	// are used up
+	putStatuses []int
+	// how many bytes of an interrupted PUT the session keeps
+	keepBytes int
+	// the interrupted PUT got through, only its response was lost
+	completeOnInterrupt bool
+	done                bool
+	// answer of the session start
+	startStatus int
+	// answer of the token endpoint, 0 for a token
+	tokenStatus int
+	tokenError  string
+
+	refreshes    int
+	queries      int
+	contentRange []string
+}
+
+func newFakeYouTube(t *testing.T) *fakeYouTube {
+	f := &fakeYouTube{t: t, startStatus: http.StatusOK}
+
+	server := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(server.Close)
+
+	t.Setenv("YOUTUBE_API_BASE_URL", server.URL)
+	t.Setenv("YOUTUBE_OAUTH_BASE_URL", server.URL)
+
+	backoff := youtubeResumeBackoff
+	youtubeResumeBackoff = time.Millisecond
+	t.Cleanup(func() { youtubeResumeBackoff = backoff })
+
+	return f
+}
+
+func (f *fakeYouTube) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/token":
+		f.refreshes++
+		if err := r.ParseForm(); err != nil {
+			f.t.Errorf("token request: %v", err)
+		}
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh-token" {
+			f.t.Errorf("unexpected token request %v", r.Form)
+		}
+
+		if f.tokenStatus != 0 {
+			w.WriteHeader(f.tokenStatus)
+			fmt.Fprintf(w, `{"error": %q}`, f.tokenError)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "access-token"}`)
+
+	case r.URL.Path == "/upload/youtube/v3/videos":
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			f.t.Errorf("session started with %q", r.Header.Get("Authorization"))
+		}
+
+		if f.startStatus != http.StatusOK {
+			w.WriteHeader(f.startStatus)
+			fmt.Fprint(w, `{"error": "rejected"}`)
+			return
+		}
+		w.Header().Set("Location", "http://"+r.Host+"/session")
+
+	case r.URL.Path == "/session":
+		f.serveSession(w, r)
+
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeYouTube) serveSession(w http.ResponseWriter, r *http.Request) {
+	contentRange := r.Header.Get("Content-Range")
+	f.contentRange = append(f.contentRange, contentRange)
+
+	// a status query, answered with what was received so far
+	if strings.HasPrefix(contentRange, "bytes */") {
+		f.queries++
+		if f.done {
+			fmt.Fprint(w, `{"id": "video-id"}`)
+			return
+		}
+		if len(f.received) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(f.received)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("reading upload: %v", err)
+	}
+
+	var offset int
+	if contentRange != "" {
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-", &offset); err != nil {
+			f.t.Errorf("invalid content range %q", contentRange)
+		}
+	}
+	if offset != len(f.received) {
+		f.t.Errorf("upload resumed at %d, the session has %d bytes", offset, len(f.received))
+	}
+
+	if len(f.putStatuses) > 0 {
+		status := f.putStatuses[0]
+		f.putStatuses = f.putStatuses[1:]
+
+		if f.completeOnInterrupt {
+			f.done = true
+		} else if f.keepBytes < len(body) {
+			body = body[:f.keepBytes]
+		}
+		f.received = append(f.received, body...)
+
+		w.WriteHeader(status)
+		return
+	}
+
+	f.received = append(f.received, body...)
+	f.done = true
+	fmt.Fprint(w, `{"id": "video-id"}`)
+}
+
+func publishTestVideo(t *testing.T, content string) (*PublishResult, error) {
+	filePath := filepath.Join(t.TempDir(), "final.mp4")
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	video := &models.Video{Topic: "The deep sea", Script: "Down there it is dark."}
+	account := &models.PublishingAccount{Destination: DestinationYouTube, Credential: "refresh-token"}
+
+	return youtubePublisher{}.Publish(context.Background(), video, account, filePath)
+}
+
+func TestYouTubePublishUploadsInOneRequest(t *testing.T) {
+	fake := newFakeYouTube(t)
+
+	result, err := publishTestVideo(t, "0123456789")
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	if result.RemoteID != "video-id" || result.RemoteURL != "https://youtube.com/shorts/video-id" {
+		t.Errorf("Publish() = %+v", result)
+	}
+	if string(fake.received) != "0123456789" {
+		t.Errorf("session received %q", fake.received)
+	}
+	if fake.refreshes != 1 {
+		t.Errorf("token refreshed %d times, want 1", fake.refreshes)
+	}
+}
+
+func TestYouTubePublishResumesFromRange(t *testing.T) {
+	fake := newFakeYouTube(t)
+	fake.putStatuses = []int{http.StatusServiceUnavailable}
+	fake.keepBytes = 4
+
+	result, err := publishTestVideo(t, "0123456789")
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	if result.RemoteID != "video-id" {
+		t.Errorf("RemoteID = %q", result.RemoteID)
+	}
+	if string(fake.received) != "0123456789" {
+		t.Errorf("session received %q", fake.received)
+	}
+	if fake.queries != 1 {
+		t.Errorf("status queried %d times, want 1", fake.queries)
+	}
+
+	want := []string{"", "bytes */10", "bytes 4-9/10"}
+	if strings.Join(fake.contentRange, ",") != strings.Join(want, ",") {
+		t.Errorf("content ranges = %q, want %q", fake.contentRange, want)
+	}
+}
+
+func TestYouTubePublishResumesWithoutRange(t *testing.T) {
+	fake := newFakeYouTube(t)
+	fake.putStatuses = []int{http.StatusBadGateway}
+	fake.keepBytes = 0
+
+	if _, err := publishTestVideo(t, "0123456789"); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	// no Range in the answer to the query, the file is sent again
+	want := []string{"", "bytes */10", ""}
+	if strings.Join(fake.contentRange, ",") != strings.Join(want, ",") {
+		t.Errorf("content ranges = %q, want %q", fake.contentRange, want)
+	}
+	if string(fake.received) != "0123456789" {
+		t.Errorf("session received %q", fake.received)
+	}
+}
+
+func TestYouTubePublishCompletedWhileInterrupted(t *testing.T) {
+	fake := newFakeYouTube(t)
+	fake.putStatuses = []int{http.StatusServiceUnavailable}
+	fake.completeOnInterrupt = true
+
+	result, err := publishTestVideo(t, "0123456789")
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	if result.RemoteID != "video-id" {
+		t.Errorf("RemoteID = %q", result.RemoteID)
+	}
+	if len(fake.contentRange) != 2 {
+		t.Errorf("session got %d requests, want the upload and one query", len(fake.contentRange))
+	}
+}
+
+func TestYouTubePublishGivesUpAfterResumes(t *testing.T) {
+	fake := newFakeYouTube(t)
+	for i := 0; i <= youtubeUploadResumes; i++ {
+		fake.putStatuses = append(fake.putStatuses, http.StatusServiceUnavailable)
+	}
+	fake.keepBytes = 1
+
+	_, err := publishTestVideo(t, "0123456789")
+	if err == nil || !strings.Contains(err.Error(), "interrupted too many times") {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	var permanentErr *permanentPublishError
+	if errors.As(err, &permanentErr) {
+		t.Errorf("Publish() error = %v is permanent, the job should retry it", err)
+	}
+	if fake.queries != youtubeUploadResumes {
+		t.Errorf("status queried %d times, want %d", fake.queries, youtubeUploadResumes)
+	}
+}
+
+func TestYouTubePublishErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		tokenStatus int
+		tokenError  string
+		startStatus int
+		permanent   bool
+	}{
+		{name: "revoked refresh token", tokenStatus: http.StatusBadRequest, tokenError: "invalid_grant", permanent: true},
+		{name: "token endpoint down", tokenStatus: http.StatusServiceUnavailable, permanent: false},
+		{name: "forbidden", startStatus: http.StatusForbidden, permanent: true},
+		{name: "invalid metadata", startStatus: http.StatusBadRequest, permanent: true},
+		{name: "expired token", startStatus: http.StatusUnauthorized, permanent: false},
+		{name: "timeout", startStatus: http.StatusRequestTimeout, permanent: false},
+		{name: "rate limited", startStatus: http.StatusTooManyRequests, permanent: false},
+		{name: "server error", startStatus: http.StatusInternalServerError, permanent: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeYouTube(t)
+			fake.tokenStatus = tt.tokenStatus
+			fake.tokenError = tt.tokenError
+			if tt.startStatus != 0 {
+				fake.startStatus = tt.startStatus
+			}
+
+			_, err := publishTestVideo(t, "0123456789")
+			if err == nil {
+				t.Fatal("Publish() succeeded")
+			}
+
+			var permanentErr *permanentPublishError
+			if permanent := errors.As(err, &permanentErr); permanent != tt.permanent {
+				t.Errorf("Publish() error = %v, permanent = %v, want %v", err, permanent, tt.permanent)
+			}
+
+			if len(fake.received) > 0 {
+				t.Errorf("session received %q after a failed start", fake.received)
+			}
+		})
+	}
+}